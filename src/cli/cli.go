@@ -0,0 +1,284 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package cli implements the odm command line tool.
+//
+// The documents and the migrations are registered by a RegisterFunc, either loaded
+// from a go plugin by cmd/odm or given by a main package of the application :
+//
+//	func main() {
+//		os.Exit(cli.Run(os.Args[1:], app.Register, os.Stdout, os.Stderr))
+//	}
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"../mongo"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/yaml.v2"
+)
+
+// RegisterFunc registers the documents and the migrations of an application
+type RegisterFunc func(documentManager mongo.DocumentManager) error
+
+const usage = `usage: odm [-url url] [-db database] command [arguments]
+
+commands:
+	schema:validate              check that the mappings of the documents are valid
+	schema:dump [-format f]      print the mappings as text, json or yaml
+	schema:indexes [sync] [-drop] show the differences between the indexes and the mappings, sync them
+	migrate up                   apply the pending migrations
+	migrate down [steps]         roll back the last applied migrations, 1 by default
+	migrate status               show the status of the migrations
+	integrity:check [-repair]    report the references to missing documents, remove them
+`
+
+// Run runs the command line arguments and returns the exit code of the command
+func Run(args []string, register RegisterFunc, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("odm", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	url := flags.String("url", getEnv("ODM_URL", "localhost"), "mongodb url")
+	database := flags.String("db", os.Getenv("ODM_DATABASE"), "database name, defaults to the database of the url")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	command := &command{args: flags.Args()[1:], stdout: stdout, url: *url, database: *database, register: register}
+	var err error
+	switch flags.Arg(0) {
+	case "schema:validate":
+		err = command.validate()
+	case "schema:dump":
+		err = command.dump()
+	case "schema:indexes":
+		err = command.indexes()
+	case "migrate":
+		err = command.migrate()
+	case "integrity:check":
+		err = command.checkIntegrity()
+	default:
+		fmt.Fprintf(stderr, "unknown command %s\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+type command struct {
+	args     []string
+	stdout   io.Writer
+	url      string
+	database string
+	register RegisterFunc
+	session  *mgo.Session
+}
+
+// documentManager returns a document manager with the registered documents.
+// The commands that don't need a database use a document manager without connection.
+func (command *command) documentManager(connect bool) (mongo.DocumentManager, error) {
+	var database *mgo.Database
+	if connect {
+		session, err := mgo.Dial(command.url)
+		if err != nil {
+			return nil, err
+		}
+		command.session = session
+		database = session.DB(command.database)
+	}
+	documentManager := mongo.NewDocumentManager(database)
+	if err := command.register(documentManager); err != nil {
+		return nil, err
+	}
+	return documentManager, nil
+}
+
+func (command *command) close() {
+	if command.session != nil {
+		command.session.Close()
+	}
+}
+
+func (command *command) validate() error {
+	// annotations are parsed when the documents are registered
+	documentManager, err := command.documentManager(false)
+	if err != nil {
+		return err
+	}
+	errors := documentManager.GetSchemaManager().ValidateMappings()
+	for _, err := range errors {
+		fmt.Fprintln(command.stdout, err)
+	}
+	if len(errors) > 0 {
+		return fmt.Errorf("%d invalid mapping(s)", len(errors))
+	}
+	fmt.Fprintln(command.stdout, "mappings are valid")
+	return nil
+}
+
+func (command *command) dump() error {
+	flags := flag.NewFlagSet("schema:dump", flag.ContinueOnError)
+	format := flags.String("format", "text", "text, json or yaml")
+	if err := flags.Parse(command.args); err != nil {
+		return err
+	}
+	documentManager, err := command.documentManager(false)
+	if err != nil {
+		return err
+	}
+	descriptions := documentManager.GetSchemaManager().DescribeDocuments()
+	var output []byte
+	switch *format {
+	case "json":
+		output, err = json.MarshalIndent(descriptions, "", "  ")
+		output = append(output, '\n')
+	case "yaml":
+		output, err = yaml.Marshal(descriptions)
+	case "text":
+		for _, description := range descriptions {
+			output = append(output, fmt.Sprintf("%s (%s)\n", description.Collection, description.Type)...)
+			for _, field := range description.Fields {
+				output = append(output, fmt.Sprintf("\t%s %s key:%s %s\n", field.Name, field.Type, field.Key, field.Relation)...)
+			}
+			for _, index := range description.Indexes {
+				output = append(output, fmt.Sprintf("\tindex %s\n", index)...)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown format %s", *format)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = command.stdout.Write(output)
+	return err
+}
+
+func (command *command) indexes() error {
+	flags := flag.NewFlagSet("schema:indexes", flag.ContinueOnError)
+	drop := flags.Bool("drop", false, "drop the indexes that are not defined in the mappings")
+	if err := flags.Parse(command.args); err != nil {
+		return err
+	}
+	documentManager, err := command.documentManager(true)
+	if err != nil {
+		return err
+	}
+	defer command.close()
+	schemaManager := documentManager.GetSchemaManager()
+	if flags.Arg(0) == "sync" {
+		if err = schemaManager.SyncIndexes(*drop); err != nil {
+			return err
+		}
+	}
+	diffs, err := schemaManager.DiffIndexes()
+	if err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		if !diff.IsEmpty() {
+			fmt.Fprintln(command.stdout, diff)
+		}
+	}
+	return nil
+}
+
+func (command *command) migrate() error {
+	if len(command.args) == 0 {
+		return fmt.Errorf("migrate expects up, down or status")
+	}
+	documentManager, err := command.documentManager(true)
+	if err != nil {
+		return err
+	}
+	defer command.close()
+	migrator := documentManager.GetMigrator()
+	var ids []string
+	switch command.args[0] {
+	case "up":
+		ids, err = migrator.Up(context.Background())
+	case "down":
+		steps := 1
+		if len(command.args) > 1 {
+			if steps, err = strconv.Atoi(command.args[1]); err != nil {
+				return fmt.Errorf("invalid number of steps %s", command.args[1])
+			}
+		}
+		ids, err = migrator.Down(context.Background(), steps)
+	case "status":
+		statuses, err := migrator.Status(context.Background())
+		for _, status := range statuses {
+			fmt.Fprintln(command.stdout, status)
+		}
+		return err
+	default:
+		return fmt.Errorf("unknown migrate command %s", command.args[0])
+	}
+	for _, id := range ids {
+		fmt.Fprintln(command.stdout, id)
+	}
+	return err
+}
+
+func (command *command) checkIntegrity() error {
+	flags := flag.NewFlagSet("integrity:check", flag.ContinueOnError)
+	repair := flags.Bool("repair", false, "remove the dangling references")
+	if err := flags.Parse(command.args); err != nil {
+		return err
+	}
+	documentManager, err := command.documentManager(true)
+	if err != nil {
+		return err
+	}
+	defer command.close()
+	report, err := documentManager.CheckIntegrity(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, err := range report.MappingErrors {
+		fmt.Fprintln(command.stdout, err)
+	}
+	for _, reference := range report.DanglingReferences {
+		fmt.Fprintln(command.stdout, reference)
+	}
+	if *repair {
+		return documentManager.RepairIntegrity(context.Background(), report)
+	}
+	if report.HasProblems() {
+		return fmt.Errorf("%d dangling reference(s), %d mapping error(s)", len(report.DanglingReferences), len(report.MappingErrors))
+	}
+	return nil
+}
+
+func getEnv(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
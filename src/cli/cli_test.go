@@ -0,0 +1,74 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package cli_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"../cli"
+	"../mongo"
+	"../test"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type Author struct {
+	ID       bson.ObjectId `bson:"_id"`
+	Name     string        `bson:"Name" odm:"index(unique:true)"`
+	Articles []*Article    `odm:"referenceMany(targetDocument:Article,mappedBy:Author)"`
+}
+
+type Article struct {
+	ID     bson.ObjectId `bson:"_id"`
+	Title  string        `bson:"Title"`
+	Author *Author       `odm:"referenceOne(targetDocument:Author)"`
+}
+
+func register(documentManager mongo.DocumentManager) error {
+	return documentManager.RegisterMany(map[string]interface{}{
+		"Author":  new(Author),
+		"Article": new(Article),
+	})
+}
+
+func TestRun_SchemaValidate(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	test.Fatal(t, cli.Run([]string{"schema:validate"}, register, stdout, stderr), 0, stderr.String())
+	// Article is not registered
+	code := cli.Run([]string{"schema:validate"}, func(documentManager mongo.DocumentManager) error {
+		return documentManager.Register("Author", new(Author))
+	}, stdout, stderr)
+	test.Fatal(t, code, 1)
+	test.Fatal(t, strings.Contains(stdout.String(), "target document 'Article' is not registered"), true, stdout.String())
+}
+
+func TestRun_SchemaDump(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	test.Fatal(t, cli.Run([]string{"schema:dump", "-format", "json"}, register, stdout, stderr), 0, stderr.String())
+	descriptions := []mongo.DocumentDescription{}
+	err := json.Unmarshal(stdout.Bytes(), &descriptions)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(descriptions), 2)
+	test.Fatal(t, descriptions[1].Collection, "Author")
+	test.Fatal(t, descriptions[1].Fields[1].Key, "Name")
+	test.Fatal(t, len(descriptions[1].Indexes), 1)
+}
+
+func TestRun_UnknownCommand(t *testing.T) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	test.Fatal(t, cli.Run([]string{"schema:unknown"}, register, stdout, stderr), 2)
+}
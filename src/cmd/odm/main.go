@@ -0,0 +1,66 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Command odm runs schema and data operations on the documents registered by a go plugin.
+// The plugin exports a Register function with the signature of cli.RegisterFunc :
+//
+//	odm -plugin app.so -url mongodb://localhost/app schema:indexes sync
+//
+// The plugin path defaults to the ODM_PLUGIN environment variable.
+package main
+
+import (
+	"fmt"
+	"os"
+	"plugin"
+
+	"../../cli"
+	"../../mongo"
+)
+
+func main() {
+	args := os.Args[1:]
+	path := os.Getenv("ODM_PLUGIN")
+	if len(args) > 1 && args[0] == "-plugin" {
+		path, args = args[1], args[2:]
+	}
+	register, err := loadPlugin(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(cli.Run(args, register, os.Stdout, os.Stderr))
+}
+
+// loadPlugin returns the Register function of a go plugin
+func loadPlugin(path string) (cli.RegisterFunc, error) {
+	if path == "" {
+		return nil, fmt.Errorf("no plugin given, use -plugin path or ODM_PLUGIN")
+	}
+	p, err := plugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	symbol, err := p.Lookup("Register")
+	if err != nil {
+		return nil, err
+	}
+	switch register := symbol.(type) {
+	case func(mongo.DocumentManager) error:
+		return register, nil
+	case *cli.RegisterFunc:
+		return *register, nil
+	}
+	return nil, fmt.Errorf("Register of plugin %s is a %T, func(mongo.DocumentManager) error was expected", path, symbol)
+}
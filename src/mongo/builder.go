@@ -0,0 +1,291 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"time"
+)
+
+// CascadeType is how related documents are persisted or removed with a document
+type CascadeType string
+
+const (
+	// Persist persists the related documents with the document
+	Persist CascadeType = "persist"
+	// Remove removes the related documents with the document
+	Remove CascadeType = "remove"
+	// All persists and removes the related documents with the document
+	All CascadeType = "all"
+)
+
+// LoadType is how the relations of related documents are loaded
+type LoadType string
+
+const (
+	// Lazy doesn't load the relations of related documents
+	Lazy LoadType = "lazy"
+	// Eager loads the relations of related documents
+	Eager LoadType = "eager"
+)
+
+// StorageType is how references to related documents are stored
+type StorageType string
+
+const (
+	// StoreAsID stores the ObjectId of the related document
+	StoreAsID StorageType = "id"
+	// StoreAsDBRef stores a DBRef { $ref, $id }
+	StoreAsDBRef StorageType = "dbRef"
+	// StoreAsDBRefWithDB stores a DBRef { $ref, $id, $db }
+	StoreAsDBRefWithDB StorageType = "dbRefWithDB"
+)
+
+// MappingBuilder builds the Mapping of a document type :
+//
+//	err := documentManager.Map(new(Article)).Collection("articles").
+//		Field("Title").Index().Unique().
+//		ReferenceOne("Author", "authors").Cascade(mongo.All).
+//		Register()
+type MappingBuilder struct {
+	manager  *defaultDocumentManager
+	document interface{}
+	mapping  Mapping
+}
+
+// Map returns a builder of the mapping of a document type, document is a pointer to struct
+func (manager *defaultDocumentManager) Map(document interface{}) *MappingBuilder {
+	return &MappingBuilder{manager: manager, document: document, mapping: Mapping{Fields: map[string]FieldMapping{}}}
+}
+
+// Collection sets the collection of the documents
+func (builder *MappingBuilder) Collection(name string) *MappingBuilder {
+	builder.mapping.Collection = name
+	return builder
+}
+
+// ID sets the struct field holding the id
+func (builder *MappingBuilder) ID(fieldName string) *MappingBuilder {
+	builder.mapping.ID = fieldName
+	return builder
+}
+
+// Field maps a struct field
+func (builder *MappingBuilder) Field(name string) *FieldBuilder {
+	builder.updateField(name, func(*FieldMapping) {})
+	return &FieldBuilder{builder, name}
+}
+
+// ReferenceOne maps a struct field holding a related document stored in the targetDocument collection
+func (builder *MappingBuilder) ReferenceOne(fieldName string, targetDocument string) *RelationBuilder {
+	relation := &RelationMapping{TargetDocument: targetDocument}
+	builder.updateField(fieldName, func(field *FieldMapping) { field.ReferenceOne = relation })
+	return &RelationBuilder{builder, relation}
+}
+
+// ReferenceMany maps a struct field holding related documents stored in the targetDocument collection
+func (builder *MappingBuilder) ReferenceMany(fieldName string, targetDocument string) *RelationBuilder {
+	relation := &RelationMapping{TargetDocument: targetDocument}
+	builder.updateField(fieldName, func(field *FieldMapping) { field.ReferenceMany = relation })
+	return &RelationBuilder{builder, relation}
+}
+
+// Mapping returns the mapping built
+func (builder *MappingBuilder) Mapping() Mapping {
+	return builder.mapping
+}
+
+// Register registers the document type with the mapping built
+func (builder *MappingBuilder) Register() error {
+	return builder.manager.RegisterMapping(builder.document, builder.mapping)
+}
+
+func (builder *MappingBuilder) updateField(name string, update func(field *FieldMapping)) {
+	field := builder.mapping.Fields[name]
+	update(&field)
+	builder.mapping.Fields[name] = field
+}
+
+// FieldBuilder builds the mapping of a struct field
+type FieldBuilder struct {
+	*MappingBuilder
+	name string
+}
+
+// Key sets the document key of the field, it must be the key the field is decoded from
+func (builder *FieldBuilder) Key(key string) *FieldBuilder {
+	builder.updateField(builder.name, func(field *FieldMapping) { field.Key = key })
+	return builder
+}
+
+// Omitempty doesn't store the zero value of the field
+func (builder *FieldBuilder) Omitempty() *FieldBuilder {
+	builder.updateField(builder.name, func(field *FieldMapping) { field.Omitempty = true })
+	return builder
+}
+
+// Ignore doesn't store the field
+func (builder *FieldBuilder) Ignore() *FieldBuilder {
+	builder.updateField(builder.name, func(field *FieldMapping) { field.Ignore = true })
+	return builder
+}
+
+// SoftDelete makes the field, a time.Time or a *time.Time, hold the time the document was removed
+func (builder *FieldBuilder) SoftDelete() *FieldBuilder {
+	builder.updateField(builder.name, func(field *FieldMapping) { field.SoftDelete = true })
+	return builder
+}
+
+// Index indexes the field
+func (builder *FieldBuilder) Index() *IndexBuilder {
+	builder.updateField(builder.name, func(field *FieldMapping) { field.Index = &IndexMapping{} })
+	return &IndexBuilder{builder, func(update func(index *IndexMapping)) {
+		builder.updateField(builder.name, func(field *FieldMapping) { update(field.Index) })
+	}}
+}
+
+// Composite adds the field to the composite index named name, a composite index is unique by default
+func (builder *FieldBuilder) Composite(name string) *IndexBuilder {
+	position := 0
+	builder.updateField(builder.name, func(field *FieldMapping) {
+		position = len(field.Composites)
+		field.Composites = append(field.Composites, IndexMapping{Name: name})
+	})
+	return &IndexBuilder{builder, func(update func(index *IndexMapping)) {
+		builder.updateField(builder.name, func(field *FieldMapping) { update(&field.Composites[position]) })
+	}}
+}
+
+// IndexBuilder builds the mapping of an index
+type IndexBuilder struct {
+	*FieldBuilder
+	update func(update func(index *IndexMapping))
+}
+
+// Unique makes the index unique
+func (builder *IndexBuilder) Unique() *IndexBuilder {
+	unique := true
+	builder.update(func(index *IndexMapping) { index.Unique = &unique })
+	return builder
+}
+
+// NotUnique makes a composite index not unique
+func (builder *IndexBuilder) NotUnique() *IndexBuilder {
+	unique := false
+	builder.update(func(index *IndexMapping) { index.Unique = &unique })
+	return builder
+}
+
+// Descending sorts the index in descending order
+func (builder *IndexBuilder) Descending() *IndexBuilder {
+	builder.update(func(index *IndexMapping) { index.Order = "desc" })
+	return builder
+}
+
+// Sparse only indexes the documents in which the field exists
+func (builder *IndexBuilder) Sparse() *IndexBuilder {
+	builder.update(func(index *IndexMapping) { index.Sparse = true })
+	return builder
+}
+
+// ExpireAfter removes the documents after duration
+func (builder *IndexBuilder) ExpireAfter(duration time.Duration) *IndexBuilder {
+	builder.update(func(index *IndexMapping) { index.ExpireAfter = int(duration / time.Second) })
+	return builder
+}
+
+// PartialFilterExists only indexes the documents in which the field exists
+func (builder *IndexBuilder) PartialFilterExists() *IndexBuilder {
+	builder.update(func(index *IndexMapping) { index.PartialFilter = "exists" })
+	return builder
+}
+
+// Type sets the type of the index, either text, 2dsphere or hashed
+func (builder *IndexBuilder) Type(indexType string) *IndexBuilder {
+	builder.update(func(index *IndexMapping) { index.Type = indexType })
+	return builder
+}
+
+// Name sets the name of an index
+func (builder *IndexBuilder) Name(name string) *IndexBuilder {
+	builder.update(func(index *IndexMapping) { index.Name = name })
+	return builder
+}
+
+// RelationBuilder builds the mapping of a relation
+type RelationBuilder struct {
+	*MappingBuilder
+	relation *RelationMapping
+}
+
+// Cascade sets how the related documents are persisted or removed with the document
+func (builder *RelationBuilder) Cascade(cascade CascadeType) *RelationBuilder {
+	builder.relation.Cascade = string(cascade)
+	return builder
+}
+
+// Load sets how the relations of related documents are loaded
+func (builder *RelationBuilder) Load(load LoadType) *RelationBuilder {
+	builder.relation.Load = string(load)
+	return builder
+}
+
+// MappedBy sets the field of the related document holding the references of the relation
+func (builder *RelationBuilder) MappedBy(fieldName string) *RelationBuilder {
+	builder.relation.MappedBy = fieldName
+	return builder
+}
+
+// InversedBy sets the field of the related document mapped by the relation
+func (builder *RelationBuilder) InversedBy(fieldName string) *RelationBuilder {
+	builder.relation.InversedBy = fieldName
+	return builder
+}
+
+// StoreID stores the references in the struct field named fieldName
+func (builder *RelationBuilder) StoreID(fieldName string) *RelationBuilder {
+	builder.relation.StoreID = fieldName
+	return builder
+}
+
+// StoreAs sets how the references are stored
+func (builder *RelationBuilder) StoreAs(storage StorageType) *RelationBuilder {
+	builder.relation.StoreAs = string(storage)
+	return builder
+}
+
+// Through stores the links of a referenceMany relation in a join collection
+func (builder *RelationBuilder) Through(collection string, joinKey string, inverseJoinKey string) *RelationBuilder {
+	builder.relation.Through = collection
+	builder.relation.JoinKey = joinKey
+	builder.relation.InverseJoinKey = inverseJoinKey
+	return builder
+}
+
+// Sort sorts the related documents of a referenceMany relation by a field, in descending order if descending is true
+func (builder *RelationBuilder) Sort(fieldName string, descending bool) *RelationBuilder {
+	builder.relation.Sort = fieldName
+	builder.relation.Order = ""
+	if descending {
+		builder.relation.Order = "desc"
+	}
+	return builder
+}
+
+// Limit limits the number of related documents of a referenceMany relation,
+// the references past the limit are kept when the document is persisted
+func (builder *RelationBuilder) Limit(limit int) *RelationBuilder {
+	builder.relation.Limit = limit
+	return builder
+}
@@ -0,0 +1,260 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ClassMetadata is a read-only view of the mapping of a registered document type,
+// for tools like admin UIs, exporters or generic handlers
+type ClassMetadata struct {
+	meta metadata
+}
+
+// FieldMetadata is the mapping of a struct field
+type FieldMetadata struct {
+	// Name is the struct field name
+	Name string
+	// Key is the document key of the field
+	Key string
+	// Type is the go type of the field
+	Type reflect.Type
+	// Omitempty is true if the zero value of the field isn't stored
+	Omitempty bool
+	// ID is true if the field holds the id of the document
+	ID bool
+	// Indexed is true if the field belongs to an index or a composite index
+	Indexed bool
+	// SoftDelete is true if the field holds the time the document was soft deleted
+	SoftDelete bool
+	// Relation is the relation held by the field, nil if none
+	Relation *RelationMetadata
+}
+
+// RelationMetadata is the mapping of a relation
+type RelationMetadata struct {
+	// Type is either referenceOne or referenceMany
+	Type string
+	// TargetDocument is the collection of the related documents
+	TargetDocument string
+	// Cascade is empty if the related documents aren't persisted or removed with the document
+	Cascade CascadeType
+	Load    LoadType
+	// MappedBy is the field of the related document holding the references of the relation
+	MappedBy string
+	// InversedBy is the field of the related document mapped by the relation
+	InversedBy string
+	// StoreID is the struct field storing the references
+	StoreID string
+	StoreAs StorageType
+	// Through is the join collection of a referenceMany relation
+	Through        string
+	JoinKey        string
+	InverseJoinKey string
+	// Sort is the field the related documents are sorted by
+	Sort       string
+	Descending bool
+	Limit      int
+}
+
+// GetMetadataFor returns the metadata of a registered document type.
+// typeOrValue is either a document, a pointer to document, their reflect.Type or a collection name
+func (manager *defaultDocumentManager) GetMetadataFor(typeOrValue interface{}) (*ClassMetadata, error) {
+	var Type reflect.Type
+	switch value := typeOrValue.(type) {
+	case string:
+		if _, Type = manager.metadatas.findMetadataByCollectionName(value); Type == nil {
+			return nil, ErrDocumentNotRegistered
+		}
+	case reflect.Type:
+		Type = value
+	default:
+		Type = reflect.TypeOf(typeOrValue)
+	}
+	if Type != nil && Type.Kind() == reflect.Struct {
+		Type = reflect.PtrTo(Type)
+	}
+	meta, err := manager.metadatas.getMetadatas(Type)
+	if err != nil {
+		return nil, err
+	}
+	return &ClassMetadata{meta}, nil
+}
+
+// AllMetadata returns the metadata of the registered document types sorted by collection name
+func (manager *defaultDocumentManager) AllMetadata() []*ClassMetadata {
+	classMetadatas := []*ClassMetadata{}
+	for _, meta := range manager.metadatas {
+		classMetadatas = append(classMetadatas, &ClassMetadata{meta})
+	}
+	sort.Slice(classMetadatas, func(i, j int) bool {
+		return classMetadatas[i].meta.targetDocument < classMetadatas[j].meta.targetDocument
+	})
+	return classMetadatas
+}
+
+// Collection returns the collection of the documents
+func (classMetadata *ClassMetadata) Collection() string {
+	return classMetadata.meta.targetDocument
+}
+
+// Type returns the type of the documents, a pointer to struct
+func (classMetadata *ClassMetadata) Type() reflect.Type {
+	return classMetadata.meta.structType
+}
+
+// IDField returns the struct field holding the id
+func (classMetadata *ClassMetadata) IDField() string {
+	return classMetadata.meta.idField
+}
+
+// IDKey returns the document key holding the id
+func (classMetadata *ClassMetadata) IDKey() string {
+	if field, ok := classMetadata.meta.findIDField(); ok {
+		return field.key
+	}
+	return classMetadata.meta.idKey
+}
+
+// Fields returns the mapped fields in the order of the struct
+func (classMetadata *ClassMetadata) Fields() []FieldMetadata {
+	fields := []FieldMetadata{}
+	for _, field := range classMetadata.meta.fields {
+		fields = append(fields, classMetadata.fieldMetadata(field))
+	}
+	return fields
+}
+
+// Field returns the mapping of a struct field, false if the field isn't mapped
+func (classMetadata *ClassMetadata) Field(name string) (FieldMetadata, bool) {
+	field, ok := classMetadata.meta.findField(name)
+	if !ok {
+		return FieldMetadata{}, false
+	}
+	return classMetadata.fieldMetadata(field), true
+}
+
+// Relations returns the mapped fields holding a relation
+func (classMetadata *ClassMetadata) Relations() []FieldMetadata {
+	fields := []FieldMetadata{}
+	for _, field := range classMetadata.meta.getFieldsWithRelation() {
+		fields = append(fields, classMetadata.fieldMetadata(field))
+	}
+	return fields
+}
+
+// Indexes returns the indexes defined by the mapping
+func (classMetadata *ClassMetadata) Indexes() []Index {
+	return classMetadata.meta.getAllIndexes()
+}
+
+// NewInstance returns a pointer to a new document
+func (classMetadata *ClassMetadata) NewInstance() interface{} {
+	return reflect.New(classMetadata.meta.structType.Elem()).Interface()
+}
+
+// GetFieldValue returns the value of the field name of document
+func (classMetadata *ClassMetadata) GetFieldValue(document interface{}, name string) (interface{}, error) {
+	Value, err := classMetadata.fieldValue(document, name)
+	if err != nil {
+		return nil, err
+	}
+	return Value.Interface(), nil
+}
+
+// SetFieldValue sets the field name of document to value, value must be assignable to the field
+func (classMetadata *ClassMetadata) SetFieldValue(document interface{}, name string, value interface{}) error {
+	Value, err := classMetadata.fieldValue(document, name)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		Value.Set(reflect.Zero(Value.Type()))
+		return nil
+	}
+	newValue := reflect.ValueOf(value)
+	if !newValue.Type().AssignableTo(Value.Type()) {
+		if !newValue.Type().ConvertibleTo(Value.Type()) {
+			return fmt.Errorf("Error %s can't be assigned to %s.%s of type %s", newValue.Type(),
+				classMetadata.meta.targetDocument, name, Value.Type())
+		}
+		newValue = newValue.Convert(Value.Type())
+	}
+	Value.Set(newValue)
+	return nil
+}
+
+// fieldValue returns the value of a mapped field of document
+func (classMetadata *ClassMetadata) fieldValue(document interface{}, name string) (reflect.Value, error) {
+	if reflect.TypeOf(document) != classMetadata.meta.structType {
+		return reflect.Value{}, fmt.Errorf("Error %T is not a %s", document, classMetadata.meta.structType)
+	}
+	if reflect.ValueOf(document).IsNil() {
+		return reflect.Value{}, ErrNotAPointer
+	}
+	if _, ok := classMetadata.meta.findField(name); !ok {
+		return reflect.Value{}, ErrFieldNotFound
+	}
+	return reflect.ValueOf(document).Elem().FieldByName(name), nil
+}
+
+func (classMetadata *ClassMetadata) fieldMetadata(field field) FieldMetadata {
+	fieldMetadata := FieldMetadata{Name: field.name, Key: field.key, Omitempty: field.omitempty,
+		ID: field.name == classMetadata.meta.idField, Indexed: field.index || field.composite,
+		SoftDelete: field.name == classMetadata.meta.softDelete}
+	if structField, ok := classMetadata.meta.structType.Elem().FieldByName(field.name); ok {
+		fieldMetadata.Type = structField.Type
+	}
+	if field.hasRelation() {
+		fieldMetadata.Relation = newRelationMetadata(field.relation)
+	}
+	return fieldMetadata
+}
+
+func newRelationMetadata(relation relation) *RelationMetadata {
+	relationMetadata := &RelationMetadata{Type: relation.relation.String(), TargetDocument: relation.targetDocument,
+		Load: Lazy, StoreID: relation.idStorageField, StoreAs: StoreAsID, Through: relation.through,
+		JoinKey: relation.joinKey, InverseJoinKey: relation.inverseJoinKey, Limit: relation.limit}
+	switch relation.cascade {
+	case all:
+		relationMetadata.Cascade = All
+	case persist:
+		relationMetadata.Cascade = Persist
+	case remove:
+		relationMetadata.Cascade = Remove
+	}
+	if relation.load == eager {
+		relationMetadata.Load = Eager
+	}
+	switch relation.mapped {
+	case mappedBy:
+		relationMetadata.MappedBy = relation.mappedField
+	case inversedBy:
+		relationMetadata.InversedBy = relation.mappedField
+	}
+	switch relation.storeAs {
+	case storeAsDBRef:
+		relationMetadata.StoreAs = StoreAsDBRef
+	case storeAsDBRefWithDB:
+		relationMetadata.StoreAs = StoreAsDBRefWithDB
+	}
+	relationMetadata.Descending = strings.HasPrefix(relation.sort, "-")
+	relationMetadata.Sort = strings.TrimPrefix(relation.sort, "-")
+	return relationMetadata
+}
@@ -0,0 +1,138 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CollectionOptions are the options of the collection of a document type,
+// given to DocumentManager.RegisterWithOptions
+type CollectionOptions struct {
+	// Capped creates a capped collection of at most MaxBytes bytes and MaxDocs documents
+	Capped   bool
+	MaxBytes int
+	MaxDocs  int
+	// Collation is the default collation of the collection
+	Collation *mgo.Collation
+	// Validator is the validator of the collection, usually a {$jsonSchema:...} document
+	Validator interface{}
+	// ValidationLevel is either off, strict or moderate
+	ValidationLevel string
+	// ValidationAction is either error or warn
+	ValidationAction string
+	// ReadMode is the read preference of every read of the collection
+	ReadMode *mgo.Mode
+	// WriteConcern is the write concern of every write to the collection
+	WriteConcern *mgo.Safe
+}
+
+func (options *CollectionOptions) String() string {
+	if options == nil {
+		return "<nil>"
+	}
+	return fmt.Sprintf("{capped:%v maxBytes:%d maxDocs:%d collation:%v validator:%v readMode:%v writeConcern:%v}",
+		options.Capped, options.MaxBytes, options.MaxDocs, options.Collation, options.Validator, options.ReadMode, options.WriteConcern)
+}
+
+// hasSessionOptions returns true if the collection requires its own session
+func (options *CollectionOptions) hasSessionOptions() bool {
+	return options != nil && (options.ReadMode != nil || options.WriteConcern != nil)
+}
+
+// createCommand returns the create command of a collection named name
+func (options *CollectionOptions) createCommand(name string) bson.D {
+	command := bson.D{{Name: "create", Value: name}}
+	if options == nil {
+		return command
+	}
+	if options.Capped {
+		command = append(command, bson.DocElem{Name: "capped", Value: true}, bson.DocElem{Name: "size", Value: options.MaxBytes})
+		if options.MaxDocs > 0 {
+			command = append(command, bson.DocElem{Name: "max", Value: options.MaxDocs})
+		}
+	}
+	if options.Collation != nil {
+		command = append(command, bson.DocElem{Name: "collation", Value: options.Collation})
+	}
+	if options.Validator != nil {
+		command = append(command, bson.DocElem{Name: "validator", Value: options.Validator})
+	}
+	if options.ValidationLevel != "" {
+		command = append(command, bson.DocElem{Name: "validationLevel", Value: options.ValidationLevel})
+	}
+	if options.ValidationAction != "" {
+		command = append(command, bson.DocElem{Name: "validationAction", Value: options.ValidationAction})
+	}
+	return command
+}
+
+// RegisterWithOptions registers a document type like Register, the options
+// are used to create the collection and for every read or write of the collection.
+func (manager *defaultDocumentManager) RegisterWithOptions(collectionName string, document interface{}, options *CollectionOptions) error {
+	if err := manager.Register(collectionName, document); err != nil {
+		return err
+	}
+	meta := manager.metadatas[reflect.TypeOf(document)]
+	meta.collectionOptions = options
+	manager.setMetadata(meta)
+	return nil
+}
+
+// collection returns the collection named name, with the read preference and the write concern
+// of its collection options
+func (manager *defaultDocumentManager) collection(name string) Collection {
+	meta, _ := manager.metadatas.findMetadataByCollectionName(name)
+	return manager.storage.C(name, meta.collectionOptions)
+}
+
+// find queries the documents of the collection named name matching query and the enabled filters,
+// soft deleted documents are excluded unless the document manager includes them
+func (manager *defaultDocumentManager) find(name string, query interface{}) Query {
+	meta, _ := manager.metadatas.findMetadataByCollectionName(name)
+	conditions := manager.filterConditions(meta)
+	if condition := manager.softDeleteFilter(meta); condition != nil {
+		conditions = append(conditions, condition)
+	}
+	return manager.collection(name).Find(and(query, conditions))
+}
+
+// CreateCollections creates the collections of the registered documents that don't exist yet
+// with their collection options. Existing collections are left untouched.
+func (schemaManager *defaultSchemaManager) CreateCollections() error {
+	names, err := schemaManager.documentManager.storage.CollectionNames()
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for _, name := range names {
+		existing[name] = true
+	}
+	for _, meta := range schemaManager.sortedMetadatas() {
+		if existing[meta.targetDocument] {
+			schemaManager.documentManager.log(fmt.Sprintf("Collection %s already exists", meta.targetDocument))
+			continue
+		}
+		if err = schemaManager.documentManager.storage.Run(meta.collectionOptions.createCommand(meta.targetDocument), nil); err != nil {
+			return err
+		}
+		schemaManager.documentManager.log(fmt.Sprintf("Created collection %s with options %s", meta.targetDocument, meta.collectionOptions))
+	}
+	return nil
+}
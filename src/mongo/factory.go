@@ -0,0 +1,102 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+)
+
+// DocumentManagerFactory creates document managers sharing the document types registered in a document manager.
+// A document manager isn't safe for concurrent use, a factory creates one per goroutine, for each HTTP request
+// for instance, without registering the document types again.
+type DocumentManagerFactory interface {
+	// Create returns a document manager with its own pending documents and its own copy of the connection
+	// of the storage. Close must be called when the document manager isn't used anymore.
+	Create() DocumentManager
+	// CreateForTenant returns a document manager like Create which operations use the storage of tenant
+	// when the storage is a NewTenantStorage, the indexes are ensured in the storage of tenant
+	CreateForTenant(tenant string) (DocumentManager, error)
+}
+
+// copyableStorage is implemented by the storages which connection shouldn't be shared between goroutines
+type copyableStorage interface {
+	Storage
+	// Copy returns a copy of the storage with its own connection
+	Copy() Storage
+	// Close releases the connection of a copy
+	Close()
+}
+
+type defaultDocumentManagerFactory struct {
+	storage        Storage
+	metadatas      metadatas
+	ensured        *ensuredTypes
+	filters        map[string]Filter
+	enabledFilters map[string]FilterParameters
+}
+
+// NewDocumentManagerFactory returns a factory of document managers using the storage and the document types
+// registered in manager. The factory is safe for concurrent use, its document types can't be changed :
+// the document types registered in manager afterwards are not shared, the document types registered
+// in a document manager created by the factory only belong to that document manager.
+// The filters registered and enabled in manager are registered and enabled in the document managers created,
+// which enable or disable them independently.
+func NewDocumentManagerFactory(manager DocumentManager) DocumentManagerFactory {
+	metadatas := metadatas{}
+	for _, classMetadata := range manager.AllMetadata() {
+		metadatas[classMetadata.meta.structType] = classMetadata.meta
+	}
+	factory := &defaultDocumentManagerFactory{storage: manager.GetStorage(), metadatas: metadatas, ensured: newEnsuredTypes(),
+		filters: map[string]Filter{}, enabledFilters: map[string]FilterParameters{}}
+	if manager, ok := manager.(*defaultDocumentManager); ok {
+		for name, filter := range manager.filters {
+			factory.filters[name] = filter
+		}
+		for name, parameters := range manager.enabledFilters {
+			factory.enabledFilters[name] = parameters
+		}
+	}
+	return factory
+}
+
+// Create returns a document manager, a copy of the mgo session if the storage is a NewMgoStorage.
+// The indexes of a tenant are ensured once for all the document managers of the factory.
+func (factory *defaultDocumentManagerFactory) Create() DocumentManager {
+	manager := NewDocumentManagerWithStorage(factory.storage).(*defaultDocumentManager)
+	manager.metadatas = factory.metadatas
+	manager.sharedMetadatas = true
+	manager.schemaManager.ensured = factory.ensured
+	for name, filter := range factory.filters {
+		manager.filters[name] = filter
+	}
+	for name, parameters := range factory.enabledFilters {
+		manager.enabledFilters[name] = parameters
+	}
+	if storage, ok := factory.storage.(copyableStorage); ok {
+		copied := storage.Copy()
+		manager.storage = copied
+		manager.release = copied.(copyableStorage).Close
+	}
+	return manager
+}
+
+func (factory *defaultDocumentManagerFactory) CreateForTenant(tenant string) (DocumentManager, error) {
+	manager := factory.Create().(*defaultDocumentManager).withContext(WithTenant(context.Background(), tenant))
+	if err := manager.ensureTenantIndexes(); err != nil {
+		manager.Close()
+		return nil, err
+	}
+	return manager, nil
+}
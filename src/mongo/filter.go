@@ -0,0 +1,199 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Filter is a global query filter. Once registered with DocumentManager.RegisterFilter and enabled
+// with DocumentManager.EnableFilter, its condition is ANDed into the finders, the queries, the relation lookups
+// and the writes of the document manager.
+type Filter interface {
+	// Condition returns the condition on the documents of class given the parameters of the filter,
+	// nil if the filter doesn't apply to them
+	Condition(class *ClassMetadata, parameters FilterParameters) bson.M
+	// Stamp sets the filtered fields of a document of class before it is persisted
+	Stamp(class *ClassMetadata, document interface{}, parameters FilterParameters) error
+}
+
+// FilterParameters are the parameters a filter is enabled with
+type FilterParameters map[string]interface{}
+
+// FieldFilter filters the documents which type has the struct field Field on the value of the parameter Parameter
+// and sets the field of the documents persisted to that value :
+//
+//	err := documentManager.RegisterFilter("tenant", mongo.FieldFilter{Field: "TenantID", Parameter: "tenantID"})
+//	err = documentManager.EnableFilter("tenant", mongo.FilterParameters{"tenantID": tenantID})
+type FieldFilter struct {
+	Field     string
+	Parameter string
+}
+
+// filterValidator is implemented by the filters which definition and parameters are checked
+// when they are registered and enabled
+type filterValidator interface {
+	validate(metadatas metadatas) error
+	validateParameters(parameters FilterParameters) error
+}
+
+// validate checks that at least one registered document has the filtered field,
+// so that a misspelled field doesn't silently disable the filter
+func (filter FieldFilter) validate(metadatas metadatas) error {
+	for _, meta := range metadatas {
+		if _, ok := meta.findField(filter.Field); ok {
+			return nil
+		}
+	}
+	return ErrFilterFieldNotFound
+}
+
+// validateParameters checks that the filter is enabled with its parameter,
+// so that the documents aren't filtered on a nil value
+func (filter FieldFilter) validateParameters(parameters FilterParameters) error {
+	if parameters[filter.Parameter] == nil {
+		return ErrFilterParameterMissing
+	}
+	return nil
+}
+
+func (filter FieldFilter) Condition(class *ClassMetadata, parameters FilterParameters) bson.M {
+	field, ok := class.meta.findField(filter.Field)
+	if !ok {
+		return nil
+	}
+	return bson.M{field.key: parameters[filter.Parameter]}
+}
+
+func (filter FieldFilter) Stamp(class *ClassMetadata, document interface{}, parameters FilterParameters) error {
+	if _, ok := class.meta.findField(filter.Field); !ok {
+		return nil
+	}
+	Field := reflect.ValueOf(document).Elem().FieldByName(filter.Field)
+	Value := reflect.ValueOf(parameters[filter.Parameter])
+	if !Value.IsValid() || !Value.Type().ConvertibleTo(Field.Type()) {
+		return fmt.Errorf("Error the parameter '%s' of type %T can't be assigned to the field %s of type %s",
+			filter.Parameter, parameters[filter.Parameter], filter.Field, Field.Type())
+	}
+	Field.Set(Value.Convert(Field.Type()))
+	return nil
+}
+
+func (manager *defaultDocumentManager) RegisterFilter(name string, filter Filter) error {
+	if validator, ok := filter.(filterValidator); ok {
+		if err := validator.validate(manager.metadatas); err != nil {
+			return err
+		}
+	}
+	manager.filters[name] = filter
+	return nil
+}
+
+func (manager *defaultDocumentManager) EnableFilter(name string, parameters FilterParameters) error {
+	filter, ok := manager.filters[name]
+	if !ok {
+		return ErrFilterNotRegistered
+	}
+	if validator, ok := filter.(filterValidator); ok {
+		if err := validator.validateParameters(parameters); err != nil {
+			return err
+		}
+	}
+	manager.enabledFilters[name] = parameters
+	return nil
+}
+
+func (manager *defaultDocumentManager) DisableFilter(name string) {
+	delete(manager.enabledFilters, name)
+}
+
+func (manager *defaultDocumentManager) IsFilterEnabled(name string) bool {
+	_, ok := manager.enabledFilters[name]
+	return ok
+}
+
+// enabledFilterNames returns the names of the enabled filters in alphabetical order
+func (manager *defaultDocumentManager) enabledFilterNames() []string {
+	names := []string{}
+	for name := range manager.enabledFilters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// filterConditions returns the conditions of the enabled filters on the documents of meta
+func (manager *defaultDocumentManager) filterConditions(meta metadata) []interface{} {
+	conditions := []interface{}{}
+	if meta.structType == nil {
+		return conditions
+	}
+	for _, name := range manager.enabledFilterNames() {
+		if condition := manager.filters[name].Condition(&ClassMetadata{meta}, manager.enabledFilters[name]); condition != nil {
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions
+}
+
+// stamp sets the fields of a document filtered by the enabled filters
+func (manager *defaultDocumentManager) stamp(document interface{}, meta metadata) error {
+	for _, name := range manager.enabledFilterNames() {
+		if err := manager.filters[name].Stamp(&ClassMetadata{meta}, document, manager.enabledFilters[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkVisible returns ErrFilteredDocument if the document of meta with the id id exists
+// but its filtered fields don't match the enabled filters, so that a write selecting a document
+// by id doesn't change the document of another tenant. It returns nil if the document doesn't exist.
+func (manager *defaultDocumentManager) checkVisible(meta metadata, id interface{}) error {
+	conditions := manager.filterConditions(meta)
+	if len(conditions) == 0 {
+		return nil
+	}
+	collection := manager.collection(meta.targetDocument)
+	if count, err := collection.Find(bson.M{"_id": id}).Count(); err != nil || count == 0 {
+		return err
+	}
+	count, err := collection.Find(and(bson.M{"_id": id}, conditions)).Count()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrFilteredDocument
+	}
+	return nil
+}
+
+// and returns the conjunction of query and conditions
+func and(query interface{}, conditions []interface{}) interface{} {
+	if len(conditions) == 0 {
+		return query
+	}
+	if query != nil {
+		conditions = append([]interface{}{query}, conditions...)
+	}
+	if len(conditions) == 1 {
+		return conditions[0]
+	}
+	return bson.M{"$and": conditions}
+}
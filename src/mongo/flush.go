@@ -0,0 +1,81 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+)
+
+// Operation is a write of a flush
+type Operation struct {
+	// Type is insert, update, remove or restore
+	Type string
+	// Collection is the collection of the document
+	Collection string
+	Document   interface{}
+}
+
+// FlushResult reports the documents written by a flush and the documents which failed
+type FlushResult struct {
+	// Operations are the writes executed, in order
+	Operations []Operation
+	// Failures are the writes which failed
+	Failures []*FlushError
+}
+
+// Inserted returns the documents inserted, with their related documents saved by cascade
+func (result *FlushResult) Inserted() []interface{} {
+	return result.documents(insert)
+}
+
+// Updated returns the documents which already had an id when persisted
+func (result *FlushResult) Updated() []interface{} {
+	return result.documents(update)
+}
+
+// Removed returns the documents removed or soft deleted
+func (result *FlushResult) Removed() []interface{} {
+	return result.documents(del)
+}
+
+// Restored returns the soft deleted documents restored
+func (result *FlushResult) Restored() []interface{} {
+	return result.documents(restore)
+}
+
+func (result *FlushResult) documents(theTask task) []interface{} {
+	documents := []interface{}{}
+	for _, operation := range result.Operations {
+		if operation.Type == theTask.String() {
+			documents = append(documents, operation.Document)
+		}
+	}
+	return documents
+}
+
+// FlushError is the failure of the write of a document during a flush,
+// Err is the error of the storage
+type FlushError struct {
+	Operation
+	Err error
+}
+
+func (err *FlushError) Error() string {
+	return fmt.Sprintf("Error during the %s of a %T in collection '%s' : %s", err.Type, err.Document, err.Collection, err.Err)
+}
+
+func (err *FlushError) Unwrap() error {
+	return err.Err
+}
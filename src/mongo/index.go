@@ -0,0 +1,199 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"../tag"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// Index is an index of a collection
+type Index struct {
+	mgo.Index
+	// PartialFilter only indexes the documents matching the filter
+	PartialFilter bson.M
+}
+
+// indexOptions are the options of an index or of a field of a composite index,
+// as defined by the parameters of an index or composite annotation :
+//
+//	index(unique:true,order:desc,sparse:true,expireAfter:3600,partialFilter:exists,type:text,name:title)
+//	composite(name:byOwner,unique:false,order:desc);composite(name:bySlug)
+type indexOptions struct {
+	// name is the name of the index, or the name of the group of a composite index
+	name       string
+	unique     bool
+	descending bool
+	sparse     bool
+	// expireAfter is the time to live of documents with a TTL index
+	expireAfter time.Duration
+	// partialFilter only indexes documents in which the key exists
+	partialFilter bool
+	// indexType is either text, 2dsphere (type:geo) or hashed
+	indexType string
+}
+
+// parseIndexOptions parses the parameters of an index or a composite annotation.
+// unique is the uniqueness of the index when the unique parameter is missing.
+// The invalid parameter is returned with the error.
+func parseIndexOptions(definition *tag.Definition, unique bool) (options indexOptions, parameter string, err error) {
+	options.unique = unique
+	for _, parameter := range definition.Parameters {
+		switch strings.ToLower(parameter.Key) {
+		case "unique":
+			options.unique = strings.ToLower(parameter.Value) != "false"
+		case "sparse":
+			options.sparse = strings.ToLower(parameter.Value) != "false"
+		case "name":
+			options.name = parameter.Value
+		case "order":
+			options.descending = strings.ToLower(parameter.Value) == "desc"
+		case "expireafter":
+			seconds, err := strconv.Atoi(parameter.Value)
+			if err != nil {
+				return options, parameter.Key, fmt.Errorf("expireAfter must be a number of seconds, got '%s'", parameter.Value)
+			}
+			options.expireAfter = time.Duration(seconds) * time.Second
+		case "partialfilter":
+			if strings.ToLower(parameter.Value) != "exists" {
+				return options, parameter.Key, fmt.Errorf("partialFilter must be exists, got '%s'", parameter.Value)
+			}
+			options.partialFilter = true
+		case "type":
+			switch strings.ToLower(parameter.Value) {
+			case "text", "2dsphere", "hashed":
+				options.indexType = strings.ToLower(parameter.Value)
+			case "geo":
+				// 2dsphere is not a valid annotation value
+				options.indexType = "2dsphere"
+			default:
+				return options, parameter.Key, fmt.Errorf("type must be text, geo or hashed, got '%s'", parameter.Value)
+			}
+		default:
+			return options, parameter.Key, fmt.Errorf("unknown parameter '%s' of %s", parameter.Key, definition.Name)
+		}
+	}
+	return
+}
+
+// indexKey returns the key of a field in an index in the mgo.Index format
+func (options indexOptions) indexKey(key string) string {
+	switch {
+	case options.indexType != "":
+		return "$" + options.indexType + ":" + key
+	case options.descending:
+		return "-" + key
+	}
+	return key
+}
+
+// IndexSpec is the description of an index used by the createIndexes and listIndexes commands
+type IndexSpec struct {
+	Name                    string `bson:"name"`
+	Key                     bson.D `bson:"key"`
+	Unique                  bool   `bson:"unique,omitempty"`
+	Sparse                  bool   `bson:"sparse,omitempty"`
+	ExpireAfterSeconds      int    `bson:"expireAfterSeconds,omitempty"`
+	PartialFilterExpression bson.M `bson:"partialFilterExpression,omitempty"`
+	// Weights are the weights of the fields of a text index
+	Weights bson.D `bson:"weights,omitempty"`
+}
+
+// Spec returns the description of the index for the createIndexes command
+func (index Index) Spec() IndexSpec {
+	keys := bson.D{}
+	for _, key := range index.Key {
+		switch {
+		case strings.HasPrefix(key, "$"):
+			parts := strings.SplitN(key[1:], ":", 2)
+			keys = append(keys, bson.DocElem{Name: parts[1], Value: parts[0]})
+		case strings.HasPrefix(key, "-"):
+			keys = append(keys, bson.DocElem{Name: key[1:], Value: -1})
+		default:
+			keys = append(keys, bson.DocElem{Name: key, Value: 1})
+		}
+	}
+	name := index.Name
+	if name == "" {
+		parts := []string{}
+		for _, key := range keys {
+			parts = append(parts, fmt.Sprintf("%s_%v", key.Name, key.Value))
+		}
+		name = strings.Join(parts, "_")
+	}
+	return IndexSpec{Name: name, Key: keys, Unique: index.Unique, Sparse: index.Sparse,
+		ExpireAfterSeconds: int(index.ExpireAfter / time.Second), PartialFilterExpression: index.PartialFilter}
+}
+
+// Index returns the index described by the result of the listIndexes command
+func (spec IndexSpec) Index() Index {
+	index := Index{Index: mgo.Index{Name: spec.Name, Unique: spec.Unique, Sparse: spec.Sparse,
+		ExpireAfter: time.Duration(spec.ExpireAfterSeconds) * time.Second}, PartialFilter: spec.PartialFilterExpression}
+	for _, key := range spec.Key {
+		switch value := key.Value.(type) {
+		case string:
+			// the fields of a text index are its weights
+			if key.Name == "_fts" {
+				for _, weight := range spec.Weights {
+					index.Key = append(index.Key, "$text:"+weight.Name)
+				}
+				continue
+			}
+			index.Key = append(index.Key, "$"+value+":"+key.Name)
+		default:
+			if key.Name == "_ftsx" {
+				continue
+			}
+			if order, ok := toFloat(value); ok && order < 0 {
+				index.Key = append(index.Key, "-"+key.Name)
+				continue
+			}
+			index.Key = append(index.Key, key.Name)
+		}
+	}
+	return index
+}
+
+// toFloat converts a number of any type to a float64
+func toFloat(value interface{}) (float64, bool) {
+	switch number := value.(type) {
+	case int:
+		return float64(number), true
+	case int32:
+		return float64(number), true
+	case int64:
+		return float64(number), true
+	case float64:
+		return number, true
+	}
+	return 0, false
+}
+
+// indexOptionsEqual returns true if 2 indexes with the same keys have the same options
+func indexOptionsEqual(current, wanted Index) bool {
+	return current.Unique == wanted.Unique &&
+		current.Sparse == wanted.Sparse &&
+		current.ExpireAfter == wanted.ExpireAfter &&
+		(wanted.Name == "" || current.Name == wanted.Name) &&
+		reflect.DeepEqual(current.PartialFilter, wanted.PartialFilter)
+}
@@ -0,0 +1,292 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// integrityBatchSize is the number of referencing documents checked at once
+const integrityBatchSize = 1000
+
+// DanglingReference is a reference to a document that doesn't exist
+type DanglingReference struct {
+	// Collection is the collection of the referencing document
+	Collection string
+	// DocumentID is the id of the referencing document
+	DocumentID bson.ObjectId
+	// Field is the struct field holding the relation
+	Field string
+	// Key is the document key holding the reference
+	Key string
+	// TargetDocument is the collection of the missing document
+	TargetDocument string
+	// ReferenceID is the id of the missing document
+	ReferenceID bson.ObjectId
+	// link is true if the referencing document is a link of a join collection
+	link bool
+}
+
+func (reference DanglingReference) String() string {
+	return fmt.Sprintf("%s(%s).%s references missing %s(%s)", reference.Collection, reference.DocumentID.Hex(),
+		reference.Key, reference.TargetDocument, reference.ReferenceID.Hex())
+}
+
+// IntegrityReport lists the problems found by DocumentManager.CheckIntegrity
+type IntegrityReport struct {
+	// DanglingReferences are references to documents that don't exist
+	DanglingReferences []DanglingReference
+	// MappingErrors are relations which target document or mappedBy field can't be found
+	MappingErrors []error
+}
+
+// HasProblems returns true if the report found dangling references or mapping errors
+func (report *IntegrityReport) HasProblems() bool {
+	return len(report.DanglingReferences) > 0 || len(report.MappingErrors) > 0
+}
+
+// CheckIntegrity walks the relations of documents and reports references to documents that don't exist.
+// documents are pointers to struct of the registered types to check, all registered types are checked if none is provided.
+func (manager *defaultDocumentManager) CheckIntegrity(ctx context.Context, documents ...interface{}) (*IntegrityReport, error) {
+	metas := []metadata{}
+	if len(documents) == 0 {
+		for _, meta := range manager.metadatas {
+			metas = append(metas, meta)
+		}
+	}
+	for _, document := range documents {
+		meta, err := manager.metadatas.getMetadatas(reflect.TypeOf(document))
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	checked := map[string]bool{}
+	for _, meta := range metas {
+		checked[meta.targetDocument] = true
+	}
+	report := &IntegrityReport{}
+	for _, meta := range metas {
+		for _, field := range meta.getFieldsWithRelation() {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+			if err := manager.checkRelationMapping(meta, field); err != nil {
+				report.MappingErrors = append(report.MappingErrors, err)
+				continue
+			}
+			relatedMeta, _ := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
+			switch {
+			case field.relation.mapped == mappedBy:
+				// the inverse side holds no reference
+			case field.relation.through != "":
+				// links of a registered association document are checked with its own relations
+				if checked[field.relation.through] {
+					continue
+				}
+				if err := manager.checkLinkIntegrity(ctx, meta, field, relatedMeta, report); err != nil {
+					return report, err
+				}
+			default:
+				if err := manager.checkReferenceIntegrity(ctx, meta, field, report); err != nil {
+					return report, err
+				}
+			}
+		}
+	}
+	return report, nil
+}
+
+// checkReferenceIntegrity checks the references stored in the documents of meta for a relation field
+func (manager *defaultDocumentManager) checkReferenceIntegrity(ctx context.Context, meta metadata, field field, report *IntegrityReport) error {
+	iter := manager.collection(meta.targetDocument).Find(bson.M{field.key: bson.M{"$exists": true}}).
+		Select(bson.M{"_id": 1, field.key: 1}).Batch(integrityBatchSize).Iter()
+	batch := docs{}
+	doc := map[string]interface{}{}
+	for iter.Next(&doc) {
+		batch = append(batch, doc)
+		doc = map[string]interface{}{}
+		if len(batch) < integrityBatchSize {
+			continue
+		}
+		if err := manager.checkReferenceBatch(ctx, meta, field, batch, report); err != nil {
+			iter.Close()
+			return err
+		}
+		batch = docs{}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return manager.checkReferenceBatch(ctx, meta, field, batch, report)
+}
+
+func (manager *defaultDocumentManager) checkReferenceBatch(ctx context.Context, meta metadata, field field, batch docs, report *IntegrityReport) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	// a DBRef may reference another collection than the target document of the relation,
+	// references are checked in the collection they point to
+	referencesByDocumentID := map[bson.ObjectId][]reference{}
+	referencedIDsByCollection := map[string][]bson.ObjectId{}
+	for _, doc := range batch {
+		references := referencesOf(doc[field.key])
+		if one, ok := referenceOf(doc[field.key]); ok {
+			references = []reference{one}
+		}
+		for _, reference := range references {
+			// a reference to another database can't be checked against the current storage
+			if manager.isForeign(reference) {
+				continue
+			}
+			referencesByDocumentID[doc["_id"].(bson.ObjectId)] = append(referencesByDocumentID[doc["_id"].(bson.ObjectId)], reference)
+			referencedIDsByCollection[field.relation.collectionOf(reference)] = append(referencedIDsByCollection[field.relation.collectionOf(reference)], reference.id)
+		}
+	}
+	existingByCollection := map[string]map[bson.ObjectId]bool{}
+	for collection, ids := range referencedIDsByCollection {
+		existing, err := manager.findExistingIDs(collection, ids)
+		if err != nil {
+			return err
+		}
+		existingByCollection[collection] = existing
+	}
+	for _, doc := range batch {
+		documentID := doc["_id"].(bson.ObjectId)
+		for _, reference := range referencesByDocumentID[documentID] {
+			if !existingByCollection[field.relation.collectionOf(reference)][reference.id] {
+				report.DanglingReferences = append(report.DanglingReferences, DanglingReference{
+					Collection: meta.targetDocument, DocumentID: documentID, Field: field.name, Key: field.key,
+					TargetDocument: field.relation.collectionOf(reference), ReferenceID: reference.id,
+				})
+			}
+		}
+	}
+	return nil
+}
+
+// checkLinkIntegrity checks that both documents of each link of a through relation exist
+func (manager *defaultDocumentManager) checkLinkIntegrity(ctx context.Context, meta metadata, field field, relatedMeta metadata, report *IntegrityReport) error {
+	joinKey, inverseJoinKey := manager.getJoinKeys(meta, field)
+	iter := manager.collection(field.relation.through).Find(nil).
+		Select(bson.M{"_id": 1, joinKey: 1, inverseJoinKey: 1}).Batch(integrityBatchSize).Iter()
+	batch := docs{}
+	doc := map[string]interface{}{}
+	check := func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, side := range []struct {
+			key, targetDocument string
+		}{{joinKey, meta.targetDocument}, {inverseJoinKey, relatedMeta.targetDocument}} {
+			ids := []bson.ObjectId{}
+			for _, link := range batch {
+				if id, ok := link[side.key].(bson.ObjectId); ok {
+					ids = append(ids, id)
+				}
+			}
+			existing, err := manager.findExistingIDs(side.targetDocument, ids)
+			if err != nil {
+				return err
+			}
+			for _, link := range batch {
+				if id, ok := link[side.key].(bson.ObjectId); ok && !existing[id] {
+					report.DanglingReferences = append(report.DanglingReferences, DanglingReference{
+						Collection: field.relation.through, DocumentID: link["_id"].(bson.ObjectId), Field: field.name, Key: side.key,
+						TargetDocument: side.targetDocument, ReferenceID: id, link: true,
+					})
+				}
+			}
+		}
+		batch = docs{}
+		return nil
+	}
+	for iter.Next(&doc) {
+		batch = append(batch, doc)
+		doc = map[string]interface{}{}
+		if len(batch) < integrityBatchSize {
+			continue
+		}
+		if err := check(); err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+	return check()
+}
+
+// findExistingIDs returns the ids of a list that exist in a collection
+func (manager *defaultDocumentManager) findExistingIDs(collection string, ids []bson.ObjectId) (map[bson.ObjectId]bool, error) {
+	existing := map[bson.ObjectId]bool{}
+	if len(ids) == 0 {
+		return existing, nil
+	}
+	found := docs{}
+	if err := manager.collection(collection).Find(bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1}).All(&found); err != nil {
+		return nil, err
+	}
+	for _, id := range found.getIds() {
+		existing[id] = true
+	}
+	return existing, nil
+}
+
+// RepairIntegrity removes the dangling references of a report : dead ids are pulled from
+// referenceMany arrays, referenceOne keys are unset and dangling links are removed.
+func (manager *defaultDocumentManager) RepairIntegrity(ctx context.Context, report *IntegrityReport) error {
+	for _, reference := range report.DanglingReferences {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		collection := manager.collection(reference.Collection)
+		if reference.link {
+			if err := collection.RemoveId(reference.DocumentID); err != nil && err != ErrNotFound {
+				return err
+			}
+			continue
+		}
+		meta, Type := manager.metadatas.findMetadataByCollectionName(reference.Collection)
+		if Type == nil {
+			return ErrDocumentNotRegistered
+		}
+		field, ok := meta.findField(reference.Field)
+		if !ok {
+			return ErrFieldNotFound
+		}
+		var update bson.M
+		switch field.relation.relation {
+		case referenceMany:
+			if field.relation.storeAs == storeAsID {
+				update = bson.M{"$pull": bson.M{field.key: reference.ReferenceID}}
+			} else {
+				update = bson.M{"$pull": bson.M{field.key: bson.M{"$id": reference.ReferenceID}}}
+			}
+		case referenceOne:
+			update = bson.M{"$unset": bson.M{field.key: 1}}
+		}
+		if err := collection.Update(bson.M{"_id": reference.DocumentID, field.relation.queryKey(field.key): reference.ReferenceID}, update); err != nil && err != ErrNotFound {
+			return err
+		}
+		manager.log(fmt.Sprintf("Repaired dangling reference %s", reference))
+	}
+	return nil
+}
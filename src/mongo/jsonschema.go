@@ -0,0 +1,308 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	objectIDType = reflect.TypeOf(bson.ObjectId(""))
+	bytesType    = reflect.TypeOf([]byte(nil))
+)
+
+// ValidatorDiff lists the differences between the $jsonSchema validator of a collection
+// and the validator generated from its metadata
+type ValidatorDiff struct {
+	// Collection is the name of the collection
+	Collection string
+	// Current is the validator of the collection, nil if it has none
+	Current bson.M
+	// Wanted is the validator generated from the metadata
+	Wanted bson.M
+	// Changes are the changed paths of the schema, prefixed by + when added,
+	// - when removed and ~ when modified
+	Changes []string
+}
+
+// IsEmpty returns true if the validator of the collection matches the metadata
+func (diff ValidatorDiff) IsEmpty() bool {
+	return len(diff.Changes) == 0
+}
+
+func (diff ValidatorDiff) String() string {
+	result := fmt.Sprintf("collection '%s' :", diff.Collection)
+	for _, change := range diff.Changes {
+		result += "\n\t" + change
+	}
+	return result
+}
+
+// JSONSchema returns the $jsonSchema of a registered document type
+func (schemaManager *defaultSchemaManager) JSONSchema(document interface{}) (bson.M, error) {
+	meta, err := schemaManager.documentManager.metadatas.getMetadatas(reflect.TypeOf(document))
+	if err != nil {
+		return nil, err
+	}
+	return jsonSchema(meta), nil
+}
+
+// DiffValidators compares the validators of the collections with the validators generated from the metadatas
+func (schemaManager *defaultSchemaManager) DiffValidators() ([]ValidatorDiff, error) {
+	diffs := []ValidatorDiff{}
+	for _, meta := range schemaManager.sortedMetadatas() {
+		diff, err := schemaManager.diffValidatorFor(meta)
+		if err != nil {
+			return diffs, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+func (schemaManager *defaultSchemaManager) diffValidatorFor(meta metadata) (ValidatorDiff, error) {
+	diff := ValidatorDiff{Collection: meta.targetDocument}
+	result := struct {
+		Cursor struct {
+			FirstBatch []struct {
+				Options struct {
+					Validator bson.M `bson:"validator"`
+				} `bson:"options"`
+			} `bson:"firstBatch"`
+		} `bson:"cursor"`
+	}{}
+	if err := schemaManager.documentManager.storage.Run(bson.D{{Name: "listCollections", Value: 1},
+		{Name: "filter", Value: bson.M{"name": meta.targetDocument}}}, &result); err != nil {
+		return diff, err
+	}
+	if len(result.Cursor.FirstBatch) > 0 {
+		diff.Current = result.Cursor.FirstBatch[0].Options.Validator
+	}
+	// the wanted validator goes through bson so that it can be compared with the current one
+	wanted := bson.M{"$jsonSchema": jsonSchema(meta)}
+	data, err := bson.Marshal(wanted)
+	if err != nil {
+		return diff, err
+	}
+	diff.Wanted = bson.M{}
+	if err = bson.Unmarshal(data, &diff.Wanted); err != nil {
+		return diff, err
+	}
+	current, _ := diff.Current["$jsonSchema"].(bson.M)
+	diff.Changes = diffSchemas("$jsonSchema", current, diff.Wanted["$jsonSchema"].(bson.M))
+	return diff, nil
+}
+
+// ApplyValidators sets the validator generated from the metadata of every registered document
+// on its collection with collMod, collections that don't exist are created.
+func (schemaManager *defaultSchemaManager) ApplyValidators() error {
+	database := schemaManager.documentManager.storage
+	for _, meta := range schemaManager.sortedMetadatas() {
+		validator := bson.M{"$jsonSchema": jsonSchema(meta)}
+		command := bson.D{{Name: "collMod", Value: meta.targetDocument}, {Name: "validator", Value: validator}}
+		if options := meta.collectionOptions; options != nil {
+			if options.ValidationLevel != "" {
+				command = append(command, bson.DocElem{Name: "validationLevel", Value: options.ValidationLevel})
+			}
+			if options.ValidationAction != "" {
+				command = append(command, bson.DocElem{Name: "validationAction", Value: options.ValidationAction})
+			}
+		}
+		err := database.Run(command, nil)
+		if err != nil && isNamespaceNotFound(err) {
+			command[0] = bson.DocElem{Name: "create", Value: meta.targetDocument}
+			err = database.Run(command, nil)
+		}
+		if err != nil {
+			return err
+		}
+		schemaManager.documentManager.log(fmt.Sprintf("Applied validator of collection %s", meta.targetDocument))
+	}
+	return nil
+}
+
+// jsonSchema returns the $jsonSchema of the documents described by meta.
+// Relations are described by the type of the stored references, relations stored
+// on the other side of the relation or in a join collection are not part of the schema.
+func jsonSchema(meta metadata) bson.M {
+	properties := bson.M{}
+	required := []string{}
+	structType := meta.structType
+	if structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+	for _, field := range meta.fields {
+		if field.ignore {
+			continue
+		}
+		structField, _ := structType.FieldByName(field.name)
+		switch {
+		case field.name == meta.idField:
+			properties["_id"] = typeSchema(structField.Type)
+			required = append(required, "_id")
+		case field.hasRelation():
+			if field.relation.mapped == mappedBy || field.relation.through != "" {
+				continue
+			}
+			reference := bson.M{"bsonType": "objectId"}
+			if field.relation.storeAs != storeAsID {
+				reference = bson.M{"bsonType": "object", "required": []string{"$ref", "$id"},
+					"properties": bson.M{"$ref": bson.M{"bsonType": "string"}, "$id": bson.M{"bsonType": "objectId"}}}
+			}
+			if field.relation.relation == referenceMany {
+				reference = bson.M{"bsonType": "array", "items": reference}
+			}
+			properties[field.key] = reference
+		default:
+			properties[field.key] = typeSchema(structField.Type)
+			if !field.omitempty {
+				required = append(required, field.key)
+			}
+		}
+	}
+	sort.Strings(required)
+	schema := bson.M{"bsonType": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// typeSchema returns the schema of the values of a go type as marshalled by the bson package
+func typeSchema(Type reflect.Type) bson.M {
+	switch Type {
+	case objectIDType:
+		return bson.M{"bsonType": "objectId"}
+	case timeType:
+		return bson.M{"bsonType": "date"}
+	case bytesType:
+		return bson.M{"bsonType": []string{"binData", "null"}}
+	}
+	switch Type.Kind() {
+	case reflect.Bool:
+		return bson.M{"bsonType": "bool"}
+	case reflect.String:
+		return bson.M{"bsonType": "string"}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16:
+		return bson.M{"bsonType": "int"}
+	case reflect.Int64:
+		return bson.M{"bsonType": "long"}
+	case reflect.Int, reflect.Uint, reflect.Uint32, reflect.Uint64:
+		// marshalled as an int32 when the value fits
+		return bson.M{"bsonType": []string{"int", "long"}}
+	case reflect.Float32, reflect.Float64:
+		return bson.M{"bsonType": "double"}
+	case reflect.Ptr:
+		schema := typeSchema(Type.Elem())
+		if schema["bsonType"] == nil {
+			return schema
+		}
+		return nullable(schema)
+	case reflect.Slice, reflect.Array:
+		return nullable(bson.M{"bsonType": "array", "items": typeSchema(Type.Elem())})
+	case reflect.Map:
+		return nullable(bson.M{"bsonType": "object"})
+	case reflect.Struct:
+		return embeddedSchema(Type)
+	}
+	// interfaces accept any value
+	return bson.M{}
+}
+
+// embeddedSchema returns the schema of an embedded struct, keyed by its bson tags
+func embeddedSchema(Type reflect.Type) bson.M {
+	properties := bson.M{}
+	required := []string{}
+	for i := 0; i < Type.NumField(); i++ {
+		structField := Type.Field(i)
+		if structField.PkgPath != "" {
+			continue
+		}
+		key := strings.ToLower(structField.Name)
+		omitempty := false
+		if bsonTag, ok := structField.Tag.Lookup("bson"); ok {
+			parts := strings.Split(bsonTag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				key = parts[0]
+			}
+			omitempty = indexOfString(parts[1:], "omitempty") >= 0
+		}
+		properties[key] = typeSchema(structField.Type)
+		if !omitempty {
+			required = append(required, key)
+		}
+	}
+	sort.Strings(required)
+	schema := bson.M{"bsonType": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// nullable adds null to the types of a schema
+func nullable(schema bson.M) bson.M {
+	switch bsonType := schema["bsonType"].(type) {
+	case string:
+		schema["bsonType"] = []string{bsonType, "null"}
+	case []string:
+		schema["bsonType"] = append(bsonType, "null")
+	}
+	return schema
+}
+
+// diffSchemas returns the changed paths between 2 schemas
+func diffSchemas(path string, current, wanted bson.M) (changes []string) {
+	if current == nil {
+		return []string{"+ " + path}
+	}
+	keys := []string{}
+	for key := range wanted {
+		keys = append(keys, key)
+	}
+	for key := range current {
+		if _, ok := wanted[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		currentValue, inCurrent := current[key]
+		wantedValue, inWanted := wanted[key]
+		switch {
+		case !inCurrent:
+			changes = append(changes, "+ "+path+"."+key)
+		case !inWanted:
+			changes = append(changes, "- "+path+"."+key)
+		default:
+			currentMap, currentIsMap := currentValue.(bson.M)
+			wantedMap, wantedIsMap := wantedValue.(bson.M)
+			if currentIsMap && wantedIsMap {
+				changes = append(changes, diffSchemas(path+"."+key, currentMap, wantedMap)...)
+			} else if !reflect.DeepEqual(currentValue, wantedValue) {
+				changes = append(changes, fmt.Sprintf("~ %s.%s : %v => %v", path, key, currentValue, wantedValue))
+			}
+		}
+	}
+	return
+}
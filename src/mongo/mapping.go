@@ -0,0 +1,357 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"../tag"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Mapping maps a document type without struct tags, it is read from a YAML or a JSON mapping file :
+//
+//	Article:
+//	  collection: articles
+//	  id: ID
+//	  fields:
+//	    Title:
+//	      index: { unique: true }
+//	    Author:
+//	      referenceOne: { targetDocument: authors, cascade: persist }
+//
+// The fields that are not mapped keep the mapping of their bson and odm struct tags.
+type Mapping struct {
+	// Collection is the collection of the documents
+	Collection string `json:"collection" yaml:"collection"`
+	// ID is the name of the struct field holding the id
+	ID string `json:"id,omitempty" yaml:"id,omitempty"`
+	// Fields are the mappings of the struct fields by name
+	Fields map[string]FieldMapping `json:"fields,omitempty" yaml:"fields,omitempty"`
+}
+
+// FieldMapping maps a struct field
+type FieldMapping struct {
+	// Key is the document key, it must be the key the field is decoded from :
+	// its bson key or its lowercased name
+	Key           string           `json:"key,omitempty" yaml:"key,omitempty"`
+	Omitempty     bool             `json:"omitempty,omitempty" yaml:"omitempty,omitempty"`
+	Ignore        bool             `json:"ignore,omitempty" yaml:"ignore,omitempty"`
+	SoftDelete    bool             `json:"softDelete,omitempty" yaml:"softDelete,omitempty"`
+	Index         *IndexMapping    `json:"index,omitempty" yaml:"index,omitempty"`
+	Composites    []IndexMapping   `json:"composites,omitempty" yaml:"composites,omitempty"`
+	ReferenceOne  *RelationMapping `json:"referenceOne,omitempty" yaml:"referenceOne,omitempty"`
+	ReferenceMany *RelationMapping `json:"referenceMany,omitempty" yaml:"referenceMany,omitempty"`
+}
+
+// IndexMapping maps an index or a composite index, with the parameters of the index annotation
+type IndexMapping struct {
+	Name string `json:"name,omitempty" yaml:"name,omitempty"`
+	// Unique defaults to false for an index and to true for a composite index
+	Unique *bool  `json:"unique,omitempty" yaml:"unique,omitempty"`
+	Order  string `json:"order,omitempty" yaml:"order,omitempty"`
+	Sparse bool   `json:"sparse,omitempty" yaml:"sparse,omitempty"`
+	// ExpireAfter is the time to live in seconds of documents with a TTL index
+	ExpireAfter   int    `json:"expireAfter,omitempty" yaml:"expireAfter,omitempty"`
+	PartialFilter string `json:"partialFilter,omitempty" yaml:"partialFilter,omitempty"`
+	Type          string `json:"type,omitempty" yaml:"type,omitempty"`
+}
+
+// RelationMapping maps a relation, with the parameters of the referenceOne and referenceMany annotations
+type RelationMapping struct {
+	TargetDocument string `json:"targetDocument" yaml:"targetDocument"`
+	MappedBy       string `json:"mappedBy,omitempty" yaml:"mappedBy,omitempty"`
+	InversedBy     string `json:"inversedBy,omitempty" yaml:"inversedBy,omitempty"`
+	Cascade        string `json:"cascade,omitempty" yaml:"cascade,omitempty"`
+	Load           string `json:"load,omitempty" yaml:"load,omitempty"`
+	StoreID        string `json:"storeId,omitempty" yaml:"storeId,omitempty"`
+	StoreAs        string `json:"storeAs,omitempty" yaml:"storeAs,omitempty"`
+	Through        string `json:"through,omitempty" yaml:"through,omitempty"`
+	JoinKey        string `json:"joinKey,omitempty" yaml:"joinKey,omitempty"`
+	InverseJoinKey string `json:"inverseJoinKey,omitempty" yaml:"inverseJoinKey,omitempty"`
+	Sort           string `json:"sort,omitempty" yaml:"sort,omitempty"`
+	Order          string `json:"order,omitempty" yaml:"order,omitempty"`
+	Limit          int    `json:"limit,omitempty" yaml:"limit,omitempty"`
+}
+
+// ReadMappings reads mappings keyed by go type name, format is either yaml or json
+func ReadMappings(reader io.Reader, format string) (map[string]Mapping, error) {
+	mappings := map[string]Mapping{}
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(format) {
+	case "yaml", "yml":
+		err = yaml.UnmarshalStrict(data, &mappings)
+	case "json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&mappings)
+	default:
+		err = fmt.Errorf("unknown mapping format %s", format)
+	}
+	return mappings, err
+}
+
+// ReadMappingFile reads a mapping file, its format is given by its extension
+func ReadMappingFile(path string) (map[string]Mapping, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadMappings(file, strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// RegisterMapping registers a document type mapped by mapping rather than by its struct tags
+func (manager *defaultDocumentManager) RegisterMapping(document interface{}, mapping Mapping) error {
+	documentType := reflect.TypeOf(document)
+	if documentType.Kind() != reflect.Ptr {
+		return ErrNotAPointer
+	}
+	if documentType.Elem().Kind() != reflect.Struct {
+		return ErrNotAstruct
+	}
+	if err := mapping.validate(documentType.Elem()); err != nil {
+		return err
+	}
+	collection := mapping.Collection
+	if collection == "" {
+		collection = documentType.Elem().Name()
+	}
+	return manager.register(collection, document, fileDriver{mapping})
+}
+
+// RegisterMappingFile registers document types with the mappings of a YAML or JSON file,
+// the mappings are keyed by the names of the go types of the documents.
+func (manager *defaultDocumentManager) RegisterMappingFile(path string, documents ...interface{}) error {
+	mappings, err := ReadMappingFile(path)
+	if err != nil {
+		return err
+	}
+	for _, document := range documents {
+		name := reflect.Indirect(reflect.ValueOf(document)).Type().Name()
+		mapping, ok := mappings[name]
+		if !ok {
+			return fmt.Errorf("no mapping for type %s in %s", name, path)
+		}
+		if err = manager.RegisterMapping(document, mapping); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate cross checks the mapping with the go type of the documents
+func (mapping Mapping) validate(Type reflect.Type) error {
+	problems := []string{}
+	if mapping.ID != "" {
+		if Field, ok := Type.FieldByName(mapping.ID); !ok {
+			problems = append(problems, fmt.Sprintf("id field %s not found", mapping.ID))
+		} else if Field.Type != objectIDType {
+			problems = append(problems, fmt.Sprintf("id field %s is not a bson.ObjectId", mapping.ID))
+		} else if key := bsonKey(Field); key != "_id" {
+			// documents are decoded with the bson keys of the struct fields
+			problems = append(problems, fmt.Sprintf("id field %s is decoded from key %s, its bson key must be _id", mapping.ID, key))
+		}
+	}
+	for name, fieldMapping := range mapping.Fields {
+		Field, ok := Type.FieldByName(name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("field %s not found", name))
+			continue
+		}
+		if fieldMapping.Key != "" && (fieldMapping.ReferenceOne != nil || fieldMapping.ReferenceMany != nil) {
+			problems = append(problems, fmt.Sprintf("relation %s can't have a key, use storeId", name))
+		} else if key := bsonKey(Field); fieldMapping.Key != "" && fieldMapping.Key != key {
+			problems = append(problems, fmt.Sprintf("key %s of field %s differs from the key %s the field is decoded from", fieldMapping.Key, name, key))
+		}
+		if fieldMapping.ReferenceOne != nil && fieldMapping.ReferenceMany != nil {
+			problems = append(problems, fmt.Sprintf("field %s has both referenceOne and referenceMany", name))
+		}
+		if fieldMapping.ReferenceOne != nil && (Field.Type.Kind() != reflect.Ptr || Field.Type.Elem().Kind() != reflect.Struct) {
+			problems = append(problems, fmt.Sprintf("referenceOne field %s is not a pointer to struct", name))
+		}
+		if fieldMapping.ReferenceMany != nil && Field.Type.Kind() != reflect.Slice {
+			problems = append(problems, fmt.Sprintf("referenceMany field %s is not a slice", name))
+		}
+		for _, relationMapping := range []*RelationMapping{fieldMapping.ReferenceOne, fieldMapping.ReferenceMany} {
+			if relationMapping == nil {
+				continue
+			}
+			if relationMapping.TargetDocument == "" {
+				problems = append(problems, fmt.Sprintf("relation %s has no targetDocument", name))
+			}
+			if relationMapping.StoreID != "" {
+				if _, ok := Type.FieldByName(relationMapping.StoreID); !ok {
+					problems = append(problems, fmt.Sprintf("storeId field %s of relation %s not found", relationMapping.StoreID, name))
+				}
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return fmt.Errorf("invalid mapping of %s : %s", Type, strings.Join(problems, ", "))
+	}
+	return nil
+}
+
+// bsonKey returns the key a struct field is encoded to and decoded from by the bson package
+func bsonKey(Field reflect.StructField) string {
+	if key := strings.TrimSpace(strings.Split(Field.Tag.Get("bson"), ",")[0]); key != "" {
+		return key
+	}
+	return strings.ToLower(Field.Name)
+}
+
+// mappingDriver reads the mapping of the struct fields of a document type
+type mappingDriver interface {
+	mapField(Field reflect.StructField) (fieldMapping, error)
+}
+
+// fieldMapping is the mapping of a struct field read by a mapping driver
+type fieldMapping struct {
+	key         string
+	omitempty   bool
+	ignore      bool
+	definitions []*tag.Definition
+}
+
+// tagDriver reads the mapping of a field from its bson and odm struct tags
+type tagDriver struct{}
+
+func (tagDriver) mapField(Field reflect.StructField) (mapping fieldMapping, err error) {
+	mapping.key = strings.ToLower(Field.Name)
+	// check bson struct tag and extract the document key
+	parts := strings.Split(Field.Tag.Get("bson"), ",")
+	if key := strings.TrimSpace(parts[0]); key != "" {
+		mapping.key = key
+		if key == "-" {
+			mapping.ignore = true
+			return
+		}
+	}
+	if len(parts) > 1 && strings.TrimSpace(parts[1]) == "omitempty" {
+		mapping.omitempty = true
+	}
+	Tag := Field.Tag.Get("odm")
+	if Tag == "-" {
+		mapping.ignore = true
+		return
+	}
+	mapping.definitions, err = tag.NewParser(strings.NewReader(Tag)).Parse()
+	return
+}
+
+// fileDriver reads the mapping of a field from a Mapping,
+// fields missing from the Mapping are read from their struct tags
+type fileDriver struct {
+	mapping Mapping
+}
+
+func (driver fileDriver) mapField(Field reflect.StructField) (fieldMapping, error) {
+	mapping, err := tagDriver{}.mapField(Field)
+	if err != nil {
+		return mapping, err
+	}
+	if fieldMappingOfFile, ok := driver.mapping.Fields[Field.Name]; ok {
+		mapping.omitempty = fieldMappingOfFile.Omitempty
+		mapping.ignore = fieldMappingOfFile.Ignore
+		mapping.definitions = fieldMappingOfFile.definitions()
+	}
+	if Field.Name == driver.mapping.ID {
+		mapping.definitions = append(mapping.definitions, &tag.Definition{Name: "id"})
+	}
+	return mapping, nil
+}
+
+// definitions returns the annotations equivalent to a field mapping
+func (fieldMapping FieldMapping) definitions() (definitions []*tag.Definition) {
+	if fieldMapping.SoftDelete {
+		definitions = append(definitions, &tag.Definition{Name: "softDelete"})
+	}
+	if fieldMapping.Index != nil {
+		definitions = append(definitions, fieldMapping.Index.definition("index"))
+	}
+	for _, composite := range fieldMapping.Composites {
+		definitions = append(definitions, composite.definition("composite"))
+	}
+	if fieldMapping.ReferenceOne != nil {
+		definitions = append(definitions, fieldMapping.ReferenceOne.definition("referenceOne"))
+	}
+	if fieldMapping.ReferenceMany != nil {
+		definitions = append(definitions, fieldMapping.ReferenceMany.definition("referenceMany"))
+	}
+	return
+}
+
+func (index IndexMapping) definition(name string) *tag.Definition {
+	parameters := parameters{}
+	if index.Unique != nil {
+		parameters.add("unique", strconv.FormatBool(*index.Unique))
+	}
+	if index.Sparse {
+		parameters.add("sparse", "true")
+	}
+	if index.ExpireAfter != 0 {
+		parameters.add("expireAfter", strconv.Itoa(index.ExpireAfter))
+	}
+	parameters.add("name", index.Name)
+	parameters.add("order", index.Order)
+	parameters.add("partialFilter", index.PartialFilter)
+	parameters.add("type", index.Type)
+	return &tag.Definition{Name: name, Parameters: parameters}
+}
+
+func (relation RelationMapping) definition(name string) *tag.Definition {
+	parameters := parameters{}
+	parameters.add("targetDocument", relation.TargetDocument)
+	parameters.add("mappedBy", relation.MappedBy)
+	parameters.add("inversedBy", relation.InversedBy)
+	parameters.add("cascade", relation.Cascade)
+	parameters.add("load", relation.Load)
+	parameters.add("storeId", relation.StoreID)
+	parameters.add("storeAs", relation.StoreAs)
+	parameters.add("through", relation.Through)
+	parameters.add("joinKey", relation.JoinKey)
+	parameters.add("inverseJoinKey", relation.InverseJoinKey)
+	parameters.add("sort", relation.Sort)
+	parameters.add("order", relation.Order)
+	if relation.Limit != 0 {
+		parameters.add("limit", strconv.Itoa(relation.Limit))
+	}
+	return &tag.Definition{Name: name, Parameters: parameters}
+}
+
+// parameters are the parameters of an annotation
+type parameters []tag.Parameter
+
+// add adds a parameter if its value is not empty
+func (p *parameters) add(key, value string) {
+	if value != "" {
+		*p = append(*p, tag.Parameter{Key: key, Value: value})
+	}
+}
@@ -0,0 +1,761 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// This file evaluates queries, sorts, projections and updates on documents decoded as bson.M,
+// following the semantics of mongodb closely enough for the in-memory storage.
+
+// toDocument converts a document, a query or an update to a bson.M with the types of decoded documents
+func toDocument(value interface{}) (bson.M, error) {
+	document := bson.M{}
+	if value == nil {
+		return document, nil
+	}
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	err = bson.Unmarshal(data, &document)
+	return document, err
+}
+
+// decodeDocument decodes a document in result like a driver would
+func decodeDocument(document bson.M, result interface{}) error {
+	data, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(data, result)
+}
+
+// lookup returns the values found at a dotted path of a value.
+// Arrays are traversed, and an array found at the end of the path is returned along with its elements.
+func lookup(value interface{}, parts []string) []interface{} {
+	if len(parts) == 0 {
+		if array, ok := value.([]interface{}); ok {
+			return append([]interface{}{array}, array...)
+		}
+		return []interface{}{value}
+	}
+	switch value := value.(type) {
+	case bson.M:
+		child, ok := value[parts[0]]
+		if !ok {
+			return nil
+		}
+		return lookup(child, parts[1:])
+	case []interface{}:
+		if index, err := strconv.Atoi(parts[0]); err == nil {
+			if index < 0 || index >= len(value) {
+				return nil
+			}
+			return lookup(value[index], parts[1:])
+		}
+		values := []interface{}{}
+		for _, element := range value {
+			if _, ok := element.(bson.M); ok {
+				values = append(values, lookup(element, parts)...)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// typeOrder returns the rank of the type of a value in the mongodb sort order
+func typeOrder(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 1
+	case int, int32, int64, float64:
+		return 2
+	case string, bson.Symbol:
+		return 3
+	case bson.M:
+		return 4
+	case []interface{}:
+		return 5
+	case []byte, bson.Binary:
+		return 6
+	case bson.ObjectId:
+		return 7
+	case bool:
+		return 8
+	case time.Time:
+		return 9
+	case bson.MongoTimestamp:
+		return 10
+	case bson.RegEx:
+		return 11
+	}
+	return 12
+}
+
+// compareBSON returns a negative number if a < b, 0 if a == b and a positive number if a > b
+func compareBSON(a, b interface{}) int {
+	if orderA, orderB := typeOrder(a), typeOrder(b); orderA != orderB {
+		return orderA - orderB
+	}
+	switch a := a.(type) {
+	case nil:
+		return 0
+	case int, int32, int64, float64:
+		x, _ := toFloat(a)
+		y, _ := toFloat(b)
+		return compareFloats(x, y)
+	case string:
+		return strings.Compare(a, fmt.Sprint(b))
+	case bson.ObjectId:
+		return strings.Compare(string(a), string(b.(bson.ObjectId)))
+	case bool:
+		switch {
+		case a == b.(bool):
+			return 0
+		case a:
+			return 1
+		}
+		return -1
+	case time.Time:
+		switch {
+		case a.Before(b.(time.Time)):
+			return -1
+		case a.After(b.(time.Time)):
+			return 1
+		}
+		return 0
+	case []interface{}:
+		b := b.([]interface{})
+		for i := 0; i < len(a) && i < len(b); i++ {
+			if result := compareBSON(a[i], b[i]); result != 0 {
+				return result
+			}
+		}
+		return len(a) - len(b)
+	}
+	if reflect.DeepEqual(a, b) {
+		return 0
+	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
+
+func equalBSON(a, b interface{}) bool {
+	return compareBSON(a, b) == 0
+}
+
+// isOperatorDocument returns true if value is a document of query operators like { $gt: 1 }
+func isOperatorDocument(value interface{}) bool {
+	document, ok := value.(bson.M)
+	if !ok || len(document) == 0 {
+		return false
+	}
+	if _, ok := document["$ref"]; ok {
+		// a DBRef
+		return false
+	}
+	for key := range document {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// matchDocument returns true if document matches filter
+func matchDocument(document bson.M, filter bson.M) (bool, error) {
+	for key, condition := range filter {
+		switch key {
+		case "$and", "$or", "$nor":
+			filters, ok := condition.([]interface{})
+			if !ok {
+				return false, fmt.Errorf("Error %s expects an array", key)
+			}
+			matches := 0
+			for _, filter := range filters {
+				filter, ok := filter.(bson.M)
+				if !ok {
+					return false, fmt.Errorf("Error %s expects an array of documents", key)
+				}
+				match, err := matchDocument(document, filter)
+				if err != nil {
+					return false, err
+				}
+				if match {
+					matches++
+				}
+			}
+			if (key == "$and" && matches != len(filters)) || (key == "$or" && matches == 0) || (key == "$nor" && matches > 0) {
+				return false, nil
+			}
+		case "$comment":
+		case "$where", "$text", "$expr":
+			return false, fmt.Errorf("Error %s is not supported by the in-memory storage", key)
+		default:
+			match, err := matchValues(lookup(document, strings.Split(key, ".")), condition)
+			if err != nil || !match {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
+
+// matchValues returns true if the values found at a path match a condition
+func matchValues(values []interface{}, condition interface{}) (bool, error) {
+	if !isOperatorDocument(condition) {
+		return matchEquality(values, condition), nil
+	}
+	operators := condition.(bson.M)
+	for operator, argument := range operators {
+		match, err := matchOperator(values, operator, argument, operators)
+		if err != nil || !match {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchEquality returns true if one of the values equals value, or matches value if it is a regular expression
+func matchEquality(values []interface{}, value interface{}) bool {
+	if value == nil && len(values) == 0 {
+		return true
+	}
+	if regex, ok := value.(bson.RegEx); ok {
+		match, _ := matchRegex(values, regex.Pattern, regex.Options)
+		return match
+	}
+	return containsValue(values, value)
+}
+
+func matchRegex(values []interface{}, pattern string, options string) (bool, error) {
+	flags := ""
+	for _, option := range options {
+		if strings.ContainsRune("ims", option) {
+			flags += string(option)
+		}
+	}
+	if flags != "" {
+		pattern = "(?" + flags + ")" + pattern
+	}
+	expression, err := regexp.Compile(pattern)
+	if err != nil {
+		return false, err
+	}
+	for _, value := range values {
+		if value, ok := value.(string); ok && expression.MatchString(value) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func matchOperator(values []interface{}, operator string, argument interface{}, operators bson.M) (bool, error) {
+	switch operator {
+	case "$eq":
+		return matchEquality(values, argument), nil
+	case "$ne":
+		return !matchEquality(values, argument), nil
+	case "$gt", "$gte", "$lt", "$lte":
+		for _, value := range values {
+			if typeOrder(value) != typeOrder(argument) {
+				continue
+			}
+			result := compareBSON(value, argument)
+			if (operator == "$gt" && result > 0) || (operator == "$gte" && result >= 0) ||
+				(operator == "$lt" && result < 0) || (operator == "$lte" && result <= 0) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$in", "$nin", "$all":
+		arguments, ok := argument.([]interface{})
+		if !ok {
+			return false, fmt.Errorf("Error %s expects an array", operator)
+		}
+		matches := 0
+		for _, argument := range arguments {
+			if matchEquality(values, argument) {
+				matches++
+			}
+		}
+		switch operator {
+		case "$in":
+			return matches > 0, nil
+		case "$nin":
+			return matches == 0, nil
+		}
+		return len(arguments) > 0 && matches == len(arguments), nil
+	case "$exists":
+		return isTruthy(argument) == (len(values) > 0), nil
+	case "$regex":
+		options, _ := operators["$options"].(string)
+		switch argument := argument.(type) {
+		case string:
+			return matchRegex(values, argument, options)
+		case bson.RegEx:
+			return matchRegex(values, argument.Pattern, argument.Options+options)
+		}
+		return false, fmt.Errorf("Error $regex expects a string")
+	case "$options":
+		return true, nil
+	case "$not":
+		match, err := matchValues(values, argument)
+		return !match, err
+	case "$size":
+		size, _ := toFloat(argument)
+		for _, value := range values {
+			if array, ok := value.([]interface{}); ok && float64(len(array)) == size {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "$elemMatch":
+		filter, ok := argument.(bson.M)
+		if !ok {
+			return false, fmt.Errorf("Error $elemMatch expects a document")
+		}
+		for _, value := range values {
+			array, ok := value.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, element := range array {
+				match, err := matchElement(element, filter)
+				if err != nil || match {
+					return match, err
+				}
+			}
+		}
+		return false, nil
+	}
+	return false, fmt.Errorf("Error operator %s is not supported by the in-memory storage", operator)
+}
+
+// matchElement returns true if an element of an array matches filter,
+// either a query on an embedded document or a document of operators
+func matchElement(element interface{}, filter bson.M) (bool, error) {
+	if document, ok := element.(bson.M); ok && !isOperatorDocument(filter) {
+		return matchDocument(document, filter)
+	}
+	return matchValues([]interface{}{element}, filter)
+}
+
+func isTruthy(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return value
+	}
+	if number, ok := toFloat(value); ok {
+		return number != 0
+	}
+	return true
+}
+
+// sortDocuments sorts documents by fields, prefixed with a dash (-) for a descending order
+func sortDocuments(documents []bson.M, fields []string) {
+	sort.SliceStable(documents, func(i, j int) bool {
+		for _, field := range fields {
+			descending := strings.HasPrefix(field, "-")
+			parts := strings.Split(strings.TrimLeft(field, "-+"), ".")
+			result := compareBSON(sortValue(documents[i], parts, descending), sortValue(documents[j], parts, descending))
+			if result == 0 {
+				continue
+			}
+			if descending {
+				return result > 0
+			}
+			return result < 0
+		}
+		return false
+	})
+}
+
+// sortValue returns the value documents are sorted by, the smallest element of an array in ascending order
+// and the largest in descending order
+func sortValue(document bson.M, parts []string, descending bool) interface{} {
+	values := lookup(document, parts)
+	if len(values) == 0 {
+		return nil
+	}
+	array, ok := values[0].([]interface{})
+	if !ok {
+		return values[0]
+	}
+	if len(array) == 0 {
+		return nil
+	}
+	value := array[0]
+	for _, element := range array[1:] {
+		if result := compareBSON(element, value); (descending && result > 0) || (!descending && result < 0) {
+			value = element
+		}
+	}
+	return value
+}
+
+// projectDocument returns the keys of document selected by projection, { key: 1 } includes keys, { key: 0 } excludes them
+func projectDocument(document bson.M, projection bson.M) (bson.M, error) {
+	include := false
+	for key, value := range projection {
+		if _, ok := value.(bson.M); ok {
+			return nil, fmt.Errorf("Error projection operators are not supported by the in-memory storage")
+		}
+		if key != "_id" && isTruthy(value) {
+			include = true
+		}
+	}
+	if !include {
+		result := copyValue(document).(bson.M)
+		for key, value := range projection {
+			if !isTruthy(value) {
+				unsetPath(result, strings.Split(key, "."))
+			}
+		}
+		return result, nil
+	}
+	result := bson.M{}
+	if id, ok := document["_id"]; ok {
+		if value, ok := projection["_id"]; !ok || isTruthy(value) {
+			result["_id"] = id
+		}
+	}
+	for key, value := range projection {
+		if key != "_id" && isTruthy(value) {
+			copyPath(document, result, strings.Split(key, "."))
+		}
+	}
+	return result, nil
+}
+
+// copyPath copies the value at a dotted path of source to destination
+func copyPath(source bson.M, destination bson.M, parts []string) {
+	value, ok := source[parts[0]]
+	if !ok {
+		return
+	}
+	if len(parts) == 1 {
+		destination[parts[0]] = copyValue(value)
+		return
+	}
+	switch value := value.(type) {
+	case bson.M:
+		child, ok := destination[parts[0]].(bson.M)
+		if !ok {
+			child = bson.M{}
+			destination[parts[0]] = child
+		}
+		copyPath(value, child, parts[1:])
+	case []interface{}:
+		array, ok := destination[parts[0]].([]interface{})
+		if !ok {
+			array = []interface{}{}
+		}
+		for i, element := range value {
+			if element, ok := element.(bson.M); ok {
+				if i >= len(array) {
+					array = append(array, bson.M{})
+				}
+				if child, ok := array[i].(bson.M); ok {
+					copyPath(element, child, parts[1:])
+				}
+			}
+		}
+		destination[parts[0]] = array
+	}
+}
+
+func copyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case bson.M:
+		result := bson.M{}
+		for key, value := range value {
+			result[key] = copyValue(value)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(value))
+		for i, element := range value {
+			result[i] = copyValue(element)
+		}
+		return result
+	}
+	return value
+}
+
+// setPath sets the value at a dotted path of document, creating the embedded documents on the way
+func setPath(document bson.M, parts []string, value interface{}) error {
+	if len(parts) == 1 {
+		document[parts[0]] = value
+		return nil
+	}
+	switch child := document[parts[0]].(type) {
+	case nil:
+		child = bson.M{}
+		document[parts[0]] = child
+		return setPath(child.(bson.M), parts[1:], value)
+	case bson.M:
+		return setPath(child, parts[1:], value)
+	case []interface{}:
+		index, err := strconv.Atoi(parts[1])
+		if err != nil || index < 0 {
+			return fmt.Errorf("Error can't set %s in an array", parts[1])
+		}
+		for len(child) <= index {
+			child = append(child, nil)
+		}
+		document[parts[0]] = child
+		if len(parts) == 2 {
+			child[index] = value
+			return nil
+		}
+		element, ok := child[index].(bson.M)
+		if !ok {
+			element = bson.M{}
+			child[index] = element
+		}
+		return setPath(element, parts[2:], value)
+	}
+	return fmt.Errorf("Error can't set %s in a %T", parts[1], document[parts[0]])
+}
+
+// unsetPath removes the value at a dotted path of document
+func unsetPath(document bson.M, parts []string) {
+	if len(parts) == 1 {
+		delete(document, parts[0])
+		return
+	}
+	if child, ok := document[parts[0]].(bson.M); ok {
+		unsetPath(child, parts[1:])
+	}
+}
+
+// getPath returns the value at a dotted path of document
+func getPath(document bson.M, parts []string) (interface{}, bool) {
+	value, ok := document[parts[0]]
+	if !ok || len(parts) == 1 {
+		return value, ok
+	}
+	if child, ok := value.(bson.M); ok {
+		return getPath(child, parts[1:])
+	}
+	return nil, false
+}
+
+// isUpdateDocument returns true if update is a document of update operators rather than a replacement
+func isUpdateDocument(update bson.M) bool {
+	for key := range update {
+		if strings.HasPrefix(key, "$") {
+			return true
+		}
+	}
+	return false
+}
+
+// applyUpdate returns document updated by update, insert is true if the document is inserted by an upsert
+func applyUpdate(document bson.M, update bson.M, insert bool) (bson.M, error) {
+	if !isUpdateDocument(update) {
+		result := copyValue(update).(bson.M)
+		if id, ok := document["_id"]; ok {
+			result["_id"] = id
+		}
+		return result, nil
+	}
+	result := copyValue(document).(bson.M)
+	for operator, fields := range update {
+		fields, ok := fields.(bson.M)
+		if !ok {
+			return nil, fmt.Errorf("Error %s expects a document", operator)
+		}
+		for key, argument := range fields {
+			parts := strings.Split(key, ".")
+			current, exists := getPath(result, parts)
+			var err error
+			switch operator {
+			case "$set":
+				err = setPath(result, parts, argument)
+			case "$setOnInsert":
+				if insert {
+					err = setPath(result, parts, argument)
+				}
+			case "$unset":
+				unsetPath(result, parts)
+			case "$inc", "$mul":
+				err = setPath(result, parts, arithmetic(operator, current, exists, argument))
+			case "$min", "$max":
+				if comparison := compareBSON(argument, current); !exists || (operator == "$min" && comparison < 0) || (operator == "$max" && comparison > 0) {
+					err = setPath(result, parts, argument)
+				}
+			case "$push", "$addToSet":
+				array, ok := current.([]interface{})
+				if exists && !ok {
+					return nil, fmt.Errorf("Error %s expects %s to be an array", operator, key)
+				}
+				elements := []interface{}{argument}
+				if document, ok := argument.(bson.M); ok {
+					if each, ok := document["$each"].([]interface{}); ok {
+						elements = each
+					}
+				}
+				for _, element := range elements {
+					if operator == "$addToSet" && containsValue(array, element) {
+						continue
+					}
+					array = append(array, element)
+				}
+				err = setPath(result, parts, array)
+			case "$pull", "$pullAll":
+				array, ok := current.([]interface{})
+				if !ok {
+					continue
+				}
+				remaining := []interface{}{}
+				for _, element := range array {
+					remove := false
+					switch {
+					case operator == "$pullAll":
+						values, _ := argument.([]interface{})
+						remove = containsValue(values, element)
+					case isDocument(argument):
+						if remove, err = matchElement(element, argument.(bson.M)); err != nil {
+							return nil, err
+						}
+					default:
+						remove = equalBSON(element, argument)
+					}
+					if !remove {
+						remaining = append(remaining, element)
+					}
+				}
+				err = setPath(result, parts, remaining)
+			case "$rename":
+				if exists {
+					unsetPath(result, parts)
+					err = setPath(result, strings.Split(fmt.Sprint(argument), "."), current)
+				}
+			default:
+				return nil, fmt.Errorf("Error update operator %s is not supported by the in-memory storage", operator)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, candidate := range values {
+		if equalBSON(candidate, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDocument(value interface{}) bool {
+	_, ok := value.(bson.M)
+	return ok
+}
+
+// arithmetic returns the result of $inc or $mul, integers stay integers
+func arithmetic(operator string, current interface{}, exists bool, argument interface{}) interface{} {
+	if !exists {
+		if operator == "$mul" {
+			current = 0
+		} else {
+			return argument
+		}
+	}
+	a, aInt := current.(int)
+	b, bInt := argument.(int)
+	if aInt && bInt {
+		if operator == "$inc" {
+			return a + b
+		}
+		return a * b
+	}
+	x, _ := toFloat(current)
+	y, _ := toFloat(argument)
+	if operator == "$inc" {
+		return x + y
+	}
+	return x * y
+}
+
+// upsertDocument returns the document inserted by an upsert which selector matched no document
+func upsertDocument(selector bson.M, update bson.M) (bson.M, error) {
+	document := bson.M{}
+	fields := equalityFields(selector)
+	for key, value := range fields {
+		if err := setPath(document, strings.Split(key, "."), value); err != nil {
+			return nil, err
+		}
+	}
+	document, err := applyUpdate(document, update, true)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := document["_id"]; !ok {
+		if id, ok := fields["_id"]; ok {
+			document["_id"] = id
+		} else {
+			document["_id"] = bson.NewObjectId()
+		}
+	}
+	return document, nil
+}
+
+// equalityFields returns the fields a selector matches by equality, including the ones of its $and conditions
+func equalityFields(selector bson.M) bson.M {
+	fields := bson.M{}
+	for key, value := range selector {
+		if key == "$and" {
+			conditions, _ := value.([]interface{})
+			for _, condition := range conditions {
+				if condition, ok := condition.(bson.M); ok {
+					for key, value := range equalityFields(condition) {
+						fields[key] = value
+					}
+				}
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+		if isOperatorDocument(value) {
+			equal, ok := value.(bson.M)["$eq"]
+			if !ok {
+				continue
+			}
+			value = equal
+		}
+		fields[key] = value
+	}
+	return fields
+}
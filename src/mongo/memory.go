@@ -0,0 +1,744 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// memoryStorage keeps the documents in memory
+type memoryStorage struct {
+	*memoryDatabase
+	// context is the context of the operations
+	context context.Context
+}
+
+// memoryDatabase is the database shared by a storage and its copies bound to a context
+type memoryDatabase struct {
+	sync.Mutex
+	name        string
+	collections map[string]*memoryCollectionData
+}
+
+type memoryCollectionData struct {
+	documents []bson.M
+	indexes   []Index
+	// options are the options of the create command and of the collMod command
+	options bson.M
+}
+
+// NewMemoryStorage returns a Storage keeping the documents of a database named name in memory,
+// so that the document manager can be used without a mongodb server, in unit tests for instance.
+//
+// Queries support the comparison, $in, $nin, $exists, $regex, $size, $all, $elemMatch, $not and logical operators,
+// updates support the field and array operators. Unique indexes and the maximum number of documents of capped
+// collections are enforced, other index types, collations and validators are only recorded.
+func NewMemoryStorage(name string) Storage {
+	return &memoryStorage{&memoryDatabase{name: name, collections: map[string]*memoryCollectionData{}}, context.Background()}
+}
+
+// WithContext returns a storage which operations fail with the error of ctx once it is done
+func (storage *memoryStorage) WithContext(ctx context.Context) Storage {
+	return &memoryStorage{storage.memoryDatabase, ctx}
+}
+
+func (storage *memoryStorage) Name() string {
+	return storage.name
+}
+
+// C returns a collection, the options are ignored
+func (storage *memoryStorage) C(name string, options *CollectionOptions) Collection {
+	return memoryCollection{storage, name}
+}
+
+// Run runs the create, collMod, drop, dropDatabase, listCollections, createIndexes, listIndexes and ping commands
+func (storage *memoryStorage) Run(command interface{}, result interface{}) error {
+	if err := storage.context.Err(); err != nil {
+		return err
+	}
+	// the name of the command is its first key
+	ordered := bson.D{}
+	data, err := bson.Marshal(command)
+	if err != nil {
+		return err
+	}
+	if err = bson.Unmarshal(data, &ordered); err != nil {
+		return err
+	}
+	if len(ordered) == 0 {
+		return fmt.Errorf("Error empty command")
+	}
+	arguments, err := toDocument(command)
+	if err != nil {
+		return err
+	}
+	name, _ := ordered[0].Value.(string)
+	response := bson.M{"ok": 1}
+	switch ordered[0].Name {
+	case "ping":
+	case "create":
+		storage.Lock()
+		defer storage.Unlock()
+		if _, ok := storage.collections[name]; ok {
+			return &mgo.QueryError{Code: 48, Message: fmt.Sprintf("collection %s already exists", name)}
+		}
+		delete(arguments, "create")
+		storage.collections[name] = &memoryCollectionData{options: arguments}
+	case "collMod":
+		storage.Lock()
+		defer storage.Unlock()
+		collection, ok := storage.collections[name]
+		if !ok {
+			return &mgo.QueryError{Code: 26, Message: "ns not found"}
+		}
+		for key, value := range arguments {
+			if key != "collMod" {
+				collection.options[key] = value
+			}
+		}
+	case "drop":
+		storage.Lock()
+		defer storage.Unlock()
+		if _, ok := storage.collections[name]; !ok {
+			return &mgo.QueryError{Code: 26, Message: "ns not found"}
+		}
+		delete(storage.collections, name)
+	case "dropDatabase":
+		storage.Lock()
+		defer storage.Unlock()
+		storage.collections = map[string]*memoryCollectionData{}
+	case "listCollections":
+		filter, _ := arguments["filter"].(bson.M)
+		collections := []interface{}{}
+		storage.Lock()
+		for name, collection := range storage.collections {
+			description := bson.M{"name": name, "type": "collection", "options": collection.options}
+			if match, err := matchDocument(description, filter); err != nil {
+				storage.Unlock()
+				return err
+			} else if match {
+				collections = append(collections, description)
+			}
+		}
+		storage.Unlock()
+		response["cursor"] = bson.M{"id": 0, "ns": storage.name + ".$cmd.listCollections", "firstBatch": collections}
+	case "createIndexes":
+		specs := struct {
+			Indexes []IndexSpec `bson:"indexes"`
+		}{}
+		if err = bson.Unmarshal(data, &specs); err != nil {
+			return err
+		}
+		for _, spec := range specs.Indexes {
+			if err = storage.C(name, nil).CreateIndex(spec.Index()); err != nil {
+				return err
+			}
+		}
+	case "listIndexes":
+		indexes, err := storage.C(name, nil).Indexes()
+		if err != nil {
+			return err
+		}
+		specs := []interface{}{}
+		for _, index := range indexes {
+			specs = append(specs, index.Spec())
+		}
+		response["cursor"] = bson.M{"id": 0, "ns": storage.name + "." + name, "firstBatch": specs}
+	default:
+		return &mgo.QueryError{Code: 59, Message: fmt.Sprintf("no such command: '%s'", ordered[0].Name)}
+	}
+	if result == nil {
+		return nil
+	}
+	return decodeDocument(response, result)
+}
+
+func (storage *memoryStorage) CollectionNames() ([]string, error) {
+	if err := storage.context.Err(); err != nil {
+		return nil, err
+	}
+	storage.Lock()
+	defer storage.Unlock()
+	names := []string{}
+	for name := range storage.collections {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Transaction runs fn and restores the documents as they were if fn fails, the indexes created by fn are kept.
+// Transactions aren't isolated : the writes of fn are visible before the commit and the concurrent writes
+// are lost when a transaction is aborted.
+func (storage *memoryStorage) Transaction(fn func(storage Storage) error) error {
+	if err := storage.context.Err(); err != nil {
+		return err
+	}
+	storage.Lock()
+	snapshot := map[string][]bson.M{}
+	for name, collection := range storage.collections {
+		documents := make([]bson.M, len(collection.documents))
+		for i, document := range collection.documents {
+			documents[i] = copyValue(document).(bson.M)
+		}
+		snapshot[name] = documents
+	}
+	storage.Unlock()
+	if err := fn(storage); err != nil {
+		storage.Lock()
+		for name, collection := range storage.collections {
+			collection.documents = snapshot[name]
+		}
+		storage.Unlock()
+		return err
+	}
+	return nil
+}
+
+// collection returns the data of a collection, created if create is true and the collection doesn't exist.
+// The storage must be locked.
+func (storage *memoryStorage) collection(name string, create bool) *memoryCollectionData {
+	collection, ok := storage.collections[name]
+	if !ok && create {
+		collection = &memoryCollectionData{options: bson.M{}}
+		storage.collections[name] = collection
+	}
+	return collection
+}
+
+type memoryCollection struct {
+	storage *memoryStorage
+	name    string
+}
+
+func (collection memoryCollection) Name() string {
+	return collection.name
+}
+
+func (collection memoryCollection) Find(query interface{}) Query {
+	return &memoryQuery{collection: collection, filter: query}
+}
+
+func (collection memoryCollection) FindId(id interface{}) Query {
+	return collection.Find(bson.M{"_id": id})
+}
+
+func (collection memoryCollection) Insert(documents ...interface{}) error {
+	if err := collection.storage.context.Err(); err != nil {
+		return err
+	}
+	collection.storage.Lock()
+	defer collection.storage.Unlock()
+	data := collection.storage.collection(collection.name, true)
+	for _, document := range documents {
+		document, err := toDocument(document)
+		if err != nil {
+			return err
+		}
+		if _, ok := document["_id"]; !ok {
+			document["_id"] = bson.NewObjectId()
+		}
+		if err = collection.checkUniqueness(data, document, -1); err != nil {
+			return err
+		}
+		data.documents = append(data.documents, document)
+		// a capped collection keeps the last max documents
+		if capped, _ := data.options["capped"].(bool); capped {
+			if max, ok := toFloat(data.options["max"]); ok && max > 0 && len(data.documents) > int(max) {
+				data.documents = data.documents[len(data.documents)-int(max):]
+			}
+		}
+	}
+	return nil
+}
+
+func (collection memoryCollection) Update(selector interface{}, update interface{}) error {
+	changeInfo, err := collection.update(selector, update, false, false)
+	if err == nil && changeInfo.Matched == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (collection memoryCollection) UpdateAll(selector interface{}, update interface{}) (*ChangeInfo, error) {
+	return collection.update(selector, update, true, false)
+}
+
+func (collection memoryCollection) Upsert(selector interface{}, update interface{}) (*ChangeInfo, error) {
+	return collection.update(selector, update, false, true)
+}
+
+func (collection memoryCollection) UpsertId(id interface{}, update interface{}) (*ChangeInfo, error) {
+	return collection.update(bson.M{"_id": id}, update, false, true)
+}
+
+func (collection memoryCollection) update(selector interface{}, update interface{}, multi bool, upsert bool) (*ChangeInfo, error) {
+	if err := collection.storage.context.Err(); err != nil {
+		return nil, err
+	}
+	filter, err := toDocument(selector)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := toDocument(update)
+	if err != nil {
+		return nil, err
+	}
+	collection.storage.Lock()
+	defer collection.storage.Unlock()
+	data := collection.storage.collection(collection.name, upsert)
+	changeInfo := &ChangeInfo{}
+	if data != nil {
+		for i, document := range data.documents {
+			match, err := matchDocument(document, filter)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				continue
+			}
+			changeInfo.Matched++
+			updated, err := applyUpdate(document, changes, false)
+			if err != nil {
+				return nil, err
+			}
+			if err = collection.checkUniqueness(data, updated, i); err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(updated, document) {
+				changeInfo.Updated++
+			}
+			data.documents[i] = updated
+			if !multi {
+				break
+			}
+		}
+	}
+	if changeInfo.Matched > 0 || !upsert {
+		return changeInfo, nil
+	}
+	document, err := upsertDocument(filter, changes)
+	if err != nil {
+		return nil, err
+	}
+	if err = collection.checkUniqueness(data, document, -1); err != nil {
+		return nil, err
+	}
+	data.documents = append(data.documents, document)
+	changeInfo.UpsertedId = document["_id"]
+	return changeInfo, nil
+}
+
+func (collection memoryCollection) Remove(selector interface{}) error {
+	changeInfo, err := collection.remove(selector, false)
+	if err == nil && changeInfo.Removed == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (collection memoryCollection) RemoveId(id interface{}) error {
+	return collection.Remove(bson.M{"_id": id})
+}
+
+func (collection memoryCollection) RemoveAll(selector interface{}) (*ChangeInfo, error) {
+	return collection.remove(selector, true)
+}
+
+func (collection memoryCollection) remove(selector interface{}, multi bool) (*ChangeInfo, error) {
+	if err := collection.storage.context.Err(); err != nil {
+		return nil, err
+	}
+	filter, err := toDocument(selector)
+	if err != nil {
+		return nil, err
+	}
+	collection.storage.Lock()
+	defer collection.storage.Unlock()
+	changeInfo := &ChangeInfo{}
+	data := collection.storage.collection(collection.name, false)
+	if data == nil {
+		return changeInfo, nil
+	}
+	remaining := []bson.M{}
+	for _, document := range data.documents {
+		match, err := matchDocument(document, filter)
+		if err != nil {
+			return nil, err
+		}
+		if match && (multi || changeInfo.Removed == 0) {
+			changeInfo.Removed++
+			continue
+		}
+		remaining = append(remaining, document)
+	}
+	changeInfo.Matched = changeInfo.Removed
+	data.documents = remaining
+	return changeInfo, nil
+}
+
+// Aggregate runs the $match, $sort, $skip, $limit, $project and $count stages of a pipeline
+func (collection memoryCollection) Aggregate(pipeline interface{}, result interface{}) error {
+	// the stages are decoded in order as well, so that the keys of $sort stay ordered
+	stages, err := toDocument(bson.M{"pipeline": pipeline})
+	if err != nil {
+		return err
+	}
+	orderedStages := struct {
+		Pipeline []bson.D `bson:"pipeline"`
+	}{}
+	if err = decodeDocument(stages, &orderedStages); err != nil {
+		return err
+	}
+	stageList, _ := stages["pipeline"].([]interface{})
+	documents, err := collection.Find(nil).(*memoryQuery).documents()
+	if err != nil {
+		return err
+	}
+	for i, stage := range stageList {
+		stage, ok := stage.(bson.M)
+		if !ok || len(stage) != 1 {
+			return fmt.Errorf("Error a stage of a pipeline must be a document with a single key")
+		}
+		for operator, argument := range stage {
+			switch operator {
+			case "$match":
+				filter, _ := argument.(bson.M)
+				matched := []bson.M{}
+				for _, document := range documents {
+					match, err := matchDocument(document, filter)
+					if err != nil {
+						return err
+					}
+					if match {
+						matched = append(matched, document)
+					}
+				}
+				documents = matched
+			case "$sort":
+				order, _ := orderedStages.Pipeline[i][0].Value.(bson.D)
+				documents = sortBy(documents, order)
+			case "$skip":
+				n, _ := toFloat(argument)
+				documents = skipLimit(documents, int(n), 0)
+			case "$limit":
+				n, _ := toFloat(argument)
+				documents = skipLimit(documents, 0, int(n))
+			case "$project":
+				projection, _ := argument.(bson.M)
+				for i, document := range documents {
+					if documents[i], err = projectDocument(document, projection); err != nil {
+						return err
+					}
+				}
+			case "$count":
+				documents = []bson.M{{fmt.Sprint(argument): len(documents)}}
+			default:
+				return fmt.Errorf("Error stage %s is not supported by the in-memory storage", operator)
+			}
+		}
+	}
+	return decodeDocuments(documents, result)
+}
+
+// sortBy sorts documents by a sort document, which is ordered
+func sortBy(documents []bson.M, order bson.D) []bson.M {
+	fields := []string{}
+	for _, element := range order {
+		if direction, _ := toFloat(element.Value); direction < 0 {
+			fields = append(fields, "-"+element.Name)
+		} else {
+			fields = append(fields, element.Name)
+		}
+	}
+	sortDocuments(documents, fields)
+	return documents
+}
+
+func skipLimit(documents []bson.M, skip int, limit int) []bson.M {
+	if skip >= len(documents) {
+		return []bson.M{}
+	}
+	documents = documents[skip:]
+	if limit < 0 {
+		limit = -limit
+	}
+	if limit > 0 && limit < len(documents) {
+		documents = documents[:limit]
+	}
+	return documents
+}
+
+// CreateIndex creates an index, an index on the same keys is left untouched
+func (collection memoryCollection) CreateIndex(index Index) error {
+	if err := collection.storage.context.Err(); err != nil {
+		return err
+	}
+	collection.storage.Lock()
+	defer collection.storage.Unlock()
+	data := collection.storage.collection(collection.name, true)
+	for _, current := range data.indexes {
+		if indexKey(current) == indexKey(index) {
+			return nil
+		}
+	}
+	index.Name = index.Spec().Name
+	for i, document := range data.documents {
+		if err := checkIndexUniqueness(collection.storage.name, collection.name, index, data.documents, document, i); err != nil {
+			return err
+		}
+	}
+	data.indexes = append(data.indexes, index)
+	return nil
+}
+
+func (collection memoryCollection) Indexes() ([]Index, error) {
+	if err := collection.storage.context.Err(); err != nil {
+		return nil, err
+	}
+	collection.storage.Lock()
+	defer collection.storage.Unlock()
+	indexes := []Index{{Index: mgo.Index{Key: []string{"_id"}, Name: "_id_"}}}
+	if data := collection.storage.collection(collection.name, false); data != nil {
+		indexes = append(indexes, data.indexes...)
+	}
+	return indexes, nil
+}
+
+func (collection memoryCollection) DropIndexName(name string) error {
+	if err := collection.storage.context.Err(); err != nil {
+		return err
+	}
+	collection.storage.Lock()
+	defer collection.storage.Unlock()
+	if data := collection.storage.collection(collection.name, false); data != nil {
+		for i, index := range data.indexes {
+			if index.Name == name {
+				data.indexes = append(data.indexes[:i], data.indexes[i+1:]...)
+				return nil
+			}
+		}
+	}
+	return &mgo.QueryError{Code: 27, Message: fmt.Sprintf("index not found with name [%s]", name)}
+}
+
+// checkUniqueness returns a duplicate key error if document, at position position of the collection
+// or -1 if it is a new document, violates the _id index or a unique index
+func (collection memoryCollection) checkUniqueness(data *memoryCollectionData, document bson.M, position int) error {
+	indexes := append([]Index{{Index: mgo.Index{Key: []string{"_id"}, Name: "_id_", Unique: true}}}, data.indexes...)
+	for _, index := range indexes {
+		if err := checkIndexUniqueness(collection.storage.name, collection.name, index, data.documents, document, position); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkIndexUniqueness(database string, collection string, index Index, documents []bson.M, document bson.M, position int) error {
+	if !index.Unique {
+		return nil
+	}
+	key, indexed, err := indexValues(index, document)
+	if err != nil || !indexed {
+		return err
+	}
+	for i, other := range documents {
+		if i == position {
+			continue
+		}
+		otherKey, indexed, err := indexValues(index, other)
+		if err != nil {
+			return err
+		}
+		if indexed && equalBSON(key, otherKey) {
+			return &mgo.LastError{Code: 11000, Err: fmt.Sprintf("E11000 duplicate key error collection: %s.%s index: %s dup key: %v",
+				database, collection, index.Name, key)}
+		}
+	}
+	return nil
+}
+
+// indexValues returns the values of the keys of an index in document,
+// indexed is false if the document is excluded from a sparse or a partial index
+func indexValues(index Index, document bson.M) (values []interface{}, indexed bool, err error) {
+	if index.PartialFilter != nil {
+		filter, err := toDocument(index.PartialFilter)
+		if err != nil {
+			return nil, false, err
+		}
+		if match, err := matchDocument(document, filter); err != nil || !match {
+			return nil, false, err
+		}
+	}
+	found := 0
+	for _, key := range index.Key {
+		if strings.HasPrefix(key, "$") {
+			key = strings.SplitN(key, ":", 2)[1]
+		}
+		value, ok := getPath(document, strings.Split(strings.TrimPrefix(key, "-"), "."))
+		if ok {
+			found++
+		}
+		values = append(values, value)
+	}
+	return values, found > 0 || !index.Sparse, nil
+}
+
+type memoryQuery struct {
+	collection memoryCollection
+	filter     interface{}
+	projection interface{}
+	sort       []string
+	skip       int
+	limit      int
+}
+
+func (query *memoryQuery) Select(selector interface{}) Query {
+	query.projection = selector
+	return query
+}
+
+func (query *memoryQuery) Sort(fields ...string) Query {
+	query.sort = fields
+	return query
+}
+
+func (query *memoryQuery) Skip(n int) Query {
+	query.skip = n
+	return query
+}
+
+func (query *memoryQuery) Limit(n int) Query {
+	query.limit = n
+	return query
+}
+
+// Batch is ignored, all the results are in memory
+func (query *memoryQuery) Batch(n int) Query {
+	return query
+}
+
+func (query *memoryQuery) One(result interface{}) error {
+	documents, err := query.documents()
+	if err != nil {
+		return err
+	}
+	if len(documents) == 0 {
+		return ErrNotFound
+	}
+	return decodeDocument(documents[0], result)
+}
+
+func (query *memoryQuery) All(result interface{}) error {
+	documents, err := query.documents()
+	if err != nil {
+		return err
+	}
+	return decodeDocuments(documents, result)
+}
+
+func (query *memoryQuery) Count() (int, error) {
+	documents, err := query.documents()
+	return len(documents), err
+}
+
+func (query *memoryQuery) Iter() Iter {
+	documents, err := query.documents()
+	return &memoryIter{documents: documents, err: err}
+}
+
+// documents returns copies of the documents matching the query
+func (query *memoryQuery) documents() ([]bson.M, error) {
+	if err := query.collection.storage.context.Err(); err != nil {
+		return nil, err
+	}
+	filter, err := toDocument(query.filter)
+	if err != nil {
+		return nil, err
+	}
+	documents := []bson.M{}
+	query.collection.storage.Lock()
+	if data := query.collection.storage.collection(query.collection.name, false); data != nil {
+		for _, document := range data.documents {
+			match, err := matchDocument(document, filter)
+			if err != nil {
+				query.collection.storage.Unlock()
+				return nil, err
+			}
+			if match {
+				documents = append(documents, copyValue(document).(bson.M))
+			}
+		}
+	}
+	query.collection.storage.Unlock()
+	sortDocuments(documents, query.sort)
+	documents = skipLimit(documents, query.skip, query.limit)
+	if query.projection != nil {
+		projection, err := toDocument(query.projection)
+		if err != nil {
+			return nil, err
+		}
+		for i, document := range documents {
+			if documents[i], err = projectDocument(document, projection); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return documents, nil
+}
+
+// decodeDocuments decodes documents in result, a pointer to slice
+func decodeDocuments(documents []bson.M, result interface{}) error {
+	slice := reflect.ValueOf(result)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return ErrNotAnArray
+	}
+	values := reflect.MakeSlice(slice.Elem().Type(), 0, len(documents))
+	for _, document := range documents {
+		value := reflect.New(values.Type().Elem())
+		if err := decodeDocument(document, value.Interface()); err != nil {
+			return err
+		}
+		values = reflect.Append(values, value.Elem())
+	}
+	slice.Elem().Set(values)
+	return nil
+}
+
+type memoryIter struct {
+	documents []bson.M
+	err       error
+}
+
+func (iter *memoryIter) Next(result interface{}) bool {
+	if iter.err != nil || len(iter.documents) == 0 {
+		return false
+	}
+	iter.err = decodeDocument(iter.documents[0], result)
+	iter.documents = iter.documents[1:]
+	return iter.err == nil
+}
+
+func (iter *memoryIter) Close() error {
+	return iter.err
+}
@@ -0,0 +1,373 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mgoStorage adapts a database of gopkg.in/mgo.v2
+type mgoStorage struct {
+	database *mgo.Database
+	// sessions are the sessions of the collections with a read preference or a write concern,
+	// shared by the storages bound to a context with WithContext
+	sessions *mgoSessions
+	// context is the context of the operations
+	context context.Context
+	// clones are the sessions bound to the deadline of context, nil if the storage isn't bound to a context
+	clones *mgoClones
+}
+
+// mgoSession is the copy of the session of a collection with options
+type mgoSession struct {
+	session *mgo.Session
+	options *CollectionOptions
+}
+
+// mgoSessions are the sessions of the collections of a storage, keyed by collection name
+type mgoSessions struct {
+	sync.Mutex
+	sessions map[string]mgoSession
+}
+
+func newMgoSessions() *mgoSessions {
+	return &mgoSessions{sessions: map[string]mgoSession{}}
+}
+
+// mgoClones are the clones of the sessions of a storage bound to a context, keyed by session.
+// A session is cloned once per context and the clones are closed when the context is done.
+type mgoClones struct {
+	sync.Mutex
+	clones map[*mgo.Session]*mgo.Session
+}
+
+// close closes the clones
+func (clones *mgoClones) close() {
+	clones.Lock()
+	defer clones.Unlock()
+	for session, clone := range clones.clones {
+		clone.Close()
+		delete(clones.clones, session)
+	}
+}
+
+// NewMgoStorage returns a Storage of a database of gopkg.in/mgo.v2
+func NewMgoStorage(database *mgo.Database) Storage {
+	return &mgoStorage{database: database, sessions: newMgoSessions(), context: context.Background()}
+}
+
+// WithContext returns a storage which operations are bound to ctx, they fail with the error of ctx once it is done.
+// mgo doesn't support contexts, so a deadline sets the socket timeout of a copy of the session,
+// closed when ctx is done, and the maximum execution time of the queries.
+func (storage *mgoStorage) WithContext(ctx context.Context) Storage {
+	bound := &mgoStorage{database: storage.database, sessions: storage.sessions, context: ctx}
+	if _, ok := ctx.Deadline(); ok {
+		bound.clones = &mgoClones{clones: map[*mgo.Session]*mgo.Session{}}
+		context.AfterFunc(ctx, bound.clones.close)
+	}
+	bound.database = bound.database.With(bound.bind(storage.database.Session))
+	return bound
+}
+
+// Copy returns a storage using a copy of the session, so with its own socket
+func (storage *mgoStorage) Copy() Storage {
+	return &mgoStorage{database: storage.database.With(storage.database.Session.Copy()), sessions: newMgoSessions(),
+		context: storage.context}
+}
+
+// Close closes the sessions of a copy
+func (storage *mgoStorage) Close() {
+	storage.sessions.Lock()
+	for name, cached := range storage.sessions.sessions {
+		cached.session.Close()
+		delete(storage.sessions.sessions, name)
+	}
+	storage.sessions.Unlock()
+	storage.database.Session.Close()
+}
+
+// bind returns a clone of session with the deadline of the context as socket timeout, cloned once per context,
+// or session if the context has no deadline
+func (storage *mgoStorage) bind(session *mgo.Session) *mgo.Session {
+	deadline, ok := storage.context.Deadline()
+	if !ok || storage.clones == nil || time.Until(deadline) <= 0 {
+		return session
+	}
+	storage.clones.Lock()
+	defer storage.clones.Unlock()
+	// the clones are closed once the context is done
+	if storage.context.Err() != nil {
+		return session
+	}
+	if clone, ok := storage.clones.clones[session]; ok {
+		return clone
+	}
+	clone := session.Clone()
+	clone.SetSocketTimeout(time.Until(deadline))
+	storage.clones.clones[session] = clone
+	return clone
+}
+
+func (storage *mgoStorage) Name() string {
+	return storage.database.Name
+}
+
+// C returns a collection. A collection with a read preference or a write concern uses its own copy of the session,
+// which is replaced when the options of the collection change.
+func (storage *mgoStorage) C(name string, options *CollectionOptions) Collection {
+	if !options.hasSessionOptions() {
+		return mgoCollection{storage.database.C(name), storage.context}
+	}
+	storage.sessions.Lock()
+	defer storage.sessions.Unlock()
+	cached, ok := storage.sessions.sessions[name]
+	if ok && cached.options != options {
+		cached.session.Close()
+		ok = false
+	}
+	if !ok {
+		cached = mgoSession{storage.database.Session.Copy(), options}
+		if options.ReadMode != nil {
+			cached.session.SetMode(*options.ReadMode, true)
+		}
+		if options.WriteConcern != nil {
+			cached.session.SetSafe(options.WriteConcern)
+		}
+		storage.sessions.sessions[name] = cached
+	}
+	return mgoCollection{storage.database.C(name).With(storage.bind(cached.session)), storage.context}
+}
+
+func (storage *mgoStorage) Run(command interface{}, result interface{}) error {
+	if err := storage.context.Err(); err != nil {
+		return err
+	}
+	return storage.database.Run(command, result)
+}
+
+func (storage *mgoStorage) CollectionNames() ([]string, error) {
+	if err := storage.context.Err(); err != nil {
+		return nil, err
+	}
+	return storage.database.CollectionNames()
+}
+
+type mgoCollection struct {
+	collection *mgo.Collection
+	context    context.Context
+}
+
+func (collection mgoCollection) Name() string {
+	return collection.collection.Name
+}
+
+func (collection mgoCollection) Find(query interface{}) Query {
+	return mgoQuery{collection.collection.Find(query), collection.context}
+}
+
+func (collection mgoCollection) FindId(id interface{}) Query {
+	return mgoQuery{collection.collection.FindId(id), collection.context}
+}
+
+func (collection mgoCollection) Insert(documents ...interface{}) error {
+	if err := collection.context.Err(); err != nil {
+		return err
+	}
+	return collection.collection.Insert(documents...)
+}
+
+func (collection mgoCollection) Update(selector interface{}, update interface{}) error {
+	if err := collection.context.Err(); err != nil {
+		return err
+	}
+	return collection.collection.Update(selector, update)
+}
+
+func (collection mgoCollection) UpdateAll(selector interface{}, update interface{}) (*ChangeInfo, error) {
+	if err := collection.context.Err(); err != nil {
+		return nil, err
+	}
+	return newChangeInfo(collection.collection.UpdateAll(selector, update))
+}
+
+func (collection mgoCollection) Upsert(selector interface{}, update interface{}) (*ChangeInfo, error) {
+	if err := collection.context.Err(); err != nil {
+		return nil, err
+	}
+	return newChangeInfo(collection.collection.Upsert(selector, update))
+}
+
+func (collection mgoCollection) UpsertId(id interface{}, update interface{}) (*ChangeInfo, error) {
+	if err := collection.context.Err(); err != nil {
+		return nil, err
+	}
+	return newChangeInfo(collection.collection.UpsertId(id, update))
+}
+
+func (collection mgoCollection) Remove(selector interface{}) error {
+	if err := collection.context.Err(); err != nil {
+		return err
+	}
+	return collection.collection.Remove(selector)
+}
+
+func (collection mgoCollection) RemoveId(id interface{}) error {
+	if err := collection.context.Err(); err != nil {
+		return err
+	}
+	return collection.collection.RemoveId(id)
+}
+
+func (collection mgoCollection) RemoveAll(selector interface{}) (*ChangeInfo, error) {
+	if err := collection.context.Err(); err != nil {
+		return nil, err
+	}
+	return newChangeInfo(collection.collection.RemoveAll(selector))
+}
+
+func (collection mgoCollection) Aggregate(pipeline interface{}, result interface{}) error {
+	if err := collection.context.Err(); err != nil {
+		return err
+	}
+	return collection.collection.Pipe(pipeline).All(result)
+}
+
+func (collection mgoCollection) CreateIndex(index Index) error {
+	if err := collection.context.Err(); err != nil {
+		return err
+	}
+	if index.PartialFilter == nil {
+		return collection.collection.EnsureIndex(index.Index)
+	}
+	// mgo.Index doesn't support partial filters
+	return collection.collection.Database.Run(bson.D{{Name: "createIndexes", Value: collection.collection.Name},
+		{Name: "indexes", Value: []interface{}{index.Spec()}}}, nil)
+}
+
+// Indexes returns the indexes of the collection with their partial filters
+func (collection mgoCollection) Indexes() ([]Index, error) {
+	if err := collection.context.Err(); err != nil {
+		return nil, err
+	}
+	mgoIndexes, err := collection.collection.Indexes()
+	if err != nil {
+		return nil, err
+	}
+	result := struct {
+		Cursor struct {
+			FirstBatch []bson.M `bson:"firstBatch"`
+		}
+	}{}
+	if err = collection.collection.Database.Run(bson.D{{Name: "listIndexes", Value: collection.collection.Name}}, &result); err != nil {
+		return nil, err
+	}
+	partialFilters := map[string]bson.M{}
+	for _, spec := range result.Cursor.FirstBatch {
+		name, _ := spec["name"].(string)
+		if filter, ok := spec["partialFilterExpression"].(bson.M); ok {
+			partialFilters[name] = filter
+		}
+	}
+	indexes := []Index{}
+	for _, index := range mgoIndexes {
+		indexes = append(indexes, Index{Index: index, PartialFilter: partialFilters[index.Name]})
+	}
+	return indexes, nil
+}
+
+func (collection mgoCollection) DropIndexName(name string) error {
+	if err := collection.context.Err(); err != nil {
+		return err
+	}
+	return collection.collection.DropIndexName(name)
+}
+
+type mgoQuery struct {
+	query   *mgo.Query
+	context context.Context
+}
+
+func (query mgoQuery) Select(selector interface{}) Query {
+	return mgoQuery{query.query.Select(selector), query.context}
+}
+
+func (query mgoQuery) Sort(fields ...string) Query {
+	return mgoQuery{query.query.Sort(fields...), query.context}
+}
+
+func (query mgoQuery) Skip(n int) Query {
+	return mgoQuery{query.query.Skip(n), query.context}
+}
+
+func (query mgoQuery) Limit(n int) Query {
+	return mgoQuery{query.query.Limit(n), query.context}
+}
+
+func (query mgoQuery) Batch(n int) Query {
+	return mgoQuery{query.query.Batch(n), query.context}
+}
+
+func (query mgoQuery) One(result interface{}) error {
+	if err := query.bind(); err != nil {
+		return err
+	}
+	return query.query.One(result)
+}
+
+func (query mgoQuery) All(result interface{}) error {
+	if err := query.bind(); err != nil {
+		return err
+	}
+	return query.query.All(result)
+}
+
+func (query mgoQuery) Count() (int, error) {
+	if err := query.bind(); err != nil {
+		return 0, err
+	}
+	return query.query.Count()
+}
+
+func (query mgoQuery) Iter() Iter {
+	if err := query.bind(); err != nil {
+		return &memoryIter{err: err}
+	}
+	return query.query.Iter()
+}
+
+// bind returns the error of the context of the query if it is done,
+// or sets the maximum execution time of the query to the deadline of the context
+func (query mgoQuery) bind() error {
+	if err := query.context.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := query.context.Deadline(); ok {
+		query.query.SetMaxTime(time.Until(deadline))
+	}
+	return nil
+}
+
+func newChangeInfo(changeInfo *mgo.ChangeInfo, err error) (*ChangeInfo, error) {
+	if changeInfo == nil {
+		return nil, err
+	}
+	return &ChangeInfo{Updated: changeInfo.Updated, Removed: changeInfo.Removed, Matched: changeInfo.Matched,
+		UpsertedId: changeInfo.UpsertedId}, err
+}
@@ -0,0 +1,372 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	// migrationsCollection is the collection of the applied migrations
+	migrationsCollection = "odm.migrations"
+	// migrationsLockCollection holds the lock of the instance running migrations
+	migrationsLockCollection = "odm.migrations.lock"
+	// migrationsLockTimeout is the time after which a lock which isn't renewed is considered stale
+	migrationsLockTimeout = 10 * time.Minute
+	// migrationsLockHeartbeat is the interval at which the instance running migrations renews its lock
+	migrationsLockHeartbeat = migrationsLockTimeout / 5
+	// migrationBatchSize is the number of documents transformed at once
+	migrationBatchSize = 100
+)
+
+// Migration is a versioned change of the stored documents.
+// Migrations are applied in the order of their ids, ids like "20161001_rename_title" keep them sorted.
+type Migration struct {
+	ID          string
+	Description string
+	// Up applies the migration
+	Up func(ctx context.Context, migrator Migrator) error
+	// Down rolls the migration back, a migration without Down can't be rolled back
+	Down func(ctx context.Context, migrator Migrator) error
+}
+
+// MigrationStatus is the status of a registered migration
+type MigrationStatus struct {
+	ID          string
+	Description string
+	Applied     bool
+	// AppliedAt is the time the migration was applied
+	AppliedAt time.Time
+}
+
+func (status MigrationStatus) String() string {
+	if !status.Applied {
+		return fmt.Sprintf("[ ] %s %s", status.ID, status.Description)
+	}
+	return fmt.Sprintf("[x] %s %s (applied at %s)", status.ID, status.Description, status.AppliedAt.Format(time.RFC3339))
+}
+
+// Migrator runs the migrations of the stored documents and records the applied migrations
+// in a history collection. Only one instance runs migrations at a time.
+type Migrator interface {
+	// Register registers migrations
+	Register(migrations ...Migration) error
+
+	// Up applies the pending migrations and returns the ids of the applied migrations
+	Up(ctx context.Context) ([]string, error)
+
+	// Down rolls back the last steps applied migrations and returns their ids
+	Down(ctx context.Context, steps int) ([]string, error)
+
+	// Status returns the status of the registered migrations
+	Status(ctx context.Context) ([]MigrationStatus, error)
+
+	// GetDocumentManager returns the document manager
+	GetDocumentManager() DocumentManager
+
+	// RenameKey renames the key oldKey of the documents of a registered type to the key
+	// of the struct field named fieldName
+	RenameKey(ctx context.Context, document interface{}, oldKey string, fieldName string) error
+
+	// TransformDocuments loads the documents of a registered type in batches and saves them
+	// after transform is called with each document. document is a pointer to struct of the type.
+	// The documents are saved with their own document manager bound to ctx, the filters are disabled
+	// and the pending documents of the document manager are not flushed.
+	TransformDocuments(ctx context.Context, document interface{}, transform func(document interface{}) error) error
+}
+
+// appliedMigration is a document of the migrations collection
+type appliedMigration struct {
+	ID          string    `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"appliedAt"`
+}
+
+type defaultMigrator struct {
+	documentManager *defaultDocumentManager
+	migrations      map[string]Migration
+}
+
+func newDefaultMigrator(documentManager *defaultDocumentManager) *defaultMigrator {
+	return &defaultMigrator{documentManager: documentManager, migrations: map[string]Migration{}}
+}
+
+func (migrator *defaultMigrator) GetDocumentManager() DocumentManager {
+	return migrator.documentManager
+}
+
+func (migrator *defaultMigrator) Register(migrations ...Migration) error {
+	for _, migration := range migrations {
+		if _, ok := migrator.migrations[migration.ID]; ok {
+			return ErrDuplicateMigration
+		}
+		migrator.migrations[migration.ID] = migration
+	}
+	return nil
+}
+
+func (migrator *defaultMigrator) Up(ctx context.Context) (ids []string, err error) {
+	lock, ctx, err := migrator.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+	applied, err := migrator.applied()
+	if err != nil {
+		return nil, err
+	}
+	for _, migration := range migrator.sortedMigrations() {
+		if _, ok := applied[migration.ID]; ok {
+			continue
+		}
+		if err = lock.check(ctx); err != nil {
+			return ids, err
+		}
+		if migration.Up != nil {
+			if err = migration.Up(ctx, migrator); err != nil {
+				return ids, fmt.Errorf("migration %s : %s", migration.ID, err)
+			}
+		}
+		if err = migrator.documentManager.collection(migrationsCollection).Insert(appliedMigration{migration.ID, migration.Description, time.Now()}); err != nil {
+			return ids, err
+		}
+		migrator.documentManager.log(fmt.Sprintf("Applied migration %s", migration.ID))
+		ids = append(ids, migration.ID)
+	}
+	return ids, nil
+}
+
+func (migrator *defaultMigrator) Down(ctx context.Context, steps int) (ids []string, err error) {
+	if steps < 1 {
+		return nil, nil
+	}
+	lock, ctx, err := migrator.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.release()
+	applied := []appliedMigration{}
+	if err = migrator.documentManager.collection(migrationsCollection).Find(nil).Sort("-appliedAt", "-_id").Limit(steps).All(&applied); err != nil {
+		return nil, err
+	}
+	for _, appliedMigration := range applied {
+		if err = lock.check(ctx); err != nil {
+			return ids, err
+		}
+		migration, ok := migrator.migrations[appliedMigration.ID]
+		if !ok {
+			return ids, ErrMigrationNotFound
+		}
+		if migration.Down == nil {
+			return ids, ErrIrreversibleMigration
+		}
+		if err = migration.Down(ctx, migrator); err != nil {
+			return ids, fmt.Errorf("migration %s : %s", migration.ID, err)
+		}
+		if err = migrator.documentManager.collection(migrationsCollection).RemoveId(migration.ID); err != nil {
+			return ids, err
+		}
+		migrator.documentManager.log(fmt.Sprintf("Rolled back migration %s", migration.ID))
+		ids = append(ids, migration.ID)
+	}
+	return ids, nil
+}
+
+func (migrator *defaultMigrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := migrator.applied()
+	if err != nil {
+		return nil, err
+	}
+	statuses := []MigrationStatus{}
+	for _, migration := range migrator.sortedMigrations() {
+		status := MigrationStatus{ID: migration.ID, Description: migration.Description}
+		if appliedMigration, ok := applied[migration.ID]; ok {
+			status.Applied = true
+			status.AppliedAt = appliedMigration.AppliedAt
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, ctx.Err()
+}
+
+func (migrator *defaultMigrator) RenameKey(ctx context.Context, document interface{}, oldKey string, fieldName string) error {
+	meta, err := migrator.documentManager.metadatas.getMetadatas(reflect.TypeOf(document))
+	if err != nil {
+		return err
+	}
+	field, ok := meta.findField(fieldName)
+	if !ok {
+		return ErrFieldNotFound
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	changeInfo, err := migrator.documentManager.collection(meta.targetDocument).UpdateAll(bson.M{oldKey: bson.M{"$exists": true}},
+		bson.M{"$rename": bson.M{oldKey: field.key}})
+	if err != nil {
+		return err
+	}
+	migrator.documentManager.log(fmt.Sprintf("Renamed key %s to %s in %d documents of %s", oldKey, field.key, changeInfo.Updated, meta.targetDocument))
+	return nil
+}
+
+func (migrator *defaultMigrator) TransformDocuments(ctx context.Context, document interface{}, transform func(document interface{}) error) error {
+	// the documents are written by a document manager with its own pending documents
+	manager := migrator.documentManager.withContext(ctx)
+	manager.enabledFilters = map[string]FilterParameters{}
+	meta, err := manager.metadatas.getMetadatas(reflect.TypeOf(document))
+	if err != nil {
+		return err
+	}
+	query := bson.M{}
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		manager.tasks, manager.hidden = tasks{}, hiddenReferences{}
+		documents := reflect.New(reflect.SliceOf(meta.structType))
+		if err = manager.collection(meta.targetDocument).Find(query).Sort("_id").Limit(migrationBatchSize).All(documents.Interface()); err != nil {
+			return err
+		}
+		if documents.Elem().Len() == 0 {
+			return nil
+		}
+		// relations are resolved so that saving the documents doesn't drop their references
+		if err = manager.resolveRelations(documents.Interface(), nil); err != nil {
+			return err
+		}
+		for i := 0; i < documents.Elem().Len(); i++ {
+			document := documents.Elem().Index(i).Interface()
+			if err = transform(document); err != nil {
+				return err
+			}
+			manager.Persist(document)
+		}
+		if err = manager.Flush(); err != nil {
+			return err
+		}
+		last, _ := manager.metadatas.getDocumentID(documents.Elem().Index(documents.Elem().Len() - 1).Interface())
+		query = bson.M{"_id": bson.M{"$gt": last}}
+	}
+}
+
+// migrationLock is the migrations lock held by the instance running migrations
+type migrationLock struct {
+	migrator   *defaultMigrator
+	collection Collection
+	owner      bson.ObjectId
+	// stop stops the heartbeat renewing the lock
+	stop func()
+}
+
+// lock acquires the migrations lock. The lock document is upserted only if it is missing or stale,
+// otherwise the upsert collides with the existing lock on _id. While the lock is held, a heartbeat renews it
+// so that it doesn't become stale during long migrations, the returned context is canceled with
+// ErrMigrationLocked if the lock is lost.
+func (migrator *defaultMigrator) lock(ctx context.Context) (*migrationLock, context.Context, error) {
+	collection := migrator.documentManager.collection(migrationsLockCollection)
+	owner := bson.NewObjectId()
+	now := time.Now()
+	_, err := collection.Upsert(bson.M{"_id": "lock", "acquiredAt": bson.M{"$lt": now.Add(-migrationsLockTimeout)}},
+		bson.M{"$set": bson.M{"owner": owner, "acquiredAt": now}})
+	if isDuplicateKey(err) {
+		return nil, nil, ErrMigrationLocked
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	lock := &migrationLock{migrator: migrator, collection: collection, owner: owner}
+	ctx, cancel := context.WithCancelCause(ctx)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(migrationsLockHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := lock.renew(); err != nil {
+					cancel(err)
+					return
+				}
+			}
+		}
+	}()
+	lock.stop = func() {
+		close(done)
+		<-stopped
+		cancel(nil)
+	}
+	return lock, ctx, nil
+}
+
+// renew refreshes the time the lock was acquired at, it returns ErrMigrationLocked if the lock
+// was taken over by another instance
+func (lock *migrationLock) renew() error {
+	err := lock.collection.Update(bson.M{"_id": "lock", "owner": lock.owner}, bson.M{"$set": bson.M{"acquiredAt": time.Now()}})
+	if err == ErrNotFound {
+		return ErrMigrationLocked
+	}
+	return err
+}
+
+// check returns the error of ctx, or an error if the lock is no longer held, before a migration is run
+func (lock *migrationLock) check(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return lock.renew()
+}
+
+// release stops the heartbeat and releases the lock
+func (lock *migrationLock) release() {
+	lock.stop()
+	if err := lock.collection.Remove(bson.M{"_id": "lock", "owner": lock.owner}); err != nil && err != ErrNotFound {
+		lock.migrator.documentManager.log(fmt.Sprintf("Error releasing migrations lock : %s", err))
+	}
+}
+
+// applied returns the applied migrations keyed by id
+func (migrator *defaultMigrator) applied() (map[string]appliedMigration, error) {
+	applied := []appliedMigration{}
+	if err := migrator.documentManager.collection(migrationsCollection).Find(nil).All(&applied); err != nil {
+		return nil, err
+	}
+	result := map[string]appliedMigration{}
+	for _, migration := range applied {
+		result[migration.ID] = migration
+	}
+	return result, nil
+}
+
+// sortedMigrations returns the registered migrations sorted by id
+func (migrator *defaultMigrator) sortedMigrations() []Migration {
+	migrations := []Migration{}
+	for _, migration := range migrator.migrations {
+		migrations = append(migrations, migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].ID < migrations[j].ID })
+	return migrations
+}
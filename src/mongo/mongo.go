@@ -16,8 +16,10 @@
 package mongo
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"strconv"
 	"strings"
 
 	"../funcs"
@@ -45,6 +47,30 @@ var (
 	ErrNotImpletemented = fmt.Errorf("Error a called method is not implemented")
 	// ErrFieldNotFound : Error a field metada was requested and not found
 	ErrFieldNotFound = fmt.Errorf("Error a field metada was requested and not found ")
+	// ErrMigrationLocked is yielded when migrations are being run by another instance
+	ErrMigrationLocked = fmt.Errorf("Error migrations are locked by another instance")
+	// ErrMigrationNotFound is yielded when an applied migration is not registered
+	ErrMigrationNotFound = fmt.Errorf("Error migration not found")
+	// ErrDuplicateMigration is yielded when 2 migrations with the same id are registered
+	ErrDuplicateMigration = fmt.Errorf("Error a migration with the same id is already registered")
+	// ErrIrreversibleMigration is yielded when rolling back a migration without a Down function
+	ErrIrreversibleMigration = fmt.Errorf("Error the migration can't be rolled back")
+	// ErrNotFound is yielded when no document matches a query, storages return it whatever the driver
+	ErrNotFound = mgo.ErrNotFound
+	// ErrFilterNotRegistered is yielded when enabling a filter which wasn't registered
+	ErrFilterNotRegistered = fmt.Errorf("Error the filter was not registered in the document manager")
+	// ErrFilterFieldNotFound is yielded when registering a FieldFilter on a field no registered document has
+	ErrFilterFieldNotFound = fmt.Errorf("Error the filtered field was not found in the registered documents")
+	// ErrFilterParameterMissing is yielded when enabling a FieldFilter without its parameter
+	ErrFilterParameterMissing = fmt.Errorf("Error the parameter of the filter is missing")
+	// ErrFilteredDocument is yielded when writing a document which exists but doesn't match the enabled filters
+	ErrFilteredDocument = fmt.Errorf("Error the document is not visible under the enabled filters")
+	// ErrSoftDeleteNotMapped is yielded when restoring a document which type has no softDelete field
+	ErrSoftDeleteNotMapped = fmt.Errorf("Error the document has no softDelete field")
+	// ErrForeignDatabaseReference is yielded when resolving a DBRef to a document of another database
+	ErrForeignDatabaseReference = fmt.Errorf("Error the reference points to a document of another database")
+	// ErrTransactionsNotSupported is yielded when the storage or the deployment doesn't support transactions
+	ErrTransactionsNotSupported = fmt.Errorf("Error transactions are not supported by the database")
 	// ErrInvalidAnnotation : An invalid mongo-odm annotation was found , check your odm struct tag
 	ErrInvalidAnnotation = fmt.Errorf("An invalid mongo-odm annotation was found , check your odm struct tag")
 	zeroMetadata         = metadata{}
@@ -62,23 +88,101 @@ type DocumentManager interface {
 	// use DocumentManager.RegisterMany to register many documents at the same time.
 	Register(collectionName string, value interface{}) error
 
+	// RegisterMapping registers a document type mapped by a Mapping rather than by its struct tags
+	RegisterMapping(value interface{}, mapping Mapping) error
+
+	// RegisterMappingFile registers document types with the mappings of a YAML or JSON file
+	RegisterMappingFile(path string, values ...interface{}) error
+
+	// Map returns a builder of the mapping of a document type, as an alternative to struct tags
+	Map(value interface{}) *MappingBuilder
+
+	// RegisterWithOptions registers a document type with the options of its collection :
+	// capped size, collation, validator, read preference and write concern.
+	RegisterWithOptions(collectionName string, value interface{}, options *CollectionOptions) error
+
 	// register many documents or returns an error on error
 	RegisterMany(documents map[string]interface{}) error
 
+	// Validate checks the relations between the registered document types
+	// and returns MappingErrors listing each problem
+	Validate() error
+
+	// GetMetadataFor returns the metadata of a registered document type,
+	// typeOrValue is either a document, its type or its collection name
+	GetMetadataFor(typeOrValue interface{}) (*ClassMetadata, error)
+
+	// AllMetadata returns the metadata of the registered document types
+	AllMetadata() []*ClassMetadata
+
 	// Persist saves a document. No document is sent to the db
 	// until flush is called
 	Persist(document interface{})
 
 	// Remove deletes a document. Flush must be called to commit changes
-	// to the database
+	// to the database. A document which type has a softDelete field isn't deleted,
+	// the field is set to the time of the flush.
 	Remove(document interface{})
 
-	// Flush executes saves,updates and removes pending in the document manager
+	// Restore resets the softDelete field of a soft deleted document. Flush must be called to commit changes
+	// to the database. The references to a soft deleted document are kept, a restored document is related again
+	// to the documents referencing it.
+	Restore(document interface{})
+
+	// WithDeleted returns a document manager sharing the pending documents of the document manager
+	// which finders and queries find the soft deleted documents, they are excluded by default
+	WithDeleted() DocumentManager
+
+	// OnlyDeleted returns a document manager sharing the pending documents of the document manager
+	// which finders and queries only find the soft deleted documents
+	OnlyDeleted() DocumentManager
+
+	// RegisterFilter registers a global query filter named name, disabled until EnableFilter is called.
+	// The filtered documents must be registered first, a FieldFilter on a field no registered document has
+	// yields ErrFilterFieldNotFound
+	RegisterFilter(name string, filter Filter) error
+
+	// EnableFilter enables the filter named name with parameters on the document manager,
+	// or returns ErrFilterNotRegistered, or ErrFilterParameterMissing if the parameter of a FieldFilter is missing
+	EnableFilter(name string, parameters FilterParameters) error
+
+	// DisableFilter disables the filter named name on the document manager
+	DisableFilter(name string)
+
+	// IsFilterEnabled returns true if the filter named name is enabled on the document manager
+	IsFilterEnabled(name string) bool
+
+	// Flush executes saves,updates and removes pending in the document manager.
+	// It stops at the first failure, returned as a *FlushError.
 	Flush() error
 
+	// FlushWithResult executes the pending saves, updates and removes like Flush but doesn't stop at the first failure,
+	// the documents which failed stay pending. The result lists the documents written and the failures,
+	// the error is the first failure.
+	FlushWithResult() (*FlushResult, error)
+
+	// SetTransactionalFlush makes Flush write the pending documents in a transaction when enabled is true,
+	// see Transactional
+	SetTransactionalFlush(enabled bool)
+
+	// Transactional runs fn with a document manager bound to a transaction and flushes the documents fn persisted
+	// or removed in the transaction, which is committed if fn and the flush succeed. fn is run again when the
+	// transaction fails with a transient error.
+	// If the storage or the deployment doesn't support transactions, the documents are flushed without transaction
+	// and a *PartialFlushError reports the documents written before a failure.
+	Transactional(fn func(documentManager DocumentManager) error) error
+
+	// FlushContext flushes like Flush, bound to ctx : the deadline of ctx is propagated to the database
+	// and the flush stops before the next pending operation once ctx is done, leaving the remaining ones pending.
+	FlushContext(ctx context.Context) error
+
 	// FindID finds a document by ID
 	FindID(id interface{}, returnValue interface{}) error
 
+	// FindIDContext finds a document by ID like FindID, bound to ctx : the deadline of ctx is propagated to the database
+	// and the resolution of the relations stops once ctx is done.
+	FindIDContext(ctx context.Context, id interface{}, returnValue interface{}) error
+
 	// FIndOne finds a single document
 	FindOne(query interface{}, returnValue interface{}) error
 
@@ -89,13 +193,37 @@ type DocumentManager interface {
 	FindAll(returnValues interface{}) error
 
 	// GetDB returns the driver's DB
+	// Deprecated: use GetStorage, GetDB returns nil unless the storage is a NewMgoStorage
 	GetDB() *mgo.Database
 
+	// GetStorage returns the storage of the documents
+	GetStorage() Storage
+
 	// SetLogger sets the logger
 	SetLogger(logger.Logger)
 
 	// CreateQuery creates a query builder for complex queries
 	CreateQuery() queryBuilder
+
+	// GetSchemaManager returns the schema manager which manages the indexes
+	// of the registered documents
+	GetSchemaManager() SchemaManager
+
+	// GetMigrator returns the migrator which runs the migrations of the stored documents
+	GetMigrator() Migrator
+
+	// CheckIntegrity walks the relations of documents and reports references to documents that don't exist
+	// and relations which mappedBy field can't be found.
+	// documents are pointers to struct of the registered types to check, all registered types are checked
+	// if none is provided.
+	CheckIntegrity(ctx context.Context, documents ...interface{}) (*IntegrityReport, error)
+
+	// RepairIntegrity removes the dangling references found by CheckIntegrity
+	RepairIntegrity(ctx context.Context, report *IntegrityReport) error
+
+	// Close releases the connection of a document manager created by a DocumentManagerFactory,
+	// it does nothing for other document managers.
+	Close()
 }
 
 // TODO DocumentManager.ResolveRelations resolve relationships for a document or a collection
@@ -104,20 +232,104 @@ type DocumentManager interface {
 // ResolveRelations(documentOrCollection interface{})error
 
 type defaultDocumentManager struct {
-	database  *mgo.Database
-	metadatas metadatas
-	tasks     tasks
-	logger    logger.Logger
+	storage       Storage
+	context       context.Context
+	metadatas     metadatas
+	tasks         tasks
+	logger        logger.Logger
+	schemaManager *defaultSchemaManager
+	migrator      *defaultMigrator
+	// sharedMetadatas is true when metadatas are shared by the document managers of a DocumentManagerFactory
+	sharedMetadatas bool
+	// release releases the copy of the storage of a document manager created by a DocumentManagerFactory
+	release func()
+	// filters are the registered filters, enabledFilters the parameters of the enabled ones
+	filters        map[string]Filter
+	enabledFilters map[string]FilterParameters
+	// softDeleteMode selects the soft deleted documents found
+	softDeleteMode softDeleteMode
+	// transactionalFlush is true when Flush writes the pending documents in a transaction
+	transactionalFlush bool
+	// removed are the documents removed by a document manager bound to a transaction,
+	// their ids are reset once the transaction is committed
+	removed []interface{}
+	// assigned are the documents which id was assigned by a document manager bound to a transaction,
+	// their ids are reset if the transaction is aborted
+	assigned []interface{}
+	// hidden are the stored references of the loaded documents which related documents aren't exposed
+	hidden hiddenReferences
 }
 
-// NewDocumentManager returns a DocumentManager
+// NewDocumentManager returns a DocumentManager storing documents with gopkg.in/mgo.v2
 func NewDocumentManager(database *mgo.Database) DocumentManager {
-	return &defaultDocumentManager{database: database, metadatas: map[reflect.Type]metadata{}, tasks: tasks{}}
+	if database == nil {
+		return NewDocumentManagerWithStorage(nil)
+	}
+	return NewDocumentManagerWithStorage(NewMgoStorage(database))
+}
+
+// NewDocumentManagerWithStorage returns a DocumentManager storing documents in storage,
+// either NewMgoStorage or the storage of another driver
+func NewDocumentManagerWithStorage(storage Storage) DocumentManager {
+	manager := &defaultDocumentManager{storage: storage, context: context.Background(), metadatas: map[reflect.Type]metadata{}, tasks: tasks{},
+		filters: map[string]Filter{}, enabledFilters: map[string]FilterParameters{}, hidden: hiddenReferences{}}
+	manager.schemaManager = newDefaultSchemaManager(manager)
+	manager.migrator = newDefaultMigrator(manager)
+	return manager
+}
+
+// withContext returns a copy of the document manager which operations are bound to ctx.
+// The copy shares on purpose the registered documents, the registered migrations, the ensured indexes,
+// the hidden references and the pending tasks of manager, so that FlushContext flushes the tasks of manager, and the copy
+// of the storage released by Close. The filters are copied : enabling or disabling a filter in the copy
+// doesn't change manager.
+func (manager *defaultDocumentManager) withContext(ctx context.Context) *defaultDocumentManager {
+	bound := *manager
+	bound.context = ctx
+	if manager.storage != nil {
+		bound.storage = manager.storage.WithContext(ctx)
+	}
+	bound.filters, bound.enabledFilters = map[string]Filter{}, map[string]FilterParameters{}
+	for name, filter := range manager.filters {
+		bound.filters[name] = filter
+	}
+	for name, parameters := range manager.enabledFilters {
+		bound.enabledFilters[name] = parameters
+	}
+	bound.schemaManager = &defaultSchemaManager{documentManager: &bound, ensured: manager.schemaManager.ensured}
+	bound.migrator = &defaultMigrator{documentManager: &bound, migrations: manager.migrator.migrations}
+	return &bound
+}
+
+// Close releases the copy of the storage of a document manager created by a DocumentManagerFactory
+func (manager *defaultDocumentManager) Close() {
+	if manager.release != nil {
+		manager.release()
+		manager.release = nil
+	}
 }
 
-// GetDB returns the original mongodb connection
+// GetDB returns the original mongodb connection, nil if the storage isn't a NewMgoStorage
 func (manager *defaultDocumentManager) GetDB() *mgo.Database {
-	return manager.database
+	if storage, ok := manager.storage.(*mgoStorage); ok {
+		return storage.database
+	}
+	return nil
+}
+
+// GetStorage returns the storage of the documents
+func (manager *defaultDocumentManager) GetStorage() Storage {
+	return manager.storage
+}
+
+// GetSchemaManager returns the schema manager
+func (manager *defaultDocumentManager) GetSchemaManager() SchemaManager {
+	return manager.schemaManager
+}
+
+// GetMigrator returns the migrator
+func (manager *defaultDocumentManager) GetMigrator() Migrator {
+	return manager.migrator
 }
 
 func (manager *defaultDocumentManager) SetLogger(Logger logger.Logger) {
@@ -134,6 +346,11 @@ func (manager *defaultDocumentManager) log(messages ...interface{}) {
 // document is a pointer to struct.
 // use DocumentManager.RegisterMany to register many documents at the same time.
 func (manager *defaultDocumentManager) Register(targetDocument string, document interface{}) error {
+	return manager.register(targetDocument, document, tagDriver{})
+}
+
+// register registers a document type which fields are mapped by driver
+func (manager *defaultDocumentManager) register(targetDocument string, document interface{}, driver mappingDriver) error {
 	documentType := reflect.TypeOf(document)
 	if documentType.Kind() != reflect.Ptr {
 		return ErrNotAPointer
@@ -141,25 +358,47 @@ func (manager *defaultDocumentManager) Register(targetDocument string, document
 	if documentType.Elem().Kind() != reflect.Struct {
 		return ErrNotAstruct
 	}
-	meta, err := getTypeMetadatas(document)
+	meta, err := getTypeMetadatasWithDriver(document, driver)
 	if err != nil {
 		return err
 	}
 	meta.structType = documentType
 	meta.targetDocument = targetDocument
 	// parser := tag.NewParser(strings.NewReader(s string) )
-	manager.metadatas[documentType] = meta
+	manager.setMetadata(meta)
 
 	manager.log("Type registered :", targetDocument, meta)
 	return nil
 }
 
+// setMetadata sets the metadata of a document type. The metadatas of a document manager created by
+// a DocumentManagerFactory are shared with the other document managers of the factory, so they are copied first.
+func (manager *defaultDocumentManager) setMetadata(meta metadata) {
+	if manager.sharedMetadatas {
+		metadatas := metadatas{}
+		for Type, meta := range manager.metadatas {
+			metadatas[Type] = meta
+		}
+		manager.metadatas = metadatas
+		manager.sharedMetadatas = false
+	}
+	manager.metadatas[meta.structType] = meta
+}
+
+// RegisterMany registers every document and returns the problems of all of them as MappingErrors
 func (manager *defaultDocumentManager) RegisterMany(documents map[string]interface{}) error {
+	errors := MappingErrors{}
 	for targetDocument, document := range documents {
-		if err := manager.Register(targetDocument, document); err != nil {
+		err := manager.Register(targetDocument, document)
+		if mappingErrors, ok := err.(MappingErrors); ok {
+			errors = append(errors, mappingErrors...)
+		} else if err != nil {
 			return err
 		}
 	}
+	if len(errors) > 0 {
+		return errors
+	}
 	return nil
 }
 
@@ -167,6 +406,7 @@ func (manager *defaultDocumentManager) Persist(value interface{}) {
 	if id, _ := manager.metadatas.getDocumentID(value); !id.Valid() {
 		// new document, insert
 		manager.metadatas.setIDForValue(value, bson.NewObjectId())
+		manager.assign(value)
 		manager.tasks[value] = insert
 		return
 	}
@@ -179,53 +419,84 @@ func (manager *defaultDocumentManager) Remove(document interface{}) {
 }
 
 func (manager *defaultDocumentManager) Flush() error {
+	if manager.transactionalFlush {
+		_, err := manager.flushInTransaction()
+		return err
+	}
+	_, err := manager.flush(false)
+	return err
+}
+
+func (manager *defaultDocumentManager) FlushWithResult() (*FlushResult, error) {
+	if manager.transactionalFlush {
+		return manager.flushInTransaction()
+	}
+	return manager.flush(true)
+}
+
+// flush executes the pending tasks, a failure is returned as a *FlushError.
+// flush stops at the first failure unless keepGoing is true, the documents which failed stay pending then.
+func (manager *defaultDocumentManager) flush(keepGoing bool) (*FlushResult, error) {
 	// TODO : a document should be flushed only once
 	// keep track of a document that has already been flushed
 	// and don't had it again to the tasks.
 	// removing should take priority on persisting.
+	result := &FlushResult{Operations: []Operation{}, Failures: []*FlushError{}}
+	failed := tasks{}
+	defer func() {
+		for document, task := range failed {
+			manager.tasks[document] = task
+		}
+	}()
 	for len(manager.tasks) != 0 {
+		// the remaining tasks stay pending when the context is done
+		if err := manager.context.Err(); err != nil {
+			return result, err
+		}
 		document, theTask := manager.tasks.pop()
-		switch theTask {
-		case del:
-			if err := manager.doRemove(document); err != nil {
-				return err
-			}
-		case insert, update:
-			metaData, err := manager.metadatas.getMetadatas(reflect.TypeOf(document))
-			if err != nil {
-				return err
-			}
-			// deal with index creation
-			// TODO it should be dealt with once
-			if metaData.hasFieldWithIndex() {
-				for _, index := range metaData.getIndexes() {
-					err = manager.database.C(metaData.targetDocument).EnsureIndex(index)
-					if err != nil {
-						return err
-					}
-				}
-
-			}
-
-			// deal with composite index creation
-			// TODO it should be dealt with once
-			if metaData.hasFieldWithComposite() {
-				for _, index := range metaData.getComposites() {
-					err = manager.database.C(metaData.targetDocument).EnsureIndex(index)
-					if err != nil {
-						return err
-					}
-				}
-
-			}
-			if err := manager.doPersist(document); err != nil {
-				return err
+		metaData, err := manager.metadatas.getMetadatas(reflect.TypeOf(document))
+		operation := Operation{Type: theTask.String(), Collection: metaData.targetDocument, Document: document}
+		if err == nil {
+			err = manager.execute(theTask, document, metaData)
+		}
+		if err != nil {
+			flushError := &FlushError{Operation: operation, Err: err}
+			result.Failures = append(result.Failures, flushError)
+			if !keepGoing {
+				return result, flushError
 			}
+			failed[document] = theTask
+			continue
 		}
+		result.Operations = append(result.Operations, operation)
+	}
+	if len(result.Failures) > 0 {
+		return result, result.Failures[0]
+	}
+	return result, nil
+}
+
+// execute executes the task of a document
+func (manager *defaultDocumentManager) execute(theTask task, document interface{}, metaData metadata) error {
+	switch theTask {
+	case del:
+		return manager.doRemove(document)
+	case insert, update:
+		return manager.doPersist(document)
+	case restore:
+		return manager.doRestore(document, metaData)
 	}
 	return nil
 }
 
+func (manager *defaultDocumentManager) FlushContext(ctx context.Context) error {
+	bound := manager.withContext(ctx)
+	if err := bound.ensureTenantIndexes(); err != nil {
+		return err
+	}
+	return bound.Flush()
+}
+
 func (manager *defaultDocumentManager) FindBy(query interface{}, documents interface{}) error {
 	Value := reflect.ValueOf(documents)
 	if Value.Kind() != reflect.Ptr {
@@ -239,10 +510,10 @@ func (manager *defaultDocumentManager) FindBy(query interface{}, documents inter
 	if !ok {
 		return ErrDocumentNotRegistered
 	}
-	if err := manager.database.C(meta.targetDocument).Find(query).All(documents); err != nil {
+	if err := manager.find(meta.targetDocument, query).All(documents); err != nil {
 		return err
 	}
-	return manager.resolveRelations(documents)
+	return manager.resolveRelations(documents, nil)
 }
 
 func (manager *defaultDocumentManager) FindAll(documents interface{}) error {
@@ -258,10 +529,10 @@ func (manager *defaultDocumentManager) FindAll(documents interface{}) error {
 	if !ok {
 		return ErrDocumentNotRegistered
 	}
-	if err := manager.database.C(meta.targetDocument).Find(nil).All(documents); err != nil {
+	if err := manager.find(meta.targetDocument, nil).All(documents); err != nil {
 		return err
 	}
-	return manager.resolveRelations(documents)
+	return manager.resolveRelations(documents, nil)
 }
 
 func (manager *defaultDocumentManager) FindOne(query interface{}, document interface{}) error {
@@ -276,10 +547,10 @@ func (manager *defaultDocumentManager) FindOne(query interface{}, document inter
 	if !ok {
 		return ErrDocumentNotRegistered
 	}
-	if err := manager.database.C(meta.targetDocument).Find(query).One(document); err != nil {
+	if err := manager.find(meta.targetDocument, query).One(document); err != nil {
 		return err
 	}
-	return manager.resolveRelations(document)
+	return manager.resolveRelations(document, nil)
 }
 
 func (manager *defaultDocumentManager) FindID(documentID interface{}, document interface{}) error {
@@ -294,11 +565,19 @@ func (manager *defaultDocumentManager) FindID(documentID interface{}, document i
 	if !ok {
 		return ErrDocumentNotRegistered
 	}
-	err := manager.database.C(meta.targetDocument).FindId(documentID).One(document)
+	err := manager.find(meta.targetDocument, bson.M{"_id": documentID}).One(document)
 	if err != nil {
 		return err
 	}
-	return manager.resolveRelations(document)
+	return manager.resolveRelations(document, nil)
+}
+
+func (manager *defaultDocumentManager) FindIDContext(ctx context.Context, documentID interface{}, document interface{}) error {
+	bound := manager.withContext(ctx)
+	if err := bound.ensureTenantIndexes(); err != nil {
+		return err
+	}
+	return bound.FindID(documentID, document)
 }
 
 func (manager *defaultDocumentManager) CreateQuery() queryBuilder {
@@ -334,6 +613,10 @@ func (manager *defaultDocumentManager) doRemove(document interface{}) error {
 	}
 	Value := reflect.Indirect(reflect.ValueOf(document))
 	Map := manager.structToMap(document)
+	// the related documents of a document of another tenant are not removed either
+	if err := manager.checkVisible(metadata, Map["_id"]); err != nil {
+		return err
+	}
 	if metadata.hasRelation() {
 		for _, field := range metadata.getFieldsWithRelation() {
 			if field.relation.cascade == all || field.relation.cascade == remove {
@@ -343,8 +626,11 @@ func (manager *defaultDocumentManager) doRemove(document interface{}) error {
 					if Type != nil {
 						many := Value.FieldByName(field.name)
 						for i := 0; i < many.Len(); i++ {
-							doc := many.Index(i)
-							idField, ok := meta.findIDField()
+							doc, docMeta, ok := manager.relatedDocument(meta, many.Index(i))
+							if !ok {
+								continue
+							}
+							idField, ok := docMeta.findIDField()
 							if !ok {
 								continue
 							}
@@ -358,11 +644,11 @@ func (manager *defaultDocumentManager) doRemove(document interface{}) error {
 					// add id of the reference to map , and add the reference in the documents to be saved
 					meta, Type := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
 					if Type != nil {
-						one := Value.FieldByName(field.name)
-						if isZero(one.Interface()) {
+						one, oneMeta, ok := manager.relatedDocument(meta, Value.FieldByName(field.name))
+						if !ok {
 							continue
 						}
-						idField, ok := meta.findIDField()
+						idField, ok := oneMeta.findIDField()
 						if !ok {
 							continue
 						}
@@ -375,12 +661,23 @@ func (manager *defaultDocumentManager) doRemove(document interface{}) error {
 			}
 		}
 	}
-	err := manager.database.C(metadata.targetDocument).RemoveId(Map["_id"])
+	// a soft deleted document and its links are kept
+	if metadata.softDelete != "" {
+		return manager.softRemove(document, metadata, Map["_id"])
+	}
+	err := manager.collection(metadata.targetDocument).Remove(bson.M{"_id": Map["_id"]})
 	if err != nil {
 		return err
 	}
-	// set the id to a zero value
-	manager.metadatas.setIDForValue(document, zeroObjectID)
+	if err = manager.removeLinks(metadata, Map["_id"].(bson.ObjectId)); err != nil {
+		return err
+	}
+	// set the id to a zero value, once the transaction is committed if any
+	if manager.removed != nil {
+		manager.removed = append(manager.removed, document)
+	} else {
+		manager.metadatas.setIDForValue(document, zeroObjectID)
+	}
 	manager.log(fmt.Sprintf("Removed document with id '%s' from collection '%s' ", Map["_id"], metadata.targetDocument))
 	return nil
 }
@@ -390,69 +687,116 @@ func (manager *defaultDocumentManager) doPersist(document interface{}) error {
 	if !ok {
 		return ErrDocumentNotRegistered
 	}
+	// the document is upserted by id, so a document of another tenant with the same id must not be overwritten
+	if id, err := manager.metadatas.getDocumentID(document); err != nil {
+		return err
+	} else if err = manager.checkVisible(metadata, id); err != nil {
+		return err
+	}
+	if err := manager.stamp(document, metadata); err != nil {
+		return err
+	}
 	Value := reflect.Indirect(reflect.ValueOf(document))
 	Map := manager.structToMap(document)
+	linksToPersist := []link{}
 	if metadata.hasRelation() {
 		for _, field := range metadata.getFieldsWithRelation() {
 			if field.relation.mapped != mappedBy {
 				switch field.relation.relation {
 				case referenceMany:
 					objectIDs := []bson.ObjectId{}
+					references := []interface{}{}
 					meta, Type := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
 					if Type != nil {
 						many := Value.FieldByName(field.name)
 						for i := 0; i < many.Len(); i++ {
-							doc := many.Index(i)
-							idField, ok := meta.findIDField()
+							doc, docMeta, ok := manager.relatedDocument(meta, many.Index(i))
+							if !ok {
+								continue
+							}
+							idField, ok := docMeta.findIDField()
 							if !ok {
 								continue
 							}
 							id := doc.Elem().FieldByName(idField.name)
 							if isZero(id.Interface()) {
 								doc.Elem().FieldByName(idField.name).Set(reflect.ValueOf(bson.NewObjectId()))
+								manager.assign(doc.Interface())
 							}
 							objectIDs = append(objectIDs, doc.Elem().FieldByName(idField.name).Interface().(bson.ObjectId))
+							references = append(references, manager.referenceValue(field.relation, manager.referenceTargetDocument(field.relation, doc), objectIDs[len(objectIDs)-1]))
 							if field.relation.cascade == all || field.relation.cascade == persist {
 								manager.tasks[doc.Interface()] = insert
 							}
 						}
 					}
-					Map[field.key] = objectIDs
+					// the references the field doesn't expose are kept
+					hidden := manager.hidden.of(document, field.name, objectIDs)
+					if field.relation.through != "" {
+						// the links of a registered association document are persisted as association documents
+						if _, associationType := manager.metadatas.findMetadataByCollectionName(field.relation.through); associationType != nil {
+							continue
+						}
+						for _, reference := range hidden {
+							objectIDs = append(objectIDs, reference.id)
+						}
+						// links are stored in the join collection once the document is saved
+						linksToPersist = append(linksToPersist, link{field, objectIDs})
+						continue
+					}
+					for _, reference := range hidden {
+						references = append(references, manager.storedValue(field.relation, reference))
+					}
+					Map[field.key] = references
 				case referenceOne:
 					// add id of the reference to map , and add the reference in the documents to be saved
 					meta, Type := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
 					if Type != nil {
-						one := Value.FieldByName(field.name)
-						if isZero(one.Interface()) {
+						one, oneMeta, ok := manager.relatedDocument(meta, Value.FieldByName(field.name))
+						if !ok {
 							continue
 						}
-						idField, ok := meta.findIDField()
+						idField, ok := oneMeta.findIDField()
 						if !ok {
 							continue
 						}
 						id := one.Elem().FieldByName(idField.name)
 						if isZero(id.Interface()) {
 							one.Elem().FieldByName(idField.name).Set(reflect.ValueOf(bson.NewObjectId()))
+							manager.assign(one.Interface())
 						}
 						if field.relation.cascade == all || field.relation.cascade == persist {
 							manager.tasks[one.Interface()] = insert
 						}
-						Map[field.key] = one.Elem().FieldByName(idField.name).Interface().(bson.ObjectId)
+						Map[field.key] = manager.referenceValue(field.relation, manager.referenceTargetDocument(field.relation, one), one.Elem().FieldByName(idField.name).Interface().(bson.ObjectId))
 					}
 				}
 			}
 		}
 	}
 	id := Map["_id"]
-	if changeInfo, err := manager.database.C(metadata.targetDocument).UpsertId(id, bson.M{"$set": stripID(Map)}); err != nil {
+	if changeInfo, err := manager.collection(metadata.targetDocument).Upsert(bson.M{"_id": id}, bson.M{"$set": stripID(Map)}); isDuplicateKey(err) {
+		return uniqueViolation(metadata, Map, err)
+	} else if err != nil {
 		return err
 	} else {
 		manager.log(fmt.Sprintf("Persisted document with id '%s' from collection '%s' , %+v ", id, metadata.targetDocument, changeInfo))
 	}
+	for _, link := range linksToPersist {
+		if err := manager.persistLinks(metadata, link.field, id.(bson.ObjectId), link.relatedIDs); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (manager *defaultDocumentManager) resolveRelations(documents interface{}, selectedFields ...string) error {
+// link is a pending update of the links of a through relation
+type link struct {
+	field      field
+	relatedIDs []bson.ObjectId
+}
+
+func (manager *defaultDocumentManager) resolveRelations(documents interface{}, orders relationOrders, selectedFields ...string) error {
 	// this operation is recursive so we need to keep track of the documents than have already
 	// been fetched from the DB by their (unique) objectIDs.
 	// the relations are resolved recursively. When no relation needs to be resolved or if an error occurs, return.
@@ -468,10 +812,12 @@ func (manager *defaultDocumentManager) resolveRelations(documents interface{}, s
 			documents = slice.Interface()
 		}
 	}
-	return manager.doResolveRelations(documents, map[bson.ObjectId]interface{}{}, selectedFields...)
+	return manager.doResolveRelations(documents, map[bson.ObjectId]interface{}{}, orders, selectedFields...)
 }
 
-func (manager *defaultDocumentManager) doResolveRelations(documents interface{}, fetchedDocuments map[bson.ObjectId]interface{}, selectedFields ...string) error {
+// doResolveRelations resolves the relations of a collection of documents.
+// orders overrides how the referenceMany relations of the documents are sorted and limited.
+func (manager *defaultDocumentManager) doResolveRelations(documents interface{}, fetchedDocuments map[bson.ObjectId]interface{}, orders relationOrders, selectedFields ...string) error {
 	manager.log("Resolving all relations for :", reflect.TypeOf(documents))
 	// top is a flag denoting whether it is the first recursive iteration of resolve or not
 	top := len(fetchedDocuments) == 0
@@ -508,6 +854,10 @@ func (manager *defaultDocumentManager) doResolveRelations(documents interface{},
 		// for each field that has a relation
 		manager.log(fmt.Sprintf("Found %d fields with relation", len(meta.getFieldsWithRelation())))
 		for _, field := range meta.getFieldsWithRelation() {
+			// stop resolving relations when the context is done
+			if err := manager.context.Err(); err != nil {
+				return err
+			}
 			// if field.key not in selected fields and selected fields length > 0
 			// do not check the field for relations
 			if len(selectedFields) > 0 && indexOfString(selectedFields, field.name) < 0 {
@@ -518,6 +868,7 @@ func (manager *defaultDocumentManager) doResolveRelations(documents interface{},
 				continue
 			}
 			manager.log("\tRelation for field : ", field.name, field.relation.relation, field.relation.targetDocument, field.relation.mapped, field.relation.mappedField)
+			order := orders.get(field)
 			switch field.relation.relation {
 
 			case referenceMany:
@@ -536,35 +887,66 @@ func (manager *defaultDocumentManager) doResolveRelations(documents interface{},
 						if !ok {
 							return ErrFieldNotFound
 						}
-						if err = manager.GetDB().C(relatedMetadata.targetDocument).Find(bson.M{relatedField.key: bson.M{"$in": documentIds}}).Select(bson.M{"_id": 1, relatedField.key: 1}).All(&relatedDocs); err != nil && err != mgo.ErrNotFound {
+						if relatedField.relation.through != "" {
+							// the owning side stores its links in a join collection
+							joinKey, inverseJoinKey := manager.getJoinKeys(relatedMetadata, relatedField)
+							if err = manager.resolveLinks(field, order, relatedField.relation.through, inverseJoinKey, joinKey, sourceValuesKeyedBySourceID, fetchedDocuments); err != nil {
+								return err
+							}
+							continue
+						}
+						selection := bson.M{"_id": 1, relatedField.key: 1}
+						sortKeys := order.keys(relatedMetadata)
+						for _, key := range sortKeys {
+							selection[strings.TrimPrefix(key, "-")] = 1
+						}
+						relatedDocsMappedBySourceId := map[bson.ObjectId][]map[string]interface{}{}
+						// the ids and sort keys of the related documents of all the documents are fetched at once,
+						// sorted by the database
+						query := manager.find(relatedMetadata.targetDocument, bson.M{relatedField.relation.queryKey(relatedField.key): bson.M{"$in": documentIds}}).Select(selection)
+						if len(sortKeys) > 0 {
+							query = query.Sort(sortKeys...)
+						}
+						if err = query.All(&relatedDocs); err != nil && err != ErrNotFound {
 							return err
 						}
 						manager.log("\tnumber of documents found in the db", len(relatedDocs))
-
-						relatedDocsMappedBySourceId := map[bson.ObjectId][]map[string]interface{}{}
 						// 2 cases , the difference between them is wether one has to iterate through objectIds
 						// or mutliple arrays of objectIds
 						switch relatedField.relation.relation {
 						case referenceMany:
 							// iterate through docs containing arrays of object ids
 							for _, doc := range relatedDocs {
-								for _, id := range doc[relatedField.key].([]interface{}) {
-									relatedDocsMappedBySourceId[id.(bson.ObjectId)] = append(relatedDocsMappedBySourceId[id.(bson.ObjectId)], doc)
+								for _, id := range referenceIDs(doc[relatedField.key]) {
+									relatedDocsMappedBySourceId[id] = append(relatedDocsMappedBySourceId[id], doc)
 								}
 							}
 						case referenceOne:
 							// iterate through docs containing object ids
 							for _, doc := range relatedDocs {
-								relatedDocsMappedBySourceId[doc[relatedField.key].(bson.ObjectId)] = append(relatedDocsMappedBySourceId[doc[relatedField.key].(bson.ObjectId)], doc)
+								if id, ok := referenceID(doc[relatedField.key]); ok {
+									relatedDocsMappedBySourceId[id] = append(relatedDocsMappedBySourceId[id], doc)
+								}
+							}
+						}
+						// only the first related documents of each document are fetched
+						if order.limit > 0 {
+							for sourceId, relatedDocsOfSource := range relatedDocsMappedBySourceId {
+								if len(relatedDocsOfSource) > order.limit {
+									relatedDocsMappedBySourceId[sourceId] = relatedDocsOfSource[:order.limit]
+								}
 							}
 						}
 						relatedCollection := reflect.New(reflect.SliceOf(relatedType))
 						// filter out documents that are already in memory
-						relatedIds := filter(relatedDocs.getIds(), func(id bson.ObjectId) bool {
-							_, ok := fetchedDocuments[id]
-							return !ok
-						})
-						if err = manager.GetDB().C(relatedMetadata.targetDocument).Find(bson.M{"_id": bson.M{"$in": relatedIds}}).All(relatedCollection.Interface()); err != nil && err != mgo.ErrNotFound {
+						relatedIds := []bson.ObjectId{}
+						for _, relatedDocsOfSource := range relatedDocsMappedBySourceId {
+							relatedIds = append(relatedIds, filter(docs(relatedDocsOfSource).getIds(), func(id bson.ObjectId) bool {
+								_, ok := fetchedDocuments[id]
+								return !ok
+							})...)
+						}
+						if err = manager.find(relatedMetadata.targetDocument, bson.M{"_id": bson.M{"$in": relatedIds}}).All(relatedCollection.Interface()); err != nil && err != ErrNotFound {
 							return err
 						}
 						relatedDocsMappedById := map[bson.ObjectId]reflect.Value{}
@@ -592,77 +974,86 @@ func (manager *defaultDocumentManager) doResolveRelations(documents interface{},
 							}
 						}
 						// resolve relations for the related documents we just fetched
-						if err = manager.doResolveRelations(relatedCollection.Interface(), fetchedDocuments); err != nil {
+						if err = manager.doResolveRelations(relatedCollection.Interface(), fetchedDocuments, nil); err != nil {
 							return err
 						}
 					}
 				default:
+					if field.relation.through != "" {
+						// all relations for referenceMany/through
+						joinKey, inverseJoinKey := manager.getJoinKeys(meta, field)
+						if err = manager.resolveLinks(field, order, field.relation.through, joinKey, inverseJoinKey, sourceValuesKeyedBySourceID, fetchedDocuments); err != nil {
+							return err
+						}
+						continue
+					}
 					{ // all relations for referenceMany/inversedBy
 
 						// the documents reference many related documents
 						results := []map[string]interface{}{}
-						if err = manager.GetDB().C(meta.targetDocument).Find(bson.M{"_id": bson.M{"$in": documentIds}}).Select(bson.M{field.key: 1, "_id": 1}).All(&results); err != nil {
+						if err = manager.collection(meta.targetDocument).Find(bson.M{"_id": bson.M{"$in": documentIds}}).Select(bson.M{field.key: 1, "_id": 1}).All(&results); err != nil {
 							return err
 						}
-						resultsKeyedByObjectID := keyResultsBySourceID(results, func(result map[string]interface{}) bson.ObjectId {
-							return result["_id"].(bson.ObjectId)
-						})
-
-						// let's see if some related documents have already been fetched
-						for objectID, result := range resultsKeyedByObjectID {
-							value := sourceValuesKeyedBySourceID[objectID]
-							// if field is empty continue
-							if _, ok := result[field.key]; !ok {
-								continue
-							}
-							// otherwise iterate
-							for _, relatedID := range result[field.key].([]interface{}) {
-								if document, ok := fetchedDocuments[relatedID.(bson.ObjectId)]; ok {
-									value.Elem().FieldByName(field.name).Set(reflect.Append(value.Elem().FieldByName(field.name), reflect.ValueOf(document)))
+						relatedMeta, relatedType := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
+						if relatedType == nil {
+							return ErrDocumentNotRegistered
+						}
+						// related references keyed by source id, in the order they are stored
+						relatedReferencesKeyedBySourceID := map[bson.ObjectId][]reference{}
+						storedReferencesKeyedBySourceID := map[bson.ObjectId][]reference{}
+						for _, result := range results {
+							relatedReferences := referencesOf(result[field.key])
+							storedReferencesKeyedBySourceID[result["_id"].(bson.ObjectId)] = relatedReferences
+							if order.limit > 0 && len(relatedReferences) > order.limit {
+								if len(order.sort) == 0 {
+									// without sort, the first stored references are the ones kept by the limit
+									relatedReferences = relatedReferences[:order.limit]
+								} else if relatedReferences, err = manager.firstReferences(field.relation, relatedMeta, order, relatedReferences); err != nil {
+									return err
 								}
 							}
+							relatedReferencesKeyedBySourceID[result["_id"].(bson.ObjectId)] = relatedReferences
 						}
 						// let's filter out already existing related documents by objectID
-						relatedObjectIds := filter(mapInterfacesToObjectIds(flatten(mapResultsToInterfaces(results, func(result map[string]interface{}) []interface{} {
-							if _, ok := result[field.key]; !ok {
-								return []interface{}{}
+						referencesToFetch := []reference{}
+						for _, relatedReferences := range relatedReferencesKeyedBySourceID {
+							for _, relatedReference := range relatedReferences {
+								// a reference to another database is never satisfied by the documents in memory
+								if _, ok := fetchedDocuments[relatedReference.id]; !ok || manager.isForeign(relatedReference) {
+									referencesToFetch = append(referencesToFetch, relatedReference)
+								}
 							}
-							return result[field.key].([]interface{})
-						}),
-						), func(i interface{}) bson.ObjectId {
-							return i.(bson.ObjectId)
-						}),
-							func(id bson.ObjectId) bool {
-								_, ok := fetchedDocuments[id]
-								return !ok
-							})
-						// if there is no related document to fetch, continue
-						if len(relatedObjectIds) == 0 {
-							continue
 						}
-						_, relatedType := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
-						if relatedType == nil {
-							return ErrDocumentNotRegistered
-						}
-						relatedDocumentValues := reflect.New(reflect.SliceOf(relatedType))
 						// fetch the remaining related documents
-						if err = manager.GetDB().C(field.relation.targetDocument).Find(bson.M{"_id": bson.M{"$in": relatedObjectIds}}).All(relatedDocumentValues.Interface()); err != nil {
+						relatedDocumentValuesKeyedByObjectID, fetched, err := manager.fetchReferences(field.relation, referencesToFetch)
+						if err != nil {
 							return err
 						}
-						for objectID, result := range resultsKeyedByObjectID {
-							value := sourceValuesKeyedBySourceID[objectID]
-							for _, id := range result[field.key].([]interface{}) {
-								for i := 0; i < relatedDocumentValues.Elem().Len(); i++ {
-									relatedObjectID, _ := manager.metadatas.getDocumentID(relatedDocumentValues.Elem().Index(i).Interface())
-									if id.(bson.ObjectId) == relatedObjectID {
-										value.Elem().FieldByName(field.name).Set(reflect.Append(value.Elem().FieldByName(field.name), relatedDocumentValues.Elem().Index(i)))
-									}
+						for objectID, relatedReferences := range relatedReferencesKeyedBySourceID {
+							many := sourceValuesKeyedBySourceID[objectID].Elem().FieldByName(field.name)
+							exposed := map[bson.ObjectId]bool{}
+							for _, relatedReference := range relatedReferences {
+								// search in the documents already in memory, then in the documents that have just been fetched
+								document, ok := relatedDocumentValuesKeyedByObjectID[relatedReference.id]
+								if fetchedDocument, inMemory := fetchedDocuments[relatedReference.id]; inMemory {
+									document, ok = reflect.ValueOf(fetchedDocument), true
 								}
+								// a DBRef may reference a document of a type the field can't hold
+								if ok && document.Type().AssignableTo(many.Type().Elem()) {
+									many.Set(reflect.Append(many, document))
+									exposed[relatedReference.id] = true
+								}
+							}
+							manager.hidden.hide(sourceValuesKeyedBySourceID[objectID].Interface(), field.name, storedReferencesKeyedBySourceID[objectID], exposed)
+							if len(order.sort) > 0 {
+								order.apply(many)
 							}
 						}
 						// lets resolve the relations of the related documents
-						if err = manager.doResolveRelations(relatedDocumentValues.Interface(), fetchedDocuments); err != nil {
-							return err
+						for _, relatedDocumentValues := range fetched {
+							if err = manager.doResolveRelations(relatedDocumentValues, fetchedDocuments, nil); err != nil {
+								return err
+							}
 						}
 					}
 				}
@@ -685,7 +1076,7 @@ func (manager *defaultDocumentManager) doResolveRelations(documents interface{},
 							return ErrFieldNotFound
 						}
 						// we have a list of source document ids, let's fetch the related documents
-						if err = manager.GetDB().C(relatedMeta.targetDocument).Find(bson.M{"_id": bson.M{"$nin": documentIds}, relatedField.key: bson.M{"$in": documentIds}}).Select(bson.M{"_id": 1, relatedField.key: 1}).All(&relatedDocumentMaps); err != nil {
+						if err = manager.find(relatedMeta.targetDocument, bson.M{"_id": bson.M{"$nin": documentIds}, relatedField.relation.queryKey(relatedField.key): bson.M{"$in": documentIds}}).Select(bson.M{"_id": 1, relatedField.key: 1}).All(&relatedDocumentMaps); err != nil {
 							return err
 						}
 						// 2 cases here. if the related documents reference many then we need to search through an array
@@ -699,8 +1090,8 @@ func (manager *defaultDocumentManager) doResolveRelations(documents interface{},
 								if _, ok := fetchedDocuments[relatedDocument["_id"].(bson.ObjectId)]; !ok {
 									relatedDocumentIds = append(relatedDocumentIds, relatedDocument["_id"].(bson.ObjectId))
 								}
-								for _, id := range relatedDocument[relatedField.key].([]interface{}) {
-									relatedDocumentsMapsMappedByDocumentID[id.(bson.ObjectId)] = relatedDocument
+								for _, id := range referenceIDs(relatedDocument[relatedField.key]) {
+									relatedDocumentsMapsMappedByDocumentID[id] = relatedDocument
 								}
 							}
 						default:
@@ -709,13 +1100,15 @@ func (manager *defaultDocumentManager) doResolveRelations(documents interface{},
 								if _, ok := fetchedDocuments[relatedDocument["_id"].(bson.ObjectId)]; !ok {
 									relatedDocumentIds = append(relatedDocumentIds, relatedDocument["_id"].(bson.ObjectId))
 								}
-								relatedDocumentsMapsMappedByDocumentID[relatedDocument[relatedField.key].(bson.ObjectId)] = relatedDocument
+								if id, ok := referenceID(relatedDocument[relatedField.key]); ok {
+									relatedDocumentsMapsMappedByDocumentID[id] = relatedDocument
+								}
 							}
 						}
 
 						// let's load the actual related documents fully typed
 						relatedDocuments := reflect.New(reflect.SliceOf(relatedType))
-						if err = manager.GetDB().C(relatedMeta.targetDocument).Find(bson.M{"_id": bson.M{"$in": relatedDocumentIds}}).All(relatedDocuments.Interface()); err != nil && err != mgo.ErrNotFound {
+						if err = manager.find(relatedMeta.targetDocument, bson.M{"_id": bson.M{"$in": relatedDocumentIds}}).All(relatedDocuments.Interface()); err != nil && err != ErrNotFound {
 							return err
 						}
 						relatedDocumentsMappedByDocumentID := map[bson.ObjectId]reflect.Value{}
@@ -741,7 +1134,7 @@ func (manager *defaultDocumentManager) doResolveRelations(documents interface{},
 							}
 						}
 						// let's resolve the possible relations in the related documents we just fetched
-						if err = manager.doResolveRelations(relatedDocuments.Interface(), fetchedDocuments); err != nil {
+						if err = manager.doResolveRelations(relatedDocuments.Interface(), fetchedDocuments, nil); err != nil {
 							return err
 						}
 					}
@@ -750,63 +1143,48 @@ func (manager *defaultDocumentManager) doResolveRelations(documents interface{},
 
 						// the documents reference one related document
 						results := []map[string]interface{}{}
-						if err = manager.GetDB().C(meta.targetDocument).Find(bson.M{field.key: bson.M{"$exists": true}, "_id": bson.M{"$in": documentIds}}).Select(bson.M{field.key: 1, "_id": 1}).All(&results); err != nil && err != mgo.ErrNotFound {
+						if err = manager.collection(meta.targetDocument).Find(bson.M{field.key: bson.M{"$exists": true}, "_id": bson.M{"$in": documentIds}}).Select(bson.M{field.key: 1, "_id": 1}).All(&results); err != nil && err != ErrNotFound {
 							return err
 						}
 						resultsKeyedByObjectID := keyResultsBySourceID(results, func(result map[string]interface{}) bson.ObjectId {
 							return result["_id"].(bson.ObjectId)
 						})
 
-						// search in fetched documents if the relation can already be satisified
-						// if yes then set the field of the related doc to the fetched document
-						for objectID, result := range resultsKeyedByObjectID {
-							if relatedObjectID, ok := result[field.key].(bson.ObjectId); ok {
-								if document, ok := fetchedDocuments[relatedObjectID]; ok {
-									sourceValuesKeyedBySourceID[objectID].Elem().FieldByName(field.name).Set(reflect.ValueOf(document))
+						// we don't need the documents that have already been fetched
+						referencesToFetch := []reference{}
+						for _, result := range results {
+							if relatedReference, ok := referenceOf(result[field.key]); ok && relatedReference.id.Valid() {
+								// a reference to another database is never satisfied by the documents in memory
+								if _, ok := fetchedDocuments[relatedReference.id]; !ok || manager.isForeign(relatedReference) {
+									referencesToFetch = append(referencesToFetch, relatedReference)
 								}
 							}
 						}
-						// we don't need the object ids that have already been fetched
-						relatedObjectIds := filter(mapResultsToRelatedObjectIds(results, func(result map[string]interface{}) bson.ObjectId {
-							return result[field.key].(bson.ObjectId)
-						}), func(id bson.ObjectId) bool {
-							_, ok := fetchedDocuments[id]
-							return !ok
-						})
-						// if there is no related document left to fetch , continue
-						if len(relatedObjectIds) == 0 {
-							continue
-						}
-						relatedMeta, relatedType := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
-						if relatedType == nil {
-							return ErrDocumentNotRegistered
-						}
-						relatedDocumentValues := reflect.New(reflect.SliceOf(relatedType))
 						// fetch the remaining documents from the db
-						if err = manager.GetDB().C(field.relation.targetDocument).Find(bson.M{"_id": bson.M{"$in": relatedObjectIds}}).All(relatedDocumentValues.Interface()); err != nil && err != mgo.ErrNotFound {
+						relatedDocumentValuesKeyedByObjectID, fetched, err := manager.fetchReferences(field.relation, referencesToFetch)
+						if err != nil {
 							return err
 						}
-						relatedDocumentValuesKeyedByObjectID := keyRelatedResultsByObjectID(func() []reflect.Value {
-							// transform reflect.Value into []reflect.Value so it can be iterated more easily
-							values := []reflect.Value{}
-							for i := 0; i < relatedDocumentValues.Elem().Len(); i++ {
-								values = append(values, relatedDocumentValues.Elem().Index(i))
-							}
-							return values
-						}(), func(value reflect.Value) bson.ObjectId {
-							//println(relatedMeta.idField)
-							//println(value.Elem().FieldByName(relatedMeta.idField).Interface().(bson.ObjectId))
-							return value.Elem().FieldByName(relatedMeta.idField).Interface().(bson.ObjectId)
-						})
 						for id, value := range sourceValuesKeyedBySourceID {
-							result := resultsKeyedByObjectID[id]
-							relatedID := result[field.key].(bson.ObjectId)
-							relatedResult := relatedDocumentValuesKeyedByObjectID[relatedID]
-							value.Elem().FieldByName(field.name).Set(relatedResult)
+							relatedID, ok := referenceID(resultsKeyedByObjectID[id][field.key])
+							if !ok {
+								continue
+							}
+							// search in the documents already in memory, then in the documents that have just been fetched
+							document, ok := relatedDocumentValuesKeyedByObjectID[relatedID]
+							if fetchedDocument, inMemory := fetchedDocuments[relatedID]; inMemory {
+								document, ok = reflect.ValueOf(fetchedDocument), true
+							}
+							// a DBRef may reference a document of a type the field can't hold
+							if one := value.Elem().FieldByName(field.name); ok && document.Type().AssignableTo(one.Type()) {
+								one.Set(document)
+							}
 						}
 						// lets resolve the relations of the related documents
-						if err = manager.doResolveRelations(relatedDocumentValues.Interface(), fetchedDocuments); err != nil {
-							return err
+						for _, relatedDocumentValues := range fetched {
+							if err = manager.doResolveRelations(relatedDocumentValues, fetchedDocuments, nil); err != nil {
+								return err
+							}
 						}
 					}
 				}
@@ -833,6 +1211,10 @@ type metadata struct {
 	idKey string
 	// fields are metadatas for struct fields
 	fields []field
+	// collectionOptions are the options of the collection
+	collectionOptions *CollectionOptions
+	// softDelete is the struct field name of the field holding the time of the soft deletion, if any
+	softDelete string
 }
 
 func (meta metadata) String() string {
@@ -871,10 +1253,16 @@ func (meta metadata) findFieldsWithIndex() []field {
 }
 
 // getIndexes create a list of indexes from the metadata
-func (meta metadata) getIndexes() []mgo.Index {
-	indexes := []mgo.Index{}
+func (meta metadata) getIndexes() []Index {
+	indexes := []Index{}
 	for _, field := range meta.findFieldsWithIndex() {
-		indexes = append(indexes, mgo.Index{Key: []string{field.key}, Unique: field.unique})
+		options := field.indexOptions
+		index := Index{Index: mgo.Index{Key: []string{options.indexKey(field.key)}, Unique: options.unique,
+			Sparse: options.sparse, ExpireAfter: options.expireAfter, Name: options.name}}
+		if options.partialFilter {
+			index.PartialFilter = bson.M{field.key: bson.M{"$exists": true}}
+		}
+		indexes = append(indexes, index)
 	}
 	return indexes
 }
@@ -900,14 +1288,44 @@ func (meta metadata) findFieldsWithComposite() []field {
 	return fieldsWithComposite
 }
 
-// getComposites create a list of indexes from the metadata
-func (meta metadata) getComposites() []mgo.Index {
-	indexes := []mgo.Index{}
-	keys := []string{}
+// getComposites create a list of indexes from the metadata,
+// composite fields are grouped by the name of their composite definition
+func (meta metadata) getComposites() []Index {
+	indexes := []Index{}
+	positions := map[string]int{}
 	for _, field := range meta.findFieldsWithComposite() {
-		keys = append(keys,field.key)
+		for _, options := range field.compositeOptions {
+			position, ok := positions[options.name]
+			if !ok {
+				position = len(indexes)
+				positions[options.name] = position
+				indexes = append(indexes, Index{Index: mgo.Index{Name: options.name, Unique: true}})
+			}
+			index := &indexes[position]
+			index.Key = append(index.Key, options.indexKey(field.key))
+			// a single non unique field makes the whole composite non unique
+			index.Unique = index.Unique && options.unique
+			index.Sparse = index.Sparse || options.sparse
+			if options.partialFilter {
+				if index.PartialFilter == nil {
+					index.PartialFilter = bson.M{}
+				}
+				index.PartialFilter[field.key] = bson.M{"$exists": true}
+			}
+		}
+	}
+	return indexes
+}
+
+// getAllIndexes returns the indexes and the composite indexes of the metadata
+func (meta metadata) getAllIndexes() []Index {
+	indexes := []Index{}
+	if meta.hasFieldWithIndex() {
+		indexes = append(indexes, meta.getIndexes()...)
+	}
+	if meta.hasFieldWithComposite() {
+		indexes = append(indexes, meta.getComposites()...)
 	}
-	indexes = append(indexes, mgo.Index{Key: keys, Unique: true})
 	return indexes
 }
 
@@ -1000,8 +1418,10 @@ type field struct {
 	composite bool
 	// index is a index
 	index bool
-	// unique is a unique index
-	unique bool
+	// indexOptions are the options of the index
+	indexOptions indexOptions
+	// compositeOptions are the options of each composite index the field belongs to
+	compositeOptions []indexOptions
 	// mongodb document key
 	key string
 	// struct field name
@@ -1053,14 +1473,34 @@ type relation struct {
 
 	// idField is the field that holds the related document id or ids
 	idStorageField string
+
+	// through is the join collection holding the links of a referenceMany relation,
+	// it can be the collection of a registered association document
+	through string
+
+	// joinKey is the key of a link holding the owning document id
+	joinKey string
+
+	// inverseJoinKey is the key of a link holding the related document id
+	inverseJoinKey string
+
+	// sort is the field of the related documents a referenceMany relation is sorted by,
+	// prefixed with a dash (-) if the order is descending
+	sort string
+
+	// limit is the maximum number of related documents of a referenceMany relation
+	limit int
+
+	// storeAs is how references to related documents are stored, either as ObjectIds or DBRefs
+	storeAs storeAs
 }
 
 func (r relation) String() string {
 	if isZero(r) {
 		return "{}"
 	}
-	return fmt.Sprintf("{ relation: '%s', targetDocument: '%s', cascade: '%v', mapped: '%s', mappedField: '%v' ,idField '%v' } ",
-		r.relation, r.targetDocument, r.cascade, r.mapped, r.mappedField, r.idStorageField)
+	return fmt.Sprintf("{ relation: '%s', targetDocument: '%s', cascade: '%v', mapped: '%s', mappedField: '%v' ,idField '%v', through: '%v', sort: '%v', limit: '%v', storeAs: '%v' } ",
+		r.relation, r.targetDocument, r.cascade, r.mapped, r.mappedField, r.idStorageField, r.through, r.sort, r.limit, r.storeAs)
 }
 
 type relationMap int
@@ -1130,8 +1570,23 @@ const (
 	del task = iota
 	insert
 	update
+	restore
 )
 
+func (t task) String() string {
+	switch t {
+	case del:
+		return "remove"
+	case insert:
+		return "insert"
+	case update:
+		return "update"
+	case restore:
+		return "restore"
+	}
+	return ""
+}
+
 type tasks map[interface{}]task
 
 func (t tasks) pop() (interface{}, task) {
@@ -1223,73 +1678,93 @@ func isIterable(value interface{}) bool {
 // getTypeMetadatas takes a pointer to struct and returns the metadata
 // for the struct or an error if the struct tag is invalid.
 func getTypeMetadatas(value interface{}) (meta metadata, err error) {
+	return getTypeMetadatasWithDriver(value, tagDriver{})
+}
+
+// getTypeMetadatasWithDriver reads the metadata of a type from the field mappings of a mapping driver.
+// The problems of every field are returned as MappingErrors.
+func getTypeMetadatasWithDriver(value interface{}, driver mappingDriver) (meta metadata, err error) {
 	Value := reflect.Indirect(reflect.ValueOf(value))
 	Type := Value.Type()
-	// for each field in struct, read its struct tag and
+	errors := MappingErrors{}
+	// for each field in struct, read its mapping and
 	// create a metadata for the field if needed
 	for i := 0; i < Value.NumField(); i++ {
 		Field := Type.Field(i)
-		MetaField := field{name: Field.Name, key: strings.ToLower(Field.Name)}
-		// check bson struct tag and extract the document key
-		Tag := Field.Tag.Get("bson")
-		parts := strings.Split(Tag, ",")
-		if len(parts) > 0 {
-			if key := strings.TrimSpace(parts[0]); key != "" {
-				MetaField.key = key
-				if key == "_id" {
-					meta.idField = Field.Name
-					meta.idKey = "_id"
-				}
-				// ignore the field and continue
-				if key == "-" {
-					MetaField.ignore = true
-					continue
-				}
+		// invalid returns an error on an annotation of the field
+		invalid := func(definition *tag.Definition, parameter string, format string, arguments ...interface{}) {
+			mappingError := &MappingError{Type: Type.String(), Field: Field.Name, Parameter: parameter,
+				Message: fmt.Sprintf(format, arguments...), Err: ErrInvalidAnnotation}
+			// definitions of a mapping file have no column
+			if definition != nil && definition.Column > 0 {
+				mappingError.Tag, mappingError.Column = Field.Tag.Get("odm"), definition.Column
 			}
+			errors = append(errors, mappingError)
 		}
-		if len(parts) > 1 {
-			if part := strings.TrimSpace(parts[1]); part == "omitempty" {
-				MetaField.omitempty = true
-			}
+		mapping, err := driver.mapField(Field)
+		if syntaxError, ok := err.(*tag.SyntaxError); ok {
+			invalid(&tag.Definition{Column: syntaxError.Column}, "", "%s", syntaxError)
+			continue
+		} else if err != nil {
+			return meta, err
 		}
-		Tag = Field.Tag.Get("odm")
-		if Tag == "-" {
-			MetaField.ignore = true
+		// ignore the field and continue
+		if mapping.ignore {
 			continue
 		}
-		parser := tag.NewParser(strings.NewReader(Tag))
-		var definitions []*tag.Definition
-		definitions, err = parser.Parse()
-		if err != nil {
-			return meta, err
+		MetaField := field{name: Field.Name, key: mapping.key, omitempty: mapping.omitempty}
+		if mapping.key == "_id" {
+			meta.idField = Field.Name
+			meta.idKey = "_id"
 		}
-		for _, definition := range definitions {
+		for _, definition := range mapping.definitions {
 			switch strings.ToLower(definition.Name) {
 
 			case "id":
 				meta.idField = Field.Name
 			case "omitempty":
 				MetaField.omitempty = true
+			case "softdelete":
+				if Field.Type != timeType && Field.Type != reflect.PtrTo(timeType) {
+					invalid(definition, "", "a softDelete field must be a time.Time or a *time.Time, got %s", Field.Type)
+				} else if meta.softDelete != "" {
+					invalid(definition, "", "%s already is the softDelete field", meta.softDelete)
+				}
+				for _, parameter := range definition.Parameters {
+					invalid(definition, parameter.Key, "unknown parameter '%s' of %s", parameter.Key, definition.Name)
+				}
+				meta.softDelete = Field.Name
 			case "index":
 				MetaField.index = true
-				for _, parameter := range definition.Parameters {
-					switch toLower(parameter.Key) {
-					case "unique":
-						MetaField.unique = true
-					}
+				options, parameter, err := parseIndexOptions(definition, false)
+				if err != nil {
+					invalid(definition, parameter, "%s", err)
 				}
+				MetaField.indexOptions = options
 			case "composite":
 				MetaField.composite = true
+				options, parameter, err := parseIndexOptions(definition, true)
+				if err != nil {
+					invalid(definition, parameter, "%s", err)
+				}
+				MetaField.compositeOptions = append(MetaField.compositeOptions, options)
 			case "referencemany", "referenceone":
 				Relation := relation{}
 				switch strings.ToLower(definition.Name) {
 				case "referencemany":
 					Relation.relation = referenceMany
 					MetaField.key = "odm:" + strings.ToLower(Field.Name) + "ids"
+					if Field.Type.Kind() != reflect.Slice {
+						invalid(definition, "", "a referenceMany field must be a slice, got %s", Field.Type)
+					}
 				case "referenceone":
 					Relation.relation = referenceOne
 					MetaField.key = "odm:" + strings.ToLower(Field.Name) + "id"
+					if Field.Type.Kind() != reflect.Ptr || Field.Type.Elem().Kind() != reflect.Struct {
+						invalid(definition, "", "a referenceOne field must be a pointer to struct, got %s", Field.Type)
+					}
 				}
+				descending := false
 				for _, parameter := range definition.Parameters {
 					switch strings.ToLower(parameter.Key) {
 					case "mappedby":
@@ -1308,22 +1783,65 @@ func getTypeMetadatas(value interface{}) (meta metadata, err error) {
 							Relation.cascade = remove
 						case "all":
 							Relation.cascade = all
+						default:
+							invalid(definition, parameter.Key, "cascade must be persist, remove or all, got '%s'", parameter.Value)
 						}
 					case "storeid":
 						Relation.idStorageField = parameter.Value
+					case "through":
+						Relation.through = parameter.Value
+					case "joinkey":
+						Relation.joinKey = parameter.Value
+					case "inversejoinkey":
+						Relation.inverseJoinKey = parameter.Value
+					case "sort":
+						Relation.sort = parameter.Value
+					case "order":
+						switch strings.ToLower(parameter.Value) {
+						case "desc":
+							descending = true
+						case "asc":
+						default:
+							invalid(definition, parameter.Key, "order must be asc or desc, got '%s'", parameter.Value)
+						}
+					case "storeas":
+						switch strings.ToLower(parameter.Value) {
+						case "id":
+							Relation.storeAs = storeAsID
+						case "dbref":
+							Relation.storeAs = storeAsDBRef
+						case "dbrefwithdb":
+							Relation.storeAs = storeAsDBRefWithDB
+						default:
+							invalid(definition, parameter.Key, "storeAs must be id, dbRef or dbRefWithDB, got '%s'", parameter.Value)
+						}
+					case "limit":
+						var err error
+						if Relation.limit, err = strconv.Atoi(parameter.Value); err != nil {
+							invalid(definition, parameter.Key, "limit must be an integer, got '%s'", parameter.Value)
+						}
 					case "load":
 						switch strings.ToLower(parameter.Value) {
 						case "eager":
 							Relation.load = eager
-
+						case "lazy":
+							Relation.load = lazy
+						default:
+							invalid(definition, parameter.Key, "load must be eager or lazy, got '%s'", parameter.Value)
 						}
 					default:
-						return meta, ErrInvalidAnnotation
+						invalid(definition, parameter.Key, "unknown parameter '%s' of %s", parameter.Key, definition.Name)
 					}
-					MetaField.relation = Relation
 				}
+				if Relation.targetDocument == "" {
+					invalid(definition, "targetDocument", "%s without targetDocument", definition.Name)
+				}
+				if descending && Relation.sort != "" {
+					Relation.sort = "-" + Relation.sort
+				}
+				MetaField.relation = Relation
 			default:
-				return meta, ErrInvalidAnnotation
+				invalid(definition, "", "unknown annotation '%s'", definition.Name)
 			}
 		}
 		// remove index definition if field has a relation
@@ -1340,14 +1858,12 @@ func getTypeMetadatas(value interface{}) (meta metadata, err error) {
 		}
 		meta.fields = append(meta.fields, MetaField)
 	}
+	if len(errors) > 0 {
+		return meta, errors
+	}
 	return
 }
 
-// toLower is a shortcurt to strings.ToLower method
-func toLower(s string) string {
-	return strings.ToLower(s)
-}
-
 // resolveKeyForField either returns lowercase version of the name if the field
 // was found or the key found in a bson struct tag or "" if the field wasn't found
 func resolveKeyForField(Struct reflect.Type, name string) string {
@@ -1367,6 +1883,9 @@ func metadataToString(meta metadata) string {
 	result := "metadata : {"
 	result += "collectionName: '" + meta.targetDocument + "', "
 	result += "idField: '" + meta.idField + "' "
+	if meta.collectionOptions != nil {
+		result += "collectionOptions: " + meta.collectionOptions.String() + " "
+	}
 	result += "fields :[\n"
 	for i, field := range meta.fields {
 		if i > 0 {
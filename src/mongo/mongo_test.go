@@ -15,10 +15,14 @@
 package mongo_test
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -94,6 +98,11 @@ func Example() {
 		log.Println("error registering types", err)
 		return
 	}
+	// create the indexes once at startup
+	if err = documentManager.GetSchemaManager().EnsureIndexes(); err != nil {
+		log.Println("error creating indexes", err)
+		return
+	}
 	// create some documents
 	author := &Author{Name: "John Doe"}
 	programmingTag := &Tag{Name: "programming"}
@@ -410,7 +419,90 @@ func TestDocumentManager_Register_InvalidAnnotation(t *testing.T) {
 	}
 	dm := mongo.NewDocumentManager(nil)
 	err := dm.Register("City", new(City))
-	test.Fatal(t, err, mongo.ErrInvalidAnnotation)
+	test.Fatal(t, errors.Is(err, mongo.ErrInvalidAnnotation), true)
+}
+
+func TestDocumentManager_Register_StoreIdKey(t *testing.T) {
+	// storeId may name a document key which isn't a struct field
+	type Person struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	type Club struct {
+		ID      bson.ObjectId `bson:"_id"`
+		Members []*Person     `odm:"referenceMany(targetDocument:Person,storeId:member_ids)"`
+	}
+	dm := mongo.NewDocumentManager(nil)
+	err := dm.RegisterMany(map[string]interface{}{
+		"Person": new(Person),
+		"Club":   new(Club),
+	})
+	test.Fatal(t, err, nil)
+}
+
+func TestDocumentManager_Register_MappingErrors(t *testing.T) {
+	type Road struct {
+		ID      bson.ObjectId `bson:"_id"`
+		Name    string        `odm:"index(expireAfter:soon)"`
+		Cities  []*struct{}   `odm:"referenceMany(targetDocument:City,cascade:everything)"`
+		Country *struct{}     `odm:"referenceOne(load:eager);omitempty(x"`
+	}
+	dm := mongo.NewDocumentManager(nil)
+	err := dm.Register("Road", new(Road))
+	mappingErrors, ok := err.(mongo.MappingErrors)
+	test.Fatal(t, ok, true)
+	test.Fatal(t, len(mappingErrors), 3, fmt.Sprint(err))
+	mappingError := mappingErrors[0].(*mongo.MappingError)
+	test.Fatal(t, mappingError.Field, "Name")
+	test.Fatal(t, mappingError.Parameter, "expireAfter")
+	test.Fatal(t, mappingError.Column, 1)
+	mappingError = mappingErrors[1].(*mongo.MappingError)
+	test.Fatal(t, mappingError.Field, "Cities")
+	test.Fatal(t, mappingError.Parameter, "cascade")
+	test.Fatal(t, mappingError.Error(), "mongo_test.Road.Cities : cascade must be persist, remove or all, got 'everything' (tag `referenceMany(targetDocument:City,cascade:everything)` at column 1)")
+	mappingError = mappingErrors[2].(*mongo.MappingError)
+	test.Fatal(t, mappingError.Field, "Country")
+	test.Fatal(t, errors.Is(err, mongo.ErrInvalidAnnotation), true)
+}
+
+func TestDocumentManager_Register_UnknownIndexParameter(t *testing.T) {
+	type Lake struct {
+		ID    bson.ObjectId `bson:"_id"`
+		Name  string        `odm:"index(uniqe:true)"`
+		Depth int           `odm:"composite(name:x);composite(name:y,sprase:true)"`
+	}
+	err := mongo.NewDocumentManager(nil).Register("Lake", new(Lake))
+	mappingErrors, ok := err.(mongo.MappingErrors)
+	test.Fatal(t, ok, true, fmt.Sprint(err))
+	test.Fatal(t, len(mappingErrors), 2, fmt.Sprint(err))
+	mappingError := mappingErrors[0].(*mongo.MappingError)
+	test.Fatal(t, mappingError.Field, "Name")
+	test.Fatal(t, mappingError.Parameter, "uniqe")
+	test.Fatal(t, mappingError.Column, 1)
+	test.Fatal(t, strings.Contains(mappingError.Error(), "unknown parameter 'uniqe' of index"), true, mappingError.Error())
+	mappingError = mappingErrors[1].(*mongo.MappingError)
+	test.Fatal(t, mappingError.Field, "Depth")
+	test.Fatal(t, mappingError.Parameter, "sprase")
+	test.Fatal(t, mappingError.Column, 19)
+}
+
+func TestDocumentManager_Validate(t *testing.T) {
+	type Street struct {
+		ID   bson.ObjectId `bson:"_id"`
+		Name string
+	}
+	type Town struct {
+		ID      bson.ObjectId `bson:"_id"`
+		Streets []*Street     `odm:"referenceMany(targetDocument:Street,sort:Number)"`
+		Mayor   *struct{}     `odm:"referenceOne(targetDocument:Mayor)"`
+	}
+	dm := mongo.NewDocumentManager(nil)
+	test.Fatal(t, dm.RegisterMany(map[string]interface{}{"Street": new(Street), "Town": new(Town)}), nil)
+	err := dm.Validate()
+	mappingErrors, ok := err.(mongo.MappingErrors)
+	test.Fatal(t, ok, true)
+	test.Fatal(t, len(mappingErrors), 2, fmt.Sprint(err))
+	test.Fatal(t, mappingErrors[0].(*mongo.MappingError).Parameter, "sort")
+	test.Fatal(t, errors.Is(mappingErrors[1], mongo.ErrDocumentNotRegistered), true)
 }
 
 func TestDocumentManager_Register_IndexAnnotation(t *testing.T) {
@@ -423,6 +515,7 @@ func TestDocumentManager_Register_IndexAnnotation(t *testing.T) {
 	defer done()
 	err := dm.Register("Country", new(Country))
 	test.Fatal(t, err, nil)
+	test.Fatal(t, dm.GetSchemaManager().EnsureIndexes(), nil)
 	country := &Country{Name: "Sweden"}
 	dm.Persist(country)
 	err = dm.Flush()
@@ -434,7 +527,307 @@ func TestDocumentManager_Register_IndexAnnotation(t *testing.T) {
 	country3 := &Country{Name: "Sweden"}
 	dm.Persist(country3)
 	err = dm.Flush()
-	test.Fatal(t, mgo.IsDup(err), true, "Error should be a duplicate key error ")
+	test.Fatal(t, isDuplicateKeyError(err), true, "Error should be a duplicate key error ")
+}
+
+func TestDocumentManager_Register_RichIndexAnnotation(t *testing.T) {
+	type Event struct {
+		ID        bson.ObjectId `bson:"_id"`
+		Title     string        `bson:"Title" odm:"index(type:text,name:title)"`
+		Email     string        `bson:"Email,omitempty" odm:"index(unique:true,partialFilter:exists)"`
+		CreatedAt time.Time     `bson:"CreatedAt" odm:"index(expireAfter:3600)"`
+		Owner     string        `bson:"Owner" odm:"composite(name:byOwner,unique:false);composite(name:bySlug)"`
+		Date      time.Time     `bson:"Date" odm:"composite(name:byOwner,order:desc)"`
+		Slug      string        `bson:"Slug" odm:"composite(name:bySlug)"`
+	}
+	dm, done := getDocumentManager(t)
+	defer done()
+	err := dm.Register("Event", new(Event))
+	test.Fatal(t, err, nil)
+	err = dm.GetSchemaManager().EnsureIndexes()
+	test.Fatal(t, err, nil)
+	indexes, err := dm.GetDB().C("Event").Indexes()
+	test.Fatal(t, err, nil)
+	byName := map[string]mgo.Index{}
+	for _, index := range indexes {
+		byName[index.Name] = index
+	}
+	test.Fatal(t, len(indexes), 6)
+	test.Fatal(t, reflect.DeepEqual(byName["byOwner"].Key, []string{"Owner", "-Date"}), true)
+	test.Fatal(t, byName["byOwner"].Unique, false)
+	test.Fatal(t, byName["bySlug"].Unique, true)
+	test.Fatal(t, byName["CreatedAt_1"].ExpireAfter, time.Hour)
+	// documents without an email are not indexed
+	for _, event := range []*Event{{Title: "Go meetup", Slug: "go"}, {Title: "Rust meetup", Slug: "rust"}} {
+		dm.Persist(event)
+	}
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	diffs, err := dm.GetSchemaManager().DiffIndexes()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, diffs[0].IsEmpty(), true, diffs[0].String())
+}
+
+func TestDocumentManager_RegisterWithOptions(t *testing.T) {
+	type LogEntry struct {
+		ID      bson.ObjectId `bson:"_id"`
+		Message string        `bson:"Message"`
+	}
+	dm, done := getDocumentManager(t)
+	defer done()
+	mode := mgo.Primary
+	err := dm.RegisterWithOptions("LogEntry", new(LogEntry), &mongo.CollectionOptions{
+		Capped: true, MaxBytes: 4096, MaxDocs: 2,
+		Collation:    &mgo.Collation{Locale: "en", Strength: 2},
+		Validator:    bson.M{"Message": bson.M{"$type": "string"}},
+		ReadMode:     &mode,
+		WriteConcern: &mgo.Safe{WMode: "majority"},
+	})
+	test.Fatal(t, err, nil)
+	err = dm.GetSchemaManager().CreateCollections()
+	test.Fatal(t, err, nil)
+	for _, message := range []string{"first", "second", "third"} {
+		dm.Persist(&LogEntry{Message: message})
+	}
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	// a capped collection keeps the last MaxDocs documents
+	entries := []*LogEntry{}
+	err = dm.FindAll(&entries)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(entries), 2)
+	// the default collation is case insensitive
+	entry := new(LogEntry)
+	err = dm.FindOne(bson.M{"Message": "THIRD"}, entry)
+	test.Fatal(t, err, nil)
+	// existing collections are left untouched
+	err = dm.GetSchemaManager().CreateCollections()
+	test.Fatal(t, err, nil)
+}
+
+func TestDocumentManager_GetSchemaManager_JSONSchema(t *testing.T) {
+	type Address struct {
+		City string `bson:"City"`
+		Zip  string `bson:"Zip,omitempty"`
+	}
+	type Employee struct {
+		ID        bson.ObjectId `bson:"_id"`
+		Name      string        `bson:"Name"`
+		Age       int           `bson:"Age,omitempty"`
+		Address   Address       `bson:"Address"`
+		Tags      []string      `bson:"Tags"`
+		Manager   *Employee     `odm:"referenceOne(targetDocument:Employee)"`
+		Reports   []*Employee   `odm:"referenceMany(targetDocument:Employee,storeAs:dbRef)"`
+		Temporary string        `bson:"-"`
+	}
+	dm := mongo.NewDocumentManager(nil)
+	err := dm.Register("Employee", new(Employee))
+	test.Fatal(t, err, nil)
+	schema, err := dm.GetSchemaManager().JSONSchema(new(Employee))
+	test.Fatal(t, err, nil)
+	test.Fatal(t, reflect.DeepEqual(schema["required"], []string{"Address", "Name", "Tags", "_id"}), true)
+	properties := schema["properties"].(bson.M)
+	test.Fatal(t, len(properties), 7)
+	test.Fatal(t, properties["_id"].(bson.M)["bsonType"], "objectId")
+	test.Fatal(t, reflect.DeepEqual(properties["Age"], bson.M{"bsonType": []string{"int", "long"}}), true)
+	test.Fatal(t, reflect.DeepEqual(properties["Tags"], bson.M{"bsonType": []string{"array", "null"}, "items": bson.M{"bsonType": "string"}}), true)
+	test.Fatal(t, reflect.DeepEqual(properties["Address"].(bson.M)["required"], []string{"City"}), true)
+	test.Fatal(t, properties["odm:managerid"].(bson.M)["bsonType"], "objectId")
+	test.Fatal(t, properties["odm:reportsids"].(bson.M)["bsonType"], "array")
+}
+
+func TestDocumentManager_GetMigrator(t *testing.T) {
+	type Product struct {
+		ID    bson.ObjectId `bson:"_id"`
+		Title string        `bson:"Title"`
+		Price int           `bson:"Price"`
+	}
+	dm, done := getDocumentManager(t)
+	defer done()
+	err := dm.Register("Product", new(Product))
+	test.Fatal(t, err, nil)
+	// products saved before the Name key was renamed Title
+	err = dm.GetDB().C("Product").Insert(bson.M{"_id": bson.NewObjectId(), "Name": "Pen", "Price": 1})
+	test.Fatal(t, err, nil)
+	migrator := dm.GetMigrator()
+	err = migrator.Register(mongo.Migration{
+		ID: "20161001_rename_name", Description: "rename Name to Title",
+		Up: func(ctx context.Context, migrator mongo.Migrator) error {
+			return migrator.RenameKey(ctx, new(Product), "Name", "Title")
+		},
+	}, mongo.Migration{
+		ID: "20161002_double_prices", Description: "prices in cents",
+		Up: func(ctx context.Context, migrator mongo.Migrator) error {
+			return migrator.TransformDocuments(ctx, new(Product), func(document interface{}) error {
+				document.(*Product).Price *= 100
+				return nil
+			})
+		},
+		Down: func(ctx context.Context, migrator mongo.Migrator) error {
+			return migrator.TransformDocuments(ctx, new(Product), func(document interface{}) error {
+				document.(*Product).Price /= 100
+				return nil
+			})
+		},
+	})
+	test.Fatal(t, err, nil)
+	ids, err := migrator.Up(context.Background())
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(ids), 2)
+	product := new(Product)
+	err = dm.FindOne(bson.M{"Title": "Pen"}, product)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, product.Price, 100)
+	// applied migrations are not applied again
+	ids, err = migrator.Up(context.Background())
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(ids), 0)
+	ids, err = migrator.Down(context.Background(), 1)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, ids[0], "20161002_double_prices")
+	statuses, err := migrator.Status(context.Background())
+	test.Fatal(t, err, nil)
+	test.Fatal(t, statuses[0].Applied, true)
+	test.Fatal(t, statuses[1].Applied, false)
+	// the first migration can't be rolled back
+	_, err = migrator.Down(context.Background(), 1)
+	test.Fatal(t, err, mongo.ErrIrreversibleMigration)
+}
+
+func TestDocumentManager_RegisterMapping(t *testing.T) {
+	// types without odm struct tags
+	type Tag struct {
+		ID   bson.ObjectId `bson:"_id"`
+		Name string
+	}
+	type Post struct {
+		ID    bson.ObjectId `bson:"_id"`
+		Title string
+		Tags  []*Tag
+	}
+	mappings, err := mongo.ReadMappings(strings.NewReader(`
+Post:
+  collection: Post
+  fields:
+    Title:
+      index: { unique: true }
+    Tags:
+      referenceMany: { targetDocument: Tag, cascade: all, sort: Name }
+Tag:
+  collection: Tag
+`), "yaml")
+	test.Fatal(t, err, nil)
+	dm := mongo.NewDocumentManager(nil)
+	err = dm.RegisterMapping(new(Post), mappings["Post"])
+	test.Fatal(t, err, nil)
+	err = dm.RegisterMapping(new(Tag), mappings["Tag"])
+	test.Fatal(t, err, nil)
+	// the same types mapped with struct tags
+	type TaggedTag struct {
+		ID   bson.ObjectId `bson:"_id"`
+		Name string
+	}
+	type TaggedPost struct {
+		ID    bson.ObjectId `bson:"_id"`
+		Title string        `odm:"index(unique:true)"`
+		Tags  []*TaggedTag  `odm:"referenceMany(targetDocument:Tag,cascade:all,sort:Name)"`
+	}
+	tagged := mongo.NewDocumentManager(nil)
+	err = tagged.RegisterMany(map[string]interface{}{"Post": new(TaggedPost), "Tag": new(TaggedTag)})
+	test.Fatal(t, err, nil)
+	descriptions, taggedDescriptions := dm.GetSchemaManager().DescribeDocuments(), tagged.GetSchemaManager().DescribeDocuments()
+	test.Fatal(t, len(descriptions), 2)
+	for i := range descriptions {
+		test.Fatal(t, reflect.DeepEqual(descriptions[i].Fields[1:2], taggedDescriptions[i].Fields[1:2]), true)
+		test.Fatal(t, reflect.DeepEqual(descriptions[i].Indexes, taggedDescriptions[i].Indexes), true)
+	}
+	test.Fatal(t, descriptions[0].Fields[2].Relation, taggedDescriptions[0].Fields[2].Relation)
+	// mapped fields are cross checked with the go type
+	err = dm.RegisterMapping(new(Post), mongo.Mapping{Collection: "Post", Fields: map[string]mongo.FieldMapping{
+		"Body":  {},
+		"Title": {Key: "title_key"},
+	}})
+	test.Fatal(t, err != nil, true)
+	test.Fatal(t, strings.Contains(err.Error(), "field Body not found"), true, err.Error())
+	test.Fatal(t, strings.Contains(err.Error(), "key title_key of field Title"), true, err.Error())
+}
+
+func TestDocumentManager_Map(t *testing.T) {
+	type Writer struct {
+		ID   bson.ObjectId `bson:"_id"`
+		Name string
+	}
+	type Novel struct {
+		ID        bson.ObjectId `bson:"_id"`
+		Title     string
+		Published time.Time
+		Writer    *Writer
+		Draft     string
+	}
+	dm := mongo.NewDocumentManager(nil)
+	err := dm.Map(new(Writer)).Collection("writers").Register()
+	test.Fatal(t, err, nil)
+	err = dm.Map(new(Novel)).Collection("novels").
+		Field("Title").Index().Unique().
+		Field("Published").Composite("byDate").Descending().
+		Field("Draft").Ignore().
+		ReferenceOne("Writer", "writers").Cascade(mongo.All).
+		Register()
+	test.Fatal(t, err, nil)
+	descriptions := dm.GetSchemaManager().DescribeDocuments()
+	test.Fatal(t, len(descriptions), 2)
+	novel := descriptions[0]
+	test.Fatal(t, novel.Collection, "novels")
+	// Draft is ignored
+	test.Fatal(t, len(novel.Fields), 4)
+	test.Fatal(t, strings.Contains(novel.Fields[3].Relation, "targetDocument: 'writers'"), true, novel.Fields[3].Relation)
+	test.Fatal(t, reflect.DeepEqual(novel.Indexes, []string{"[title] unique", "[-published] name:byDate,unique"}), true, fmt.Sprint(novel.Indexes))
+	// mappings are checked against the go type
+	err = dm.Map(new(Novel)).ReferenceMany("Title", "writers").Register()
+	test.Fatal(t, strings.Contains(fmt.Sprint(err), "referenceMany field Title is not a slice"), true, fmt.Sprint(err))
+}
+
+func TestDocumentManager_GetSchemaManager(t *testing.T) {
+	type Country struct {
+		ID   bson.ObjectId `bson:"_id"`
+		Name string        `bson:"Name" odm:"index(unique:true)"`
+		Code string        `bson:"Code"`
+	}
+	dm, done := getDocumentManager(t)
+	defer done()
+	err := dm.Register("Country", new(Country))
+	test.Fatal(t, err, nil)
+	schemaManager := dm.GetSchemaManager()
+	err = schemaManager.EnsureIndexes()
+	test.Fatal(t, err, nil)
+	diffs, err := schemaManager.DiffIndexes()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(diffs), 1)
+	test.Fatal(t, diffs[0].IsEmpty(), true)
+	// an index that is not defined in the metadata
+	err = dm.GetDB().C("Country").EnsureIndexKey("Code")
+	test.Fatal(t, err, nil)
+	diffs, err = schemaManager.DiffIndexes()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(diffs[0].Extra), 1)
+	err = schemaManager.SyncIndexes(false)
+	test.Fatal(t, err, nil)
+	indexes, err := dm.GetDB().C("Country").Indexes()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(indexes), 3)
+	err = schemaManager.SyncIndexes(true)
+	test.Fatal(t, err, nil)
+	indexes, err = dm.GetDB().C("Country").Indexes()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(indexes), 2)
+	// a dropped index is created again
+	err = dm.GetDB().C("Country").DropIndex("Name")
+	test.Fatal(t, err, nil)
+	err = schemaManager.EnsureIndexes()
+	test.Fatal(t, err, nil)
+	indexes, err = dm.GetDB().C("Country").Indexes()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(indexes), 2)
 }
 
 func TestDocumentManager_FindAll_MappedBy(t *testing.T) {
@@ -473,6 +866,267 @@ func TestDocumentManager_FindAll_MappedBy(t *testing.T) {
 	test.Fatal(t, len(projects[0].Employee.Projects), 2)
 }
 
+type Member struct {
+	ID     bson.ObjectId `bson:"_id,omitempty"`
+	Name   string        `bson:"Name"`
+	Groups []*Group      `odm:"referenceMany(targetDocument:Group,through:Membership,cascade:persist)"`
+}
+
+type Group struct {
+	ID      bson.ObjectId `bson:"_id,omitempty"`
+	Name    string        `bson:"Name"`
+	Members []*Member     `odm:"referenceMany(targetDocument:Member,mappedBy:Groups)"`
+}
+
+type Membership struct {
+	ID       bson.ObjectId `bson:"_id,omitempty"`
+	Member   *Member       `odm:"referenceOne(targetDocument:Member)"`
+	Group    *Group        `odm:"referenceOne(targetDocument:Group)"`
+	JoinedAt time.Time     `bson:"JoinedAt"`
+}
+
+func TestDocumentManager_Register_ThroughAnnotation(t *testing.T) {
+	dm, done := getDocumentManager(t)
+	defer done()
+	err := dm.RegisterMany(map[string]interface{}{
+		"Member":     new(Member),
+		"Group":      new(Group),
+		"Membership": new(Membership),
+	})
+	test.Fatal(t, err, nil)
+	admins, editors := &Group{Name: "admins"}, &Group{Name: "editors"}
+	john := &Member{Name: "John"}
+	jane := &Member{Name: "Jane"}
+	dm.Persist(admins)
+	dm.Persist(editors)
+	dm.Persist(john)
+	dm.Persist(jane)
+	// the links of a registered association document are its documents
+	joinedAt := time.Now().UTC().Truncate(time.Millisecond)
+	dm.Persist(&Membership{Member: john, Group: admins, JoinedAt: joinedAt})
+	dm.Persist(&Membership{Member: john, Group: editors, JoinedAt: joinedAt})
+	dm.Persist(&Membership{Member: jane, Group: editors, JoinedAt: joinedAt})
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	// the links are stored in the join collection, not on the owning document
+	count, err := dm.GetDB().C("Membership").Count()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 3)
+	member := new(Member)
+	err = dm.FindID(john.ID, member)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(member.Groups), 2)
+	group := new(Group)
+	err = dm.FindID(editors.ID, group)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(group.Members), 2)
+	// association documents can carry extra attributes
+	memberships := []*Membership{}
+	err = dm.FindBy(bson.M{"odm:memberid": jane.ID}, &memberships)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(memberships), 1)
+	test.Fatal(t, memberships[0].Group.Name, "editors")
+	test.Fatal(t, memberships[0].JoinedAt.Equal(joinedAt), true)
+	// persisting the owning document doesn't change its links
+	member.Groups = member.Groups[:1]
+	dm.Persist(member)
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	count, err = dm.GetDB().C("Membership").Count()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 3)
+	// removing an association document removes the link
+	dm.Remove(memberships[0])
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	count, err = dm.GetDB().C("Membership").Count()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 2)
+	// removing the owning document removes its links
+	dm.Remove(john)
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	count, err = dm.GetDB().C("Membership").Count()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 0)
+}
+
+type Customer struct {
+	ID     bson.ObjectId `bson:"_id,omitempty"`
+	Name   string        `bson:"Name"`
+	Orders []*Order      `odm:"referenceMany(targetDocument:Order,mappedBy:Customer,sort:Created,order:desc,limit:2)"`
+}
+
+type Order struct {
+	ID       bson.ObjectId `bson:"_id,omitempty"`
+	Created  time.Time     `bson:"Created"`
+	Customer *Customer     `odm:"referenceOne(targetDocument:Customer)"`
+	Items    []*Item       `odm:"referenceMany(targetDocument:Item,cascade:all)"`
+}
+
+type Item struct {
+	ID   bson.ObjectId `bson:"_id,omitempty"`
+	Name string        `bson:"Name"`
+}
+
+func TestDocumentManager_Register_SortAndLimitAnnotation(t *testing.T) {
+	dm, done := getDocumentManager(t)
+	defer done()
+	err := dm.RegisterMany(map[string]interface{}{
+		"Customer": new(Customer),
+		"Order":    new(Order),
+		"Item":     new(Item),
+	})
+	test.Fatal(t, err, nil)
+	customer := &Customer{Name: "John"}
+	dm.Persist(customer)
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		dm.Persist(&Order{Customer: customer, Created: now.Add(time.Duration(i) * time.Hour),
+			Items: []*Item{{Name: "c"}, {Name: "a"}, {Name: "b"}}})
+	}
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	customer = new(Customer)
+	err = dm.FindOne(bson.M{"Name": "John"}, customer)
+	test.Fatal(t, err, nil)
+	// the 2 latest orders
+	test.Fatal(t, len(customer.Orders), 2)
+	test.Fatal(t, customer.Orders[0].Created.After(customer.Orders[1].Created), true)
+	// owning side arrays preserve the stored order
+	order := new(Order)
+	err = dm.FindID(customer.Orders[0].ID, order)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(order.Items), 3)
+	test.Fatal(t, order.Items[0].Name, "c")
+	// the query builder overrides the annotation
+	order = new(Order)
+	err = dm.CreateQuery().Find(bson.M{"_id": customer.Orders[0].ID}).SortRelation("Items", "Name").LimitRelation("Items", 2).One(order)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(order.Items), 2)
+	test.Fatal(t, order.Items[0].Name, "a")
+	customer = new(Customer)
+	err = dm.CreateQuery().Find(bson.M{"Name": "John"}).LimitRelation("Orders", -1).One(customer)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(customer.Orders), 3)
+}
+
+func TestDocumentManager_Register_StoreAsAnnotation(t *testing.T) {
+	type Writer struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string        `bson:"Name"`
+	}
+	type Book struct {
+		ID        bson.ObjectId `bson:"_id,omitempty"`
+		Title     string        `bson:"Title"`
+		Writer    *Writer       `odm:"referenceOne(targetDocument:Writer,storeAs:dbRefWithDB,cascade:all)"`
+		CoWriters []*Writer     `odm:"referenceMany(targetDocument:Writer,storeAs:dbRef,cascade:all)"`
+	}
+	dm, done := getDocumentManager(t)
+	defer done()
+	err := dm.RegisterMany(map[string]interface{}{
+		"Writer": new(Writer),
+		"Book":   new(Book),
+	})
+	test.Fatal(t, err, nil)
+	book := &Book{Title: "Go", Writer: &Writer{Name: "John"}, CoWriters: []*Writer{{Name: "Jane"}, {Name: "Jack"}}}
+	dm.Persist(book)
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	// references are self-describing
+	raw := struct {
+		Writer    mgo.DBRef   `bson:"odm:writerid"`
+		CoWriters []mgo.DBRef `bson:"odm:cowritersids"`
+	}{}
+	err = dm.GetDB().C("Book").FindId(book.ID).One(&raw)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, raw.Writer.Collection, "Writer")
+	test.Fatal(t, raw.Writer.Id, interface{}(book.Writer.ID))
+	test.Fatal(t, raw.Writer.Database, dm.GetDB().Name)
+	test.Fatal(t, len(raw.CoWriters), 2)
+	test.Fatal(t, raw.CoWriters[0].Database, "")
+	book = new(Book)
+	err = dm.FindOne(bson.M{"Title": "Go"}, book)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, book.Writer.Name, "John")
+	test.Fatal(t, len(book.CoWriters), 2)
+	test.Fatal(t, book.CoWriters[1].Name, "Jack")
+}
+
+func TestDocumentManager_CheckIntegrity(t *testing.T) {
+	dm, done := getDocumentManager(t)
+	defer done()
+	err := dm.RegisterMany(map[string]interface{}{
+		"Post": new(Post),
+		"Role": new(Role),
+		"User": new(User),
+	})
+	test.Fatal(t, err, nil)
+	user := &User{Name: "John", Posts: []*Post{{Title: "First"}, {Title: "Second"}}, Role: &Role{Title: "Editor"}}
+	dm.Persist(user)
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	// remove related documents without cascading
+	err = dm.GetDB().C("Post").RemoveId(user.Posts[0].ID)
+	test.Fatal(t, err, nil)
+	err = dm.GetDB().C("Role").RemoveId(user.Role.ID)
+	test.Fatal(t, err, nil)
+	report, err := dm.CheckIntegrity(context.Background(), new(User))
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(report.DanglingReferences), 2)
+	test.Fatal(t, len(report.MappingErrors), 0)
+	err = dm.RepairIntegrity(context.Background(), report)
+	test.Fatal(t, err, nil)
+	report, err = dm.CheckIntegrity(context.Background(), new(User))
+	test.Fatal(t, err, nil)
+	test.Fatal(t, report.HasProblems(), false)
+	result := new(User)
+	err = dm.FindID(user.ID, result)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(result.Posts), 1)
+	test.Fatal(t, result.Role == nil, true)
+}
+
+func TestDocumentManager_CreateQuery_Where(t *testing.T) {
+	dm, done := getDocumentManager(t)
+	defer done()
+	err := dm.RegisterMany(map[string]interface{}{
+		"Client":   new(Client),
+		"Employee": new(Employee),
+		"Project":  new(Project),
+	})
+	test.Fatal(t, err, nil)
+	john, jane := &Employee{Name: "John"}, &Employee{Name: "Jane"}
+	project1 := &Project{Title: "First project", Employee: john}
+	project2 := &Project{Title: "Second project", Employee: jane}
+	client := &Client{Name: "Example", Projects: []*Project{project1}}
+	for _, document := range []interface{}{john, jane, project1, project2, client} {
+		dm.Persist(document)
+	}
+	err = dm.Flush()
+	test.Fatal(t, err, nil)
+	// owning side
+	projects := []*Project{}
+	err = dm.CreateQuery().Where("Employee.Name").Eq("Jane").All(&projects)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(projects), 1)
+	test.Fatal(t, projects[0].Title, "Second project")
+	// inverse side
+	employees := []*Employee{}
+	err = dm.CreateQuery().Where("Projects.Title").Eq("First project").All(&employees)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(employees), 1)
+	test.Fatal(t, employees[0].Name, "John")
+	// through 2 relations and combined with Find
+	clients := []*Client{}
+	err = dm.CreateQuery().Find(bson.M{"Name": "Example"}).Where("Projects.Employee.Name").In("John", "Jack").All(&clients)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(clients), 1)
+	count, err := dm.CreateQuery().Where("Projects.Employee.Name").Eq("Jane").Count("Client")
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 0)
+}
+
 func cleanUp(db *mgo.Database) {
 	for _, collection := range []string{"Article", "Tag", "Author"} {
 		db.C(collection).DropCollection()
@@ -558,3 +1212,1001 @@ func TestMain(m *testing.M) {
 	verbose = args.Verbose
 	m.Run()
 }
+
+func TestDocumentManager_GetMetadataFor(t *testing.T) {
+	type Writer struct {
+		ID   bson.ObjectId `bson:"_id"`
+		Name string        `bson:"name" odm:"index(unique:true)"`
+	}
+	type Book struct {
+		ID      bson.ObjectId `bson:"_id"`
+		Title   string        `bson:"title,omitempty"`
+		Writers []*Writer     `odm:"referenceMany(targetDocument:Writer,cascade:all,load:eager,sort:Name,order:desc)"`
+	}
+	dm := mongo.NewDocumentManager(nil)
+	test.Fatal(t, dm.RegisterMany(map[string]interface{}{"Writer": new(Writer), "Book": new(Book)}), nil)
+	test.Fatal(t, len(dm.AllMetadata()), 2)
+	test.Fatal(t, dm.AllMetadata()[0].Collection(), "Book")
+	_, err := dm.GetMetadataFor("Publisher")
+	test.Fatal(t, err, mongo.ErrDocumentNotRegistered)
+	classMetadata, err := dm.GetMetadataFor(Book{})
+	test.Fatal(t, err, nil)
+	test.Fatal(t, classMetadata.Type(), reflect.TypeOf(new(Book)))
+	test.Fatal(t, classMetadata.IDField(), "ID")
+	test.Fatal(t, classMetadata.IDKey(), "_id")
+	title, ok := classMetadata.Field("Title")
+	test.Fatal(t, ok, true)
+	test.Fatal(t, title.Key, "title")
+	test.Fatal(t, title.Omitempty, true)
+	test.Fatal(t, title.Type, reflect.TypeOf(""))
+	relations := classMetadata.Relations()
+	test.Fatal(t, len(relations), 1)
+	test.Fatal(t, *relations[0].Relation, mongo.RelationMetadata{Type: "referenceMany", TargetDocument: "Writer",
+		Cascade: mongo.All, Load: mongo.Eager, StoreAs: mongo.StoreAsID, Sort: "Name", Descending: true})
+	writerMetadata, err := dm.GetMetadataFor(reflect.TypeOf(new(Writer)))
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(writerMetadata.Indexes()), 1)
+
+	book := classMetadata.NewInstance().(*Book)
+	test.Fatal(t, classMetadata.SetFieldValue(book, "Title", "Dune"), nil)
+	value, err := classMetadata.GetFieldValue(book, "Title")
+	test.Fatal(t, err, nil)
+	test.Fatal(t, value, "Dune")
+	test.Fatal(t, classMetadata.SetFieldValue(book, "Unknown", 1), mongo.ErrFieldNotFound)
+	test.Fatal(t, classMetadata.SetFieldValue(book, "Writers", 1) != nil, true)
+}
+
+func TestIndex_Spec(t *testing.T) {
+	index := mongo.Index{Index: mgo.Index{Key: []string{"Owner", "-CreatedAt"}, Unique: true, ExpireAfter: time.Hour}}
+	spec := index.Spec()
+	test.Fatal(t, spec.Name, "Owner_1_CreatedAt_-1")
+	test.Fatal(t, spec.ExpireAfterSeconds, 3600)
+	test.Fatal(t, reflect.DeepEqual(spec.Index().Key, index.Key), true)
+	test.Fatal(t, spec.Index().Unique, true)
+	test.Fatal(t, spec.Index().ExpireAfter, time.Hour)
+	text := mongo.IndexSpec{Name: "Title_text", Key: bson.D{{Name: "_fts", Value: "text"}, {Name: "_ftsx", Value: 1}},
+		Weights: bson.D{{Name: "Title", Value: 1}}}
+	test.Fatal(t, reflect.DeepEqual(text.Index().Key, []string{"$text:Title"}), true)
+}
+
+func TestNewMemoryStorage(t *testing.T) {
+	type Publisher struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string        `bson:"Name" odm:"index(unique:true)"`
+	}
+	type Novel struct {
+		ID        bson.ObjectId `bson:"_id,omitempty"`
+		Title     string        `bson:"Title"`
+		Year      int           `bson:"Year"`
+		Publisher *Publisher    `odm:"referenceOne(targetDocument:Publisher,cascade:persist)"`
+	}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewMemoryStorage("memory"))
+	err := dm.RegisterMany(map[string]interface{}{"Publisher": new(Publisher), "Novel": new(Novel)})
+	test.Fatal(t, err, nil)
+	test.Fatal(t, dm.GetSchemaManager().EnsureIndexes(), nil)
+	publisher := &Publisher{Name: "Ace"}
+	for i, title := range []string{"Dune", "Neuromancer", "Hyperion"} {
+		dm.Persist(&Novel{Title: title, Year: 1965 + i*10, Publisher: publisher})
+	}
+	test.Fatal(t, dm.Flush(), nil)
+	novel := new(Novel)
+	test.Fatal(t, dm.FindOne(bson.M{"Title": "Dune"}, novel), nil)
+	test.Fatal(t, novel.Publisher.Name, "Ace")
+	found := new(Novel)
+	test.Fatal(t, dm.FindID(novel.ID, found), nil)
+	test.Fatal(t, found.Title, "Dune")
+	test.Fatal(t, dm.FindID(bson.NewObjectId(), new(Novel)), mongo.ErrNotFound)
+	novels := []*Novel{}
+	test.Fatal(t, dm.FindBy(bson.M{"$or": []bson.M{{"Year": bson.M{"$gte": 1975}}, {"Title": bson.M{"$in": []string{"Dune"}}}}}, &novels), nil)
+	test.Fatal(t, len(novels), 3)
+	// unique indexes are enforced
+	dm.Persist(&Publisher{Name: "Ace"})
+	test.Fatal(t, isDuplicateKeyError(dm.Flush()), true)
+	id := novel.ID
+	dm.Remove(novel)
+	test.Fatal(t, dm.Flush(), nil)
+	test.Fatal(t, dm.FindID(id, new(Novel)), mongo.ErrNotFound)
+}
+
+func TestNewMemoryStorage_Collection(t *testing.T) {
+	collection := mongo.NewMemoryStorage("memory").C("Item", nil)
+	err := collection.Insert(bson.M{"_id": 1, "Name": "pen", "Price": 2, "Tags": []string{"office"}},
+		bson.M{"_id": 2, "Name": "book", "Price": 10, "Tags": []string{"office", "leisure"}},
+		bson.M{"_id": 3, "Name": "ball", "Price": 5})
+	test.Fatal(t, err, nil)
+	for query, count := range map[string]bson.M{
+		"$eq":     {"Name": bson.M{"$eq": "pen"}},
+		"$gt":     {"Price": bson.M{"$gt": 2}},
+		"$lte":    {"Price": bson.M{"$lte": 5}},
+		"$in":     {"Tags": bson.M{"$in": []string{"leisure"}}},
+		"$exists": {"Tags": bson.M{"$exists": false}},
+		"$and":    {"$and": []bson.M{{"Price": bson.M{"$gt": 2}}, {"Tags": "office"}}},
+		"$or":     {"$or": []bson.M{{"Name": "pen"}, {"Name": "ball"}}},
+	} {
+		n, err := collection.Find(count).Count()
+		test.Fatal(t, err, nil)
+		test.Fatal(t, n, map[string]int{"$eq": 1, "$gt": 2, "$lte": 2, "$in": 1, "$exists": 1, "$and": 1, "$or": 2}[query], query)
+	}
+	items := []bson.M{}
+	err = collection.Find(nil).Sort("-Price").Skip(1).Limit(1).Select(bson.M{"Name": 1}).All(&items)
+	test.Fatal(t, err, nil)
+	test.Fatal(t, reflect.DeepEqual(items, []bson.M{{"_id": 3, "Name": "ball"}}), true, fmt.Sprint(items))
+	changeInfo, err := collection.Upsert(bson.M{"Name": "ink"}, bson.M{"$set": bson.M{"Price": 1}})
+	test.Fatal(t, err, nil)
+	test.Fatal(t, changeInfo.UpsertedId != nil, true)
+	item := bson.M{}
+	test.Fatal(t, collection.Find(bson.M{"Name": "ink"}).One(&item), nil)
+	test.Fatal(t, item["Price"], 1)
+	changeInfo, err = collection.UpdateAll(bson.M{"Price": bson.M{"$lt": 5}}, bson.M{"$inc": bson.M{"Price": 1}})
+	test.Fatal(t, err, nil)
+	test.Fatal(t, changeInfo.Updated, 2)
+	err = collection.CreateIndex(mongo.Index{Index: mgo.Index{Key: []string{"Name"}, Unique: true}})
+	test.Fatal(t, err, nil)
+	test.Fatal(t, mgo.IsDup(collection.Insert(bson.M{"Name": "pen"})), true)
+	test.Fatal(t, collection.RemoveId(4), mongo.ErrNotFound)
+}
+
+func TestDocumentManager_FlushContext(t *testing.T) {
+	type Reader struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string        `bson:"Name"`
+	}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewMemoryStorage("memory"))
+	test.Fatal(t, dm.Register("Reader", new(Reader)), nil)
+	first, second := &Reader{Name: "Ann"}, &Reader{Name: "Bob"}
+	dm.Persist(first)
+	dm.Persist(second)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	// a canceled flush leaves the documents pending
+	test.Fatal(t, dm.FlushContext(ctx), context.Canceled)
+	readers := []*Reader{}
+	test.Fatal(t, dm.FindAll(&readers), nil)
+	test.Fatal(t, len(readers), 0)
+	test.Fatal(t, dm.FlushContext(context.Background()), nil)
+	test.Fatal(t, dm.FindAll(&readers), nil)
+	test.Fatal(t, len(readers), 2)
+	test.Fatal(t, dm.FindIDContext(ctx, first.ID, new(Reader)), context.Canceled)
+	reader := new(Reader)
+	test.Fatal(t, dm.FindIDContext(context.Background(), first.ID, reader), nil)
+	test.Fatal(t, reader.Name, "Ann")
+	test.Fatal(t, dm.CreateQuery().Context(ctx).Find(bson.M{"Name": "Bob"}).All(&readers), context.Canceled)
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	test.Fatal(t, dm.CreateQuery().Context(ctx).Find(bson.M{"Name": "Bob"}).One(reader), nil)
+	test.Fatal(t, reader.Name, "Bob")
+}
+
+func TestNewDocumentManagerFactory(t *testing.T) {
+	type Visit struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Page string        `bson:"Page" odm:"index"`
+	}
+	type Note struct {
+		ID bson.ObjectId `bson:"_id,omitempty"`
+	}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewMemoryStorage("memory"))
+	test.Fatal(t, dm.Register("Visit", new(Visit)), nil)
+	factory := mongo.NewDocumentManagerFactory(dm)
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func(i int) {
+			manager := factory.Create()
+			defer manager.Close()
+			manager.Persist(&Visit{Page: fmt.Sprint("page", i)})
+			errs <- manager.Flush()
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		test.Fatal(t, <-errs, nil)
+	}
+	visits := []*Visit{}
+	test.Fatal(t, dm.FindAll(&visits), nil)
+	test.Fatal(t, len(visits), 10)
+	// the document types registered by a created document manager are its own
+	manager := factory.Create()
+	defer manager.Close()
+	test.Fatal(t, manager.Register("Note", new(Note)), nil)
+	_, err := factory.Create().GetMetadataFor(new(Note))
+	test.Fatal(t, err, mongo.ErrDocumentNotRegistered)
+	_, err = factory.Create().GetMetadataFor(new(Visit))
+	test.Fatal(t, err, nil)
+}
+
+// isDuplicateKeyError returns true if err wraps a duplicate key error
+func isDuplicateKeyError(err error) bool {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if mgo.IsDup(err) {
+			return true
+		}
+	}
+	return false
+}
+
+// nonTransactionalStorage hides the transactions of a storage
+type nonTransactionalStorage struct {
+	mongo.Storage
+}
+
+func TestDocumentManager_Transactional(t *testing.T) {
+	type Account struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string        `bson:"Name" odm:"index(unique:true)"`
+	}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewMemoryStorage("memory"))
+	test.Fatal(t, dm.Register("Account", new(Account)), nil)
+	test.Fatal(t, dm.GetSchemaManager().EnsureIndexes(), nil)
+	first := &Account{Name: "first"}
+	err := dm.Transactional(func(dm mongo.DocumentManager) error {
+		dm.Persist(first)
+		dm.Persist(&Account{Name: "second"})
+		return nil
+	})
+	test.Fatal(t, err, nil)
+	accounts := []*Account{}
+	test.Fatal(t, dm.FindAll(&accounts), nil)
+	test.Fatal(t, len(accounts), 2)
+	// a failed transaction is rolled back
+	err = dm.Transactional(func(dm mongo.DocumentManager) error {
+		dm.Persist(&Account{Name: "third"})
+		dm.Persist(&Account{Name: "first"})
+		return nil
+	})
+	test.Fatal(t, isDuplicateKeyError(err), true)
+	test.Fatal(t, dm.FindOne(bson.M{"Name": "third"}, new(Account)), mongo.ErrNotFound)
+	canceled := errors.New("canceled")
+	err = dm.Transactional(func(dm mongo.DocumentManager) error {
+		dm.Persist(&Account{Name: "fourth"})
+		test.Fatal(t, dm.Flush(), nil)
+		return canceled
+	})
+	test.Fatal(t, err, canceled)
+	test.Fatal(t, dm.FindOne(bson.M{"Name": "fourth"}, new(Account)), mongo.ErrNotFound)
+	// a transactional flush removes documents once the transaction is committed
+	dm.SetTransactionalFlush(true)
+	id := first.ID
+	dm.Remove(first)
+	test.Fatal(t, dm.Flush(), nil)
+	test.Fatal(t, first.ID, bson.ObjectId(""))
+	test.Fatal(t, dm.FindID(id, new(Account)), mongo.ErrNotFound)
+	dm.Persist(&Account{Name: "fifth"})
+	dm.Persist(&Account{Name: "second"})
+	test.Fatal(t, isDuplicateKeyError(dm.Flush()), true)
+	test.Fatal(t, dm.FindOne(bson.M{"Name": "fifth"}, new(Account)), mongo.ErrNotFound)
+}
+
+func TestDocumentManager_Transactional_Abort(t *testing.T) {
+	type Wallet struct {
+		ID bson.ObjectId `bson:"_id,omitempty"`
+	}
+	type Account struct {
+		ID     bson.ObjectId `bson:"_id,omitempty"`
+		Name   string        `bson:"Name" odm:"index(unique:true)"`
+		Wallet *Wallet       `odm:"referenceOne(targetDocument:Wallet,cascade:persist)"`
+	}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewMemoryStorage("memory"))
+	test.Fatal(t, dm.RegisterMany(map[string]interface{}{"Account": new(Account), "Wallet": new(Wallet)}), nil)
+	test.Fatal(t, dm.GetSchemaManager().EnsureIndexes(), nil)
+	dm.Persist(&Account{Name: "taken"})
+	test.Fatal(t, dm.Flush(), nil)
+	account := &Account{Name: "taken", Wallet: &Wallet{}}
+	persist := func(dm mongo.DocumentManager) error {
+		dm.Persist(account)
+		return nil
+	}
+	test.Fatal(t, isDuplicateKeyError(dm.Transactional(persist)), true)
+	// the ids assigned in an aborted transaction are reset, so that the documents are inserted when retried
+	test.Fatal(t, account.ID, bson.ObjectId(""))
+	test.Fatal(t, account.Wallet.ID, bson.ObjectId(""), "the ids of cascaded documents are reset")
+	account.Name = "free"
+	test.Fatal(t, dm.Transactional(persist), nil)
+	test.Fatal(t, account.ID.Valid(), true)
+	loaded := new(Account)
+	test.Fatal(t, dm.FindID(account.ID, loaded), nil)
+	test.Fatal(t, loaded.Wallet != nil && loaded.Wallet.ID == account.Wallet.ID, true)
+}
+
+func TestDocumentManager_Transactional_NotSupported(t *testing.T) {
+	type Account struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string        `bson:"Name" odm:"index(unique:true)"`
+	}
+	dm := mongo.NewDocumentManagerWithStorage(nonTransactionalStorage{mongo.NewMemoryStorage("memory")})
+	test.Fatal(t, dm.Register("Account", new(Account)), nil)
+	test.Fatal(t, dm.GetSchemaManager().EnsureIndexes(), nil)
+	err := dm.Transactional(func(dm mongo.DocumentManager) error {
+		dm.Persist(&Account{Name: "first"})
+		return nil
+	})
+	test.Fatal(t, err, nil)
+	err = dm.Transactional(func(dm mongo.DocumentManager) error {
+		dm.Persist(&Account{Name: "first"})
+		return nil
+	})
+	partialFlushError := new(mongo.PartialFlushError)
+	test.Fatal(t, errors.As(err, &partialFlushError), true)
+	test.Fatal(t, len(partialFlushError.Committed), 0)
+	test.Fatal(t, isDuplicateKeyError(partialFlushError.Err), true)
+	dm.SetTransactionalFlush(true)
+	account := &Account{Name: "second"}
+	dm.Persist(account)
+	test.Fatal(t, dm.Flush(), nil)
+	test.Fatal(t, dm.FindID(account.ID, new(Account)), nil)
+}
+
+func TestDocumentManager_FlushWithResult(t *testing.T) {
+	type Customer struct {
+		ID    bson.ObjectId `bson:"_id,omitempty"`
+		Email string        `bson:"Email" odm:"index(unique:true)"`
+	}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewMemoryStorage("memory"))
+	test.Fatal(t, dm.Register("Customer", new(Customer)), nil)
+	test.Fatal(t, dm.GetSchemaManager().EnsureIndexes(), nil)
+	existing, updated, removed := &Customer{Email: "ann@example.com"}, &Customer{Email: "eve@example.com"}, &Customer{Email: "bob@example.com"}
+	dm.Persist(existing)
+	dm.Persist(updated)
+	dm.Persist(removed)
+	test.Fatal(t, dm.Flush(), nil)
+	duplicate, created := &Customer{Email: "ann@example.com"}, &Customer{Email: "carl@example.com"}
+	updated.Email = "eve@example.org"
+	dm.Persist(updated)
+	dm.Persist(created)
+	dm.Remove(removed)
+	dm.Persist(duplicate)
+	result, err := dm.FlushWithResult()
+	flushError := new(mongo.FlushError)
+	test.Fatal(t, errors.As(err, &flushError), true)
+	test.Fatal(t, flushError.Document, interface{}(duplicate))
+	test.Fatal(t, flushError.Collection, "Customer")
+	test.Fatal(t, flushError.Type, "insert")
+	test.Fatal(t, isDuplicateKeyError(err), true)
+	test.Fatal(t, len(result.Failures), 1)
+	test.Fatal(t, reflect.DeepEqual(result.Inserted(), []interface{}{created}), true)
+	test.Fatal(t, reflect.DeepEqual(result.Updated(), []interface{}{updated}), true)
+	test.Fatal(t, reflect.DeepEqual(result.Removed(), []interface{}{removed}), true)
+	// the documents which failed stay pending
+	duplicate.Email = "dan@example.com"
+	result, err = dm.FlushWithResult()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, reflect.DeepEqual(result.Inserted(), []interface{}{duplicate}), true)
+	// Flush stops at the first failure
+	dm.Persist(&Customer{Email: "dan@example.com"})
+	err = dm.Flush()
+	test.Fatal(t, errors.As(err, &flushError), true)
+	test.Fatal(t, flushError.Type, "insert")
+}
+
+func TestDocumentManager_UniqueViolation(t *testing.T) {
+	type Member struct {
+		ID    bson.ObjectId `bson:"_id,omitempty"`
+		Email string        `bson:"email" odm:"index(unique:true)"`
+		Team  string        `bson:"Team" odm:"composite(name:TeamName)"`
+		Name  string        `bson:"Name" odm:"composite(name:TeamName)"`
+	}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewMemoryStorage("memory"))
+	test.Fatal(t, dm.Register("Member", new(Member)), nil)
+	test.Fatal(t, dm.GetSchemaManager().EnsureIndexes(), nil)
+	dm.Persist(&Member{Email: "ann@example.com", Team: "go", Name: "Ann"})
+	test.Fatal(t, dm.Flush(), nil)
+	dm.Persist(&Member{Email: "ann@example.com", Team: "go", Name: "Ann B."})
+	err := dm.Flush()
+	test.Fatal(t, errors.Is(err, mongo.ErrUniqueViolation), true)
+	test.Fatal(t, isDuplicateKeyError(err), true)
+	violation := new(mongo.UniqueViolationError)
+	test.Fatal(t, errors.As(err, &violation), true)
+	test.Fatal(t, violation.Collection, "Member")
+	test.Fatal(t, violation.Index, "email_1")
+	test.Fatal(t, reflect.DeepEqual(violation.Fields, []string{"Email"}), true)
+	test.Fatal(t, reflect.DeepEqual(violation.Values, []interface{}{"ann@example.com"}), true)
+	dm.Persist(&Member{Email: "bob@example.com", Team: "go", Name: "Ann"})
+	err = dm.Flush()
+	test.Fatal(t, errors.As(err, &violation), true)
+	test.Fatal(t, violation.Index, "TeamName")
+	test.Fatal(t, reflect.DeepEqual(violation.Fields, []string{"Team", "Name"}), true)
+	test.Fatal(t, reflect.DeepEqual(violation.Values, []interface{}{"go", "Ann"}), true)
+	test.Fatal(t, violation.Error(), "Error Team, Name [go Ann] already exists in collection 'Member' (unique index 'TeamName')")
+}
+
+func TestDocumentManager_SoftDelete(t *testing.T) {
+	type Book struct {
+		ID        bson.ObjectId `bson:"_id,omitempty"`
+		Title     string
+		DeletedAt *time.Time `odm:"softDelete"`
+	}
+	type Author struct {
+		ID        bson.ObjectId `bson:"_id,omitempty"`
+		Name      string
+		BookIDs   []bson.ObjectId
+		Books     []*Book   `odm:"referenceMany(targetDocument:Book,storeId:BookIDs,cascade:all)"`
+		DeletedAt time.Time `odm:"softDelete"`
+	}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewMemoryStorage("memory"))
+	test.Fatal(t, dm.Register("Book", new(Book)), nil)
+	test.Fatal(t, dm.Register("Author", new(Author)), nil)
+	books := []*Book{{Title: "Dune"}, {Title: "Children of Dune"}}
+	author := &Author{Name: "Frank Herbert", Books: books}
+	dm.Persist(author)
+	test.Fatal(t, dm.Flush(), nil)
+	dm.Remove(books[1])
+	test.Fatal(t, dm.Flush(), nil)
+	test.Fatal(t, books[1].DeletedAt != nil, true)
+	test.Fatal(t, books[1].ID != "", true, "a soft deleted document keeps its id")
+	test.Fatal(t, dm.FindID(books[1].ID, new(Book)), mongo.ErrNotFound)
+	found := []*Book{}
+	test.Fatal(t, dm.FindAll(&found), nil)
+	test.Fatal(t, len(found), 1)
+	count, err := dm.CreateQuery().Count("Book")
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 1)
+	count, err = dm.CreateQuery().WithDeleted().Count("Book")
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 2)
+	loaded := new(Author)
+	test.Fatal(t, dm.FindID(author.ID, loaded), nil)
+	test.Fatal(t, len(loaded.Books), 1, "soft deleted related documents are not resolved")
+	deleted := new(Book)
+	test.Fatal(t, dm.WithDeleted().FindID(books[1].ID, deleted), nil)
+	test.Fatal(t, deleted.DeletedAt.Equal(*books[1].DeletedAt), true)
+	found = []*Book{}
+	test.Fatal(t, dm.OnlyDeleted().FindAll(&found), nil)
+	test.Fatal(t, len(found), 1)
+	test.Fatal(t, found[0].ID, books[1].ID)
+	found = []*Book{}
+	test.Fatal(t, dm.CreateQuery().OnlyDeleted().Where("Title").Eq("Dune").All(&found), nil)
+	test.Fatal(t, len(found), 0)
+	count, err = dm.CreateQuery().Where("Books.Title").Eq("Children of Dune").Count("Author")
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 0, "conditions on relations ignore soft deleted related documents")
+	// persisting the author keeps the reference to the soft deleted book
+	loaded.Name = "Frank Patrick Herbert"
+	dm.Persist(loaded)
+	test.Fatal(t, dm.Flush(), nil)
+
+	dm.Restore(books[1])
+	result, err := dm.FlushWithResult()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(result.Restored()), 1)
+	test.Fatal(t, books[1].DeletedAt == nil, true)
+	test.Fatal(t, dm.FindID(books[1].ID, new(Book)), nil)
+	loaded = new(Author)
+	test.Fatal(t, dm.FindID(author.ID, loaded), nil)
+	test.Fatal(t, loaded.Name, "Frank Patrick Herbert")
+	test.Fatal(t, len(loaded.Books), 2, "a restored document is related again")
+
+	// removal cascades to the related documents, which are soft deleted too
+	dm.Remove(author)
+	test.Fatal(t, dm.Flush(), nil)
+	test.Fatal(t, author.DeletedAt.IsZero(), false)
+	test.Fatal(t, dm.FindID(author.ID, new(Author)), mongo.ErrNotFound)
+	found = []*Book{}
+	test.Fatal(t, dm.FindAll(&found), nil)
+	test.Fatal(t, len(found), 0)
+	found = []*Book{}
+	test.Fatal(t, dm.WithDeleted().FindAll(&found), nil)
+	test.Fatal(t, len(found), 2)
+
+	type Shelf struct {
+		ID        bson.ObjectId `bson:"_id,omitempty"`
+		DeletedAt string        `odm:"softDelete"`
+	}
+	mappingError := new(mongo.MappingError)
+	test.Fatal(t, errors.As(dm.Register("Shelf", new(Shelf)), &mappingError), true)
+	test.Fatal(t, mappingError.Error(), "mongo_test.Shelf.DeletedAt : a softDelete field must be a time.Time or a *time.Time, got string (tag `softDelete` at column 1)")
+
+	type Note struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Text string
+	}
+	test.Fatal(t, dm.Register("Note", new(Note)), nil)
+	note := &Note{Text: "note"}
+	dm.Persist(note)
+	test.Fatal(t, dm.Flush(), nil)
+	dm.Restore(note)
+	test.Fatal(t, errors.Is(dm.Flush(), mongo.ErrSoftDeleteNotMapped), true)
+}
+
+func TestDocumentManager_Filters(t *testing.T) {
+	type Task struct {
+		ID       bson.ObjectId `bson:"_id,omitempty"`
+		TenantID string
+		Title    string
+	}
+	type Project struct {
+		ID       bson.ObjectId `bson:"_id,omitempty"`
+		TenantID string
+		Name     string
+		TaskIDs  []bson.ObjectId
+		Tasks    []*Task `odm:"referenceMany(targetDocument:Task,storeId:TaskIDs,cascade:all)"`
+	}
+	type Country struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string
+	}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewMemoryStorage("memory"))
+	test.Fatal(t, dm.Register("Task", new(Task)), nil)
+	test.Fatal(t, dm.Register("Project", new(Project)), nil)
+	test.Fatal(t, dm.Register("Country", new(Country)), nil)
+	test.Fatal(t, dm.RegisterFilter("tenant", mongo.FieldFilter{Field: "TenantId", Parameter: "tenantID"}), mongo.ErrFilterFieldNotFound)
+	test.Fatal(t, dm.RegisterFilter("tenant", mongo.FieldFilter{Field: "TenantID", Parameter: "tenantID"}), nil)
+	test.Fatal(t, dm.EnableFilter("unknown", nil), mongo.ErrFilterNotRegistered)
+	test.Fatal(t, dm.EnableFilter("tenant", mongo.FilterParameters{"tenant": "a"}), mongo.ErrFilterParameterMissing)
+	test.Fatal(t, dm.IsFilterEnabled("tenant"), false)
+
+	test.Fatal(t, dm.EnableFilter("tenant", mongo.FilterParameters{"tenantID": "a"}), nil)
+	projectA := &Project{Name: "A", Tasks: []*Task{{Title: "A1"}, {Title: "A2"}}}
+	dm.Persist(projectA)
+	dm.Persist(&Country{Name: "France"})
+	test.Fatal(t, dm.Flush(), nil)
+	test.Fatal(t, projectA.TenantID, "a", "persisted documents are stamped")
+	test.Fatal(t, projectA.Tasks[1].TenantID, "a", "cascaded documents are stamped")
+
+	test.Fatal(t, dm.EnableFilter("tenant", mongo.FilterParameters{"tenantID": "b"}), nil)
+	dm.Persist(&Project{Name: "B"})
+	test.Fatal(t, dm.Flush(), nil)
+	projects := []*Project{}
+	test.Fatal(t, dm.FindAll(&projects), nil)
+	test.Fatal(t, len(projects), 1)
+	test.Fatal(t, projects[0].Name, "B")
+	test.Fatal(t, dm.FindID(projectA.ID, new(Project)), mongo.ErrNotFound)
+	test.Fatal(t, dm.FindOne(bson.M{"name": "A"}, new(Project)), mongo.ErrNotFound)
+	count, err := dm.CreateQuery().Where("Tasks.Title").Eq("A1").Count("Project")
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 0)
+	countries := []*Country{}
+	test.Fatal(t, dm.FindAll(&countries), nil)
+	test.Fatal(t, len(countries), 1, "types without the filtered field are not filtered")
+
+	// a document manager created by a factory enables or disables filters independently
+	factory := mongo.NewDocumentManagerFactory(dm)
+	other := factory.Create()
+	defer other.Close()
+	test.Fatal(t, other.IsFilterEnabled("tenant"), true)
+	other.DisableFilter("tenant")
+	test.Fatal(t, dm.IsFilterEnabled("tenant"), true)
+	projects = []*Project{}
+	test.Fatal(t, other.FindAll(&projects), nil)
+	test.Fatal(t, len(projects), 2)
+
+	// relation lookups are filtered
+	_, err = dm.GetStorage().C("Task", nil).UpdateAll(bson.M{"title": "A2"}, bson.M{"$set": bson.M{"tenantid": "b"}})
+	test.Fatal(t, err, nil)
+	test.Fatal(t, other.EnableFilter("tenant", mongo.FilterParameters{"tenantID": "a"}), nil)
+	loaded := new(Project)
+	test.Fatal(t, other.FindID(projectA.ID, loaded), nil)
+	test.Fatal(t, len(loaded.Tasks), 1)
+	test.Fatal(t, loaded.Tasks[0].Title, "A1")
+	// the references to the filtered out documents are kept when the document is persisted
+	other.Persist(loaded)
+	test.Fatal(t, other.Flush(), nil)
+	stored := bson.M{}
+	test.Fatal(t, dm.GetStorage().C("Project", nil).FindId(projectA.ID).One(&stored), nil)
+	test.Fatal(t, len(stored["taskids"].([]interface{})), 2)
+
+	// writes are filtered : the documents of another tenant can't be updated or removed
+	dm.Remove(projectA.Tasks[0])
+	test.Fatal(t, errors.Is(dm.Flush(), mongo.ErrFilteredDocument), true)
+	dm.Persist(projectA)
+	test.Fatal(t, errors.Is(dm.Flush(), mongo.ErrFilteredDocument), true, "a document of another tenant isn't upserted")
+	test.Fatal(t, projectA.TenantID, "a", "a document of another tenant isn't stamped")
+	dm.Remove(&Project{ID: bson.NewObjectId()})
+	test.Fatal(t, errors.Is(dm.Flush(), mongo.ErrNotFound), true)
+	other.DisableFilter("tenant")
+	loaded = new(Project)
+	test.Fatal(t, other.FindID(projectA.ID, loaded), nil)
+	test.Fatal(t, loaded.TenantID, "a")
+	test.Fatal(t, len(loaded.Tasks), 2)
+}
+
+func TestNewTenantStorage(t *testing.T) {
+	type Member struct {
+		ID    bson.ObjectId `bson:"_id,omitempty"`
+		Email string        `bson:"email" odm:"index(unique:true)"`
+	}
+	storages := map[string]mongo.Storage{"acme": mongo.NewMemoryStorage("acme"), "globex": mongo.NewMemoryStorage("globex")}
+	main := mongo.NewMemoryStorage("main")
+	resolved := map[string]int{}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewTenantStorage(main, func(tenant string) mongo.Storage {
+		resolved[tenant]++
+		return storages[tenant]
+	}))
+	test.Fatal(t, dm.Register("Member", new(Member)), nil)
+	indexNames := func(storage mongo.Storage) []string {
+		names := []string{}
+		indexes, _ := storage.C("Member", nil).Indexes()
+		for _, index := range indexes {
+			names = append(names, index.Name)
+		}
+		return names
+	}
+
+	// the tenant of the context of an operation selects the storage
+	acme := mongo.WithTenant(context.Background(), "acme")
+	member := &Member{Email: "ann@example.com"}
+	dm.Persist(member)
+	test.Fatal(t, dm.FlushContext(acme), nil)
+	test.Fatal(t, dm.FindID(member.ID, new(Member)), mongo.ErrNotFound)
+	test.Fatal(t, dm.FindIDContext(acme, member.ID, new(Member)), nil)
+	test.Fatal(t, reflect.DeepEqual(indexNames(storages["acme"]), []string{"_id_", "email_1"}), true, "indexes are ensured in the storage of the tenant")
+	test.Fatal(t, reflect.DeepEqual(indexNames(main), []string{"_id_"}), true)
+
+	// a document manager created for a tenant uses the storage of the tenant
+	factory := mongo.NewDocumentManagerFactory(dm)
+	globex, err := factory.CreateForTenant("globex")
+	test.Fatal(t, err, nil)
+	defer globex.Close()
+	test.Fatal(t, reflect.DeepEqual(indexNames(storages["globex"]), []string{"_id_", "email_1"}), true, "indexes are ensured when the tenant is resolved")
+	test.Fatal(t, globex.GetMigrator().GetDocumentManager() == globex, true, "the migrations of a tenant run in the storage of the tenant")
+	globex.Persist(&Member{Email: "ann@example.com"})
+	test.Fatal(t, globex.Flush(), nil)
+	members := []*Member{}
+	test.Fatal(t, globex.FindAll(&members), nil)
+	test.Fatal(t, len(members), 1)
+	test.Fatal(t, globex.FindID(member.ID, new(Member)), mongo.ErrNotFound)
+	test.Fatal(t, globex.FindIDContext(acme, member.ID, new(Member)), nil, "the tenant of the context overrides the tenant of the document manager")
+	globex.Persist(&Member{Email: "ann@example.com"})
+	test.Fatal(t, errors.Is(globex.Flush(), mongo.ErrUniqueViolation), true)
+
+	// operations without tenant, or which tenant has no storage, use the default storage
+	dm.Persist(&Member{Email: "bob@example.com"})
+	test.Fatal(t, dm.FlushContext(mongo.WithTenant(context.Background(), "initech")), nil)
+	members = []*Member{}
+	test.Fatal(t, dm.FindAll(&members), nil)
+	test.Fatal(t, len(members), 1)
+	test.Fatal(t, members[0].Email, "bob@example.com")
+	test.Fatal(t, reflect.DeepEqual(indexNames(main), []string{"_id_", "email_1"}), true)
+	test.Fatal(t, reflect.DeepEqual(resolved, map[string]int{"acme": 1, "globex": 1, "initech": 1}), true, "the storage of a tenant is resolved once", fmt.Sprint(resolved))
+}
+
+// copyableStorage counts the copies of a storage which are closed
+type copyableStorage struct {
+	mongo.Storage
+	copies map[string]int
+}
+
+func (storage copyableStorage) Copy() mongo.Storage {
+	storage.copies[storage.Name()]++
+	return storage
+}
+
+func (storage copyableStorage) Close() {
+	storage.copies[storage.Name()]--
+}
+
+func TestNewTenantStorage_Copy(t *testing.T) {
+	type Member struct {
+		ID    bson.ObjectId `bson:"_id,omitempty"`
+		Email string        `bson:"email" odm:"index(unique:true)"`
+	}
+	copies := map[string]int{}
+	acme := copyableStorage{mongo.NewMemoryStorage("acme"), copies}
+	dm := mongo.NewDocumentManagerWithStorage(mongo.NewTenantStorage(copyableStorage{mongo.NewMemoryStorage("main"), copies}, func(tenant string) mongo.Storage {
+		return acme
+	}))
+	test.Fatal(t, dm.Register("Member", new(Member)), nil)
+	factory := mongo.NewDocumentManagerFactory(dm)
+	first, err := factory.CreateForTenant("acme")
+	test.Fatal(t, err, nil)
+	second, err := factory.CreateForTenant("acme")
+	test.Fatal(t, err, nil)
+	test.Fatal(t, reflect.DeepEqual(copies, map[string]int{"main": 2, "acme": 2}), true, "each document manager copies the storages", fmt.Sprint(copies))
+	first.Close()
+	second.Close()
+	test.Fatal(t, reflect.DeepEqual(copies, map[string]int{"main": 0, "acme": 0}), true, "the copies are closed", fmt.Sprint(copies))
+}
+
+func TestDocumentManager_ThroughIndexes(t *testing.T) {
+	type Role struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string
+	}
+	type Account struct {
+		ID    bson.ObjectId `bson:"_id,omitempty"`
+		Roles []*Role       `odm:"referenceMany(targetDocument:Role,through:AccountRoles,cascade:persist)"`
+	}
+	storage := mongo.NewMemoryStorage("memory")
+	dm := mongo.NewDocumentManagerWithStorage(storage)
+	test.Fatal(t, dm.Register("Role", new(Role)), nil)
+	test.Fatal(t, dm.Register("Account", new(Account)), nil)
+	schemaManager := dm.GetSchemaManager()
+	diffs, err := schemaManager.DiffIndexes()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(diffs), 3)
+	test.Fatal(t, diffs[2].Collection, "AccountRoles")
+	test.Fatal(t, len(diffs[2].Missing), 2)
+	test.Fatal(t, schemaManager.EnsureIndexes(), nil)
+	indexes, err := storage.C("AccountRoles", nil).Indexes()
+	test.Fatal(t, err, nil)
+	names := []string{}
+	for _, index := range indexes {
+		names = append(names, index.Name)
+	}
+	test.Fatal(t, reflect.DeepEqual(names, []string{"_id_", "odm:accountid_1_odm:roleid_1", "odm:roleid_1"}), true, fmt.Sprint(names))
+	diffs, err = schemaManager.DiffIndexes()
+	test.Fatal(t, err, nil)
+	for _, diff := range diffs {
+		test.Fatal(t, diff.IsEmpty(), true, diff.Collection)
+	}
+	dm.Persist(&Account{Roles: []*Role{{Name: "admin"}, {Name: "editor"}, {Name: "viewer"}}})
+	test.Fatal(t, dm.Flush(), nil)
+	count, err := storage.C("AccountRoles", nil).Find(nil).Count()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 3)
+}
+
+func TestDocumentManager_ThroughAssociation(t *testing.T) {
+	type Course struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string
+	}
+	type Student struct {
+		ID      bson.ObjectId `bson:"_id,omitempty"`
+		Name    string
+		Courses []*Course `odm:"referenceMany(targetDocument:Course,through:Enrollment)"`
+	}
+	type Enrollment struct {
+		ID      bson.ObjectId `bson:"_id,omitempty"`
+		Student *Student      `odm:"referenceOne(targetDocument:Student)"`
+		Course  *Course       `odm:"referenceOne(targetDocument:Course)"`
+		Grade   int
+	}
+	storage := mongo.NewMemoryStorage("memory")
+	dm := mongo.NewDocumentManagerWithStorage(storage)
+	test.Fatal(t, dm.Register("Course", new(Course)), nil)
+	test.Fatal(t, dm.Register("Student", new(Student)), nil)
+	test.Fatal(t, dm.Register("Enrollment", new(Enrollment)), nil)
+	math, physics := &Course{Name: "Math"}, &Course{Name: "Physics"}
+	student := &Student{Name: "Ann"}
+	dm.Persist(math)
+	dm.Persist(physics)
+	dm.Persist(student)
+	enrollment := &Enrollment{Student: student, Course: math, Grade: 12}
+	dm.Persist(enrollment)
+	test.Fatal(t, dm.Flush(), nil)
+
+	// the association document is the link, with its attributes
+	stored := []bson.M{}
+	test.Fatal(t, storage.C("Enrollment", nil).Find(nil).All(&stored), nil)
+	test.Fatal(t, len(stored), 1)
+	test.Fatal(t, stored[0]["odm:studentid"], student.ID)
+	test.Fatal(t, stored[0]["odm:courseid"], math.ID)
+	test.Fatal(t, stored[0]["grade"], 12)
+	loaded := new(Student)
+	test.Fatal(t, dm.FindID(student.ID, loaded), nil)
+	test.Fatal(t, len(loaded.Courses), 1)
+	test.Fatal(t, loaded.Courses[0].Name, "Math")
+	enrollments := []*Enrollment{}
+	test.Fatal(t, dm.FindBy(bson.M{"odm:studentid": student.ID}, &enrollments), nil)
+	test.Fatal(t, len(enrollments), 1)
+	test.Fatal(t, enrollments[0].Grade, 12)
+	test.Fatal(t, enrollments[0].Course.Name, "Math")
+
+	// the owning document doesn't duplicate nor delete the association documents
+	loaded.Courses = append(loaded.Courses, physics)
+	dm.Persist(loaded)
+	enrollments[0].Grade = 15
+	dm.Persist(enrollments[0])
+	test.Fatal(t, dm.Flush(), nil)
+	loaded.Courses = nil
+	dm.Persist(loaded)
+	test.Fatal(t, dm.Flush(), nil)
+	stored = []bson.M{}
+	test.Fatal(t, storage.C("Enrollment", nil).Find(nil).All(&stored), nil)
+	test.Fatal(t, len(stored), 1)
+	test.Fatal(t, stored[0]["_id"], enrollment.ID)
+	test.Fatal(t, stored[0]["grade"], 15)
+}
+
+func TestDocumentManager_RelationLimit(t *testing.T) {
+	type Buyer struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string
+	}
+	type Purchase struct {
+		ID     bson.ObjectId `bson:"_id,omitempty"`
+		Number int
+		Buyer  *Buyer `odm:"referenceOne(targetDocument:Buyer)"`
+	}
+	type Shopper struct {
+		ID          bson.ObjectId `bson:"_id,omitempty"`
+		Name        string
+		Latest      []*Purchase `odm:"referenceMany(targetDocument:Purchase,mappedBy:Buyer,sort:Number,order:desc,limit:2)"`
+		Favorites   []*Purchase `odm:"referenceMany(targetDocument:Purchase,storeId:FavoriteIDs,sort:Number,limit:2)"`
+		FavoriteIDs []bson.ObjectId
+		Wishes      []*Purchase `odm:"referenceMany(targetDocument:Purchase,through:Wish,limit:1)"`
+	}
+	storage := mongo.NewMemoryStorage("memory")
+	dm := mongo.NewDocumentManagerWithStorage(storage)
+	test.Fatal(t, dm.Register("Buyer", new(Buyer)), nil)
+	test.Fatal(t, dm.Register("Purchase", new(Purchase)), nil)
+	for _, name := range []string{"Ann", "Bob"} {
+		buyer := &Buyer{Name: name}
+		dm.Persist(buyer)
+		ids := []bson.ObjectId{}
+		for number := 1; number <= 4; number++ {
+			purchase := &Purchase{Number: number, Buyer: buyer}
+			dm.Persist(purchase)
+			ids = append(ids, purchase.ID)
+		}
+		test.Fatal(t, dm.Flush(), nil)
+		// a shopper shares the collection and the id of a buyer
+		_, err := storage.C("Buyer", nil).UpdateAll(bson.M{"_id": buyer.ID}, bson.M{"$set": bson.M{"favoriteids": []bson.ObjectId{ids[3], ids[2], ids[0]}}})
+		test.Fatal(t, err, nil)
+		for _, id := range ids[:2] {
+			test.Fatal(t, storage.C("Wish", nil).Insert(bson.M{"_id": bson.NewObjectId(), "odm:buyerid": buyer.ID, "odm:purchaseid": id}), nil)
+		}
+	}
+	loader := mongo.NewDocumentManagerWithStorage(storage)
+	test.Fatal(t, loader.Register("Purchase", new(Purchase)), nil)
+	test.Fatal(t, loader.Register("Buyer", new(Shopper)), nil)
+	shoppers := []*Shopper{}
+	test.Fatal(t, loader.FindAll(&shoppers), nil)
+	test.Fatal(t, len(shoppers), 2)
+	for _, shopper := range shoppers {
+		test.Fatal(t, len(shopper.Latest), 2, shopper.Name)
+		test.Fatal(t, shopper.Latest[0].Number, 4)
+		test.Fatal(t, shopper.Latest[1].Number, 3)
+		test.Fatal(t, len(shopper.Favorites), 2)
+		test.Fatal(t, shopper.Favorites[0].Number, 1)
+		test.Fatal(t, shopper.Favorites[1].Number, 3)
+		test.Fatal(t, len(shopper.Wishes), 1)
+		test.Fatal(t, shopper.Wishes[0].Number, 1)
+	}
+
+	// the references past the limit are kept when a loaded document is persisted
+	shopper := shoppers[0]
+	shopper.Name = "Carl"
+	loader.Persist(shopper)
+	test.Fatal(t, loader.Flush(), nil)
+	stored := bson.M{}
+	test.Fatal(t, storage.C("Buyer", nil).FindId(shopper.ID).One(&stored), nil)
+	test.Fatal(t, stored["name"], "Carl")
+	test.Fatal(t, len(stored["favoriteids"].([]interface{})), 3)
+	links, err := storage.C("Wish", nil).Find(bson.M{"odm:buyerid": shopper.ID}).Count()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, links, 2)
+	reloaded := new(Shopper)
+	test.Fatal(t, loader.FindID(shopper.ID, reloaded), nil)
+	test.Fatal(t, len(reloaded.Favorites), 2)
+	test.Fatal(t, reloaded.Favorites[0].Number, 1)
+	test.Fatal(t, reloaded.Favorites[1].Number, 3)
+
+	// a related document the field exposes can still be removed from the field
+	reloaded.Favorites = reloaded.Favorites[1:]
+	loader.Persist(reloaded)
+	test.Fatal(t, loader.Flush(), nil)
+	stored = bson.M{}
+	test.Fatal(t, storage.C("Buyer", nil).FindId(shopper.ID).One(&stored), nil)
+	test.Fatal(t, len(stored["favoriteids"].([]interface{})), 2)
+}
+
+func TestDocumentManager_DBRefResolution(t *testing.T) {
+	type Cat struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string
+	}
+	type Dog struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string
+	}
+	type Owner struct {
+		ID       bson.ObjectId `bson:"_id,omitempty"`
+		Pets     []interface{} `odm:"referenceMany(targetDocument:Cat,storeAs:dbRef,cascade:persist)"`
+		Favorite *Dog          `odm:"referenceOne(targetDocument:Dog,storeAs:dbRefWithDB,cascade:persist)"`
+		Cats     []*Cat        `odm:"referenceMany(targetDocument:Cat,storeAs:dbRef)"`
+	}
+	storage := mongo.NewMemoryStorage("memory")
+	dm := mongo.NewDocumentManagerWithStorage(storage)
+	test.Fatal(t, dm.Register("Cat", new(Cat)), nil)
+	test.Fatal(t, dm.Register("Dog", new(Dog)), nil)
+	test.Fatal(t, dm.Register("Owner", new(Owner)), nil)
+	felix, rex := &Cat{Name: "Felix"}, &Dog{Name: "Rex"}
+	owner := &Owner{Pets: []interface{}{felix, rex}, Favorite: rex, Cats: []*Cat{felix}}
+	dm.Persist(owner)
+	test.Fatal(t, dm.Flush(), nil)
+	stored := bson.M{}
+	test.Fatal(t, storage.C("Owner", nil).FindId(owner.ID).One(&stored), nil)
+	test.Fatal(t, stored["odm:petsids"].([]interface{})[1].(bson.M)["$ref"], "Dog")
+	test.Fatal(t, stored["odm:favoriteid"].(bson.M)["$db"], "memory")
+
+	// the references are resolved in the collections they point to
+	loader := mongo.NewDocumentManagerWithStorage(storage)
+	test.Fatal(t, loader.Register("Cat", new(Cat)), nil)
+	test.Fatal(t, loader.Register("Dog", new(Dog)), nil)
+	test.Fatal(t, loader.Register("Owner", new(Owner)), nil)
+	loaded := new(Owner)
+	test.Fatal(t, loader.FindID(owner.ID, loaded), nil)
+	test.Fatal(t, len(loaded.Pets), 2)
+	test.Fatal(t, loaded.Pets[0].(*Cat).Name, "Felix")
+	test.Fatal(t, loaded.Pets[1].(*Dog).Name, "Rex")
+	test.Fatal(t, loaded.Favorite == loaded.Pets[1], true, "a document referenced twice is fetched once")
+	test.Fatal(t, len(loaded.Cats), 1)
+	test.Fatal(t, loaded.Cats[0] == loaded.Pets[0], true, "a document referenced twice is fetched once")
+
+	// references to another database can't be resolved
+	_, err := storage.C("Owner", nil).UpdateAll(bson.M{"_id": owner.ID}, bson.M{"$set": bson.M{"odm:favoriteid.$db": "other"}})
+	test.Fatal(t, err, nil)
+	test.Fatal(t, loader.FindID(owner.ID, new(Owner)), mongo.ErrForeignDatabaseReference)
+
+	// the integrity check looks for each reference in its collection and skips the other databases
+	test.Fatal(t, storage.C("Cat", nil).RemoveId(felix.ID), nil)
+	report, err := loader.CheckIntegrity(context.Background(), new(Owner))
+	test.Fatal(t, err, nil)
+	test.Fatal(t, len(report.DanglingReferences), 2, fmt.Sprint(report.DanglingReferences))
+	for _, reference := range report.DanglingReferences {
+		test.Fatal(t, reference.TargetDocument, "Cat")
+		test.Fatal(t, reference.ReferenceID, felix.ID)
+	}
+}
+
+func TestMigrator_TransformDocuments(t *testing.T) {
+	type Tag struct {
+		ID   bson.ObjectId `bson:"_id,omitempty"`
+		Name string
+	}
+	type Post struct {
+		ID    bson.ObjectId `bson:"_id,omitempty"`
+		Title string
+		Tags  []*Tag `odm:"referenceMany(targetDocument:Tag,limit:1)"`
+	}
+	storage := mongo.NewMemoryStorage("memory")
+	dm := mongo.NewDocumentManagerWithStorage(storage)
+	test.Fatal(t, dm.Register("Tag", new(Tag)), nil)
+	test.Fatal(t, dm.Register("Post", new(Post)), nil)
+	post := &Post{Title: "go", Tags: []*Tag{{Name: "a"}, {Name: "b"}}}
+	dm.Persist(post.Tags[0])
+	dm.Persist(post.Tags[1])
+	dm.Persist(post)
+	test.Fatal(t, dm.Flush(), nil)
+	pending := &Tag{Name: "pending"}
+	dm.Persist(pending)
+	test.Fatal(t, dm.GetMigrator().TransformDocuments(context.Background(), new(Post), func(document interface{}) error {
+		document.(*Post).Title = "Go"
+		return nil
+	}), nil)
+	stored := bson.M{}
+	test.Fatal(t, storage.C("Post", nil).FindId(post.ID).One(&stored), nil)
+	test.Fatal(t, stored["title"], "Go")
+	test.Fatal(t, len(stored["odm:tagsids"].([]interface{})), 2, "the references past the limit are kept")
+	count, err := storage.C("Tag", nil).Find(bson.M{"name": "pending"}).Count()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 0, "the pending documents of the document manager are not flushed")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	test.Fatal(t, dm.GetMigrator().TransformDocuments(ctx, new(Post), func(document interface{}) error { return nil }), context.Canceled)
+}
+
+func TestMigrator_Lock(t *testing.T) {
+	storage := mongo.NewMemoryStorage("memory")
+	dm := mongo.NewDocumentManagerWithStorage(storage)
+	migrator := dm.GetMigrator()
+	locks := storage.C("odm.migrations.lock", nil)
+	ran := []string{}
+	test.Fatal(t, migrator.Register(mongo.Migration{ID: "1", Up: func(ctx context.Context, migrator mongo.Migrator) error {
+		ran = append(ran, "1")
+		// another instance can't run migrations while the lock is held
+		_, err := migrator.Up(ctx)
+		test.Fatal(t, err, mongo.ErrMigrationLocked)
+		// the lock is taken over, as if it had become stale
+		_, err = locks.UpdateAll(nil, bson.M{"$set": bson.M{"owner": bson.NewObjectId()}})
+		return err
+	}}, mongo.Migration{ID: "2", Up: func(ctx context.Context, migrator mongo.Migrator) error {
+		ran = append(ran, "2")
+		return nil
+	}}), nil)
+	ids, err := migrator.Up(context.Background())
+	test.Fatal(t, err, mongo.ErrMigrationLocked, "the lock is checked before each migration")
+	test.Fatal(t, reflect.DeepEqual(ids, []string{"1"}), true)
+	test.Fatal(t, reflect.DeepEqual(ran, []string{"1"}), true)
+	count, err := locks.Find(nil).Count()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 1, "the lock of the other instance is kept")
+
+	test.Fatal(t, locks.RemoveId("lock"), nil)
+	ids, err = migrator.Up(context.Background())
+	test.Fatal(t, err, nil)
+	test.Fatal(t, reflect.DeepEqual(ids, []string{"2"}), true)
+	count, err = locks.Find(nil).Count()
+	test.Fatal(t, err, nil)
+	test.Fatal(t, count, 0, "the lock is released")
+}
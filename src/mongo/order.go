@@ -0,0 +1,199 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// relationOrder sorts and limits the documents of a resolved referenceMany relation.
+// sort holds field names of the related document, a field name prefixed with a dash (-)
+// is sorted in descending order.
+type relationOrder struct {
+	sort  []string
+	limit int
+}
+
+// keys returns the sort fields as mongodb keys
+func (order relationOrder) keys(meta metadata) []string {
+	keys := []string{}
+	for _, name := range order.sort {
+		prefix := ""
+		if strings.HasPrefix(name, "-") {
+			prefix, name = "-", name[1:]
+		}
+		if f, ok := meta.findField(name); ok {
+			name = f.key
+		}
+		keys = append(keys, prefix+name)
+	}
+	return keys
+}
+
+// firstIDs returns the first ids of ids in the order of the related documents,
+// the database sorts and limits them
+func (manager *defaultDocumentManager) firstIDs(meta metadata, order relationOrder, ids []bson.ObjectId) ([]bson.ObjectId, error) {
+	results := docs{}
+	query := manager.find(meta.targetDocument, bson.M{"_id": bson.M{"$in": ids}}).Select(bson.M{"_id": 1})
+	if keys := order.keys(meta); len(keys) > 0 {
+		query = query.Sort(keys...)
+	}
+	if err := query.Limit(order.limit).All(&results); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	return results.getIds(), nil
+}
+
+// firstReferences returns the first references in the order of the related documents. The database sorts and limits
+// them when they reference documents of the collection of meta, otherwise they are sorted and limited once resolved.
+func (manager *defaultDocumentManager) firstReferences(r relation, meta metadata, order relationOrder, references []reference) ([]reference, error) {
+	referencesByID := map[bson.ObjectId]reference{}
+	ids := []bson.ObjectId{}
+	for _, reference := range references {
+		if r.collectionOf(reference) != meta.targetDocument || (reference.database != "" && reference.database != manager.storage.Name()) {
+			return references, nil
+		}
+		referencesByID[reference.id] = reference
+		ids = append(ids, reference.id)
+	}
+	ids, err := manager.firstIDs(meta, order, ids)
+	if err != nil {
+		return nil, err
+	}
+	first := []reference{}
+	for _, id := range ids {
+		first = append(first, referencesByID[id])
+	}
+	return first, nil
+}
+
+// apply sorts a slice of related documents and truncates it to the limit
+func (order relationOrder) apply(slice reflect.Value) {
+	if len(order.sort) > 0 {
+		values := convertValueToArrayOfValues(slice)
+		sort.SliceStable(values, func(i, j int) bool {
+			for _, name := range order.sort {
+				descending := strings.HasPrefix(name, "-")
+				name = strings.TrimPrefix(name, "-")
+				comparison := compareValues(fieldByName(values[i], name), fieldByName(values[j], name))
+				if comparison == 0 {
+					continue
+				}
+				if descending {
+					return comparison > 0
+				}
+				return comparison < 0
+			}
+			return false
+		})
+		sorted := reflect.MakeSlice(slice.Type(), 0, len(values))
+		sorted = reflect.Append(sorted, values...)
+		slice.Set(sorted)
+	}
+	if order.limit > 0 && slice.Len() > order.limit {
+		slice.Set(slice.Slice(0, order.limit))
+	}
+}
+
+// relationOrders are sort and limit overrides for the relations of the queried documents,
+// keyed by field name
+type relationOrders map[string]relationOrder
+
+// get returns the order of the relation annotation of a field, with the sort
+// and the limit of the override if they are set
+func (orders relationOrders) get(f field) relationOrder {
+	order := relationOrder{limit: f.relation.limit}
+	if f.relation.sort != "" {
+		order.sort = []string{f.relation.sort}
+	}
+	if override, ok := orders[f.name]; ok {
+		if override.sort != nil {
+			order.sort = override.sort
+		}
+		if override.limit != 0 {
+			order.limit = override.limit
+		}
+	}
+	return order
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// fieldByName returns the field of a struct or of a pointer to struct,
+// or an invalid value if the pointer is nil
+func fieldByName(value reflect.Value, name string) reflect.Value {
+	if value = reflect.Indirect(value); !value.IsValid() {
+		return value
+	}
+	return value.FieldByName(name)
+}
+
+// compareValues compares 2 values of the same type and returns -1, 0 or 1.
+// invalid and nil values come first.
+func compareValues(a, b reflect.Value) int {
+	a, b = reflect.Indirect(a), reflect.Indirect(b)
+	switch {
+	case !a.IsValid() && !b.IsValid():
+		return 0
+	case !a.IsValid():
+		return -1
+	case !b.IsValid():
+		return 1
+	}
+	switch a.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return compareFloats(float64(a.Int()), float64(b.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return compareFloats(float64(a.Uint()), float64(b.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return compareFloats(a.Float(), b.Float())
+	case reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case reflect.Bool:
+		switch {
+		case a.Bool() == b.Bool():
+			return 0
+		case b.Bool():
+			return -1
+		}
+		return 1
+	case reflect.Struct:
+		if a.Type() == timeType {
+			ta, tb := a.Interface().(time.Time), b.Interface().(time.Time)
+			switch {
+			case ta.Before(tb):
+				return -1
+			case ta.After(tb):
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
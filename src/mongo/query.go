@@ -15,9 +15,9 @@
 package mongo
 
 import (
+	"context"
 	"reflect"
 
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
@@ -29,6 +29,11 @@ type queryBuilder interface {
 	// @see https://docs.mongodb.com/manual/reference/operator/query/#query-selectors
 	Find(query interface{}) queryBuilder
 
+	// Where adds a condition on a field path to the query. The path is made of struct field
+	// names separated by dots and can go through relations, like "Author.Name".
+	// Conditions are and-ed with the query of Find.
+	Where(path string) queryCondition
+
 	// Sort asks the database to order returned documents according to the
 	// provided field names
 	// @see http://www.mongodb.org/display/DOCS/Sorting+and+Natural+Order
@@ -40,12 +45,33 @@ type queryBuilder interface {
 	// Skip skips over the n initial documents from the query results.
 	Skip(int) queryBuilder
 
+	// SortRelation orders the documents of the referenceMany relation field of the
+	// queried documents according to the provided field names of the related document,
+	// it overrides the sort parameter of the relation annotation.
+	// @see Sort
+	SortRelation(field string, fields ...string) queryBuilder
+
+	// LimitRelation restricts the maximum number of documents of the referenceMany relation field
+	// of the queried documents to n, it overrides the limit parameter of the relation annotation.
+	// A negative n removes the limit.
+	LimitRelation(field string, n int) queryBuilder
+
 	// Select enables selecting which fields should be retrieved for the results
 	// found.
 	// @param query map[string]interface{} | bson.M
 	// @see http://www.mongodb.org/display/DOCS/Retrieving+a+Subset+of+Fields
 	Select(query interface{}) queryBuilder
 
+	// Context binds the query to ctx : the deadline of ctx is propagated to the database
+	// and the resolution of the relations of the results stops once ctx is done.
+	Context(ctx context.Context) queryBuilder
+
+	// WithDeleted includes the soft deleted documents in the result set, they are excluded by default
+	WithDeleted() queryBuilder
+
+	// OnlyDeleted restricts the result set to the soft deleted documents
+	OnlyDeleted() queryBuilder
+
 	// Count returns the total number of documents in the result set.
 	Count(targetDocument string) (int, error)
 
@@ -66,6 +92,10 @@ type defaultQueryBuilder struct {
 	selection       interface{}
 	limit, skip     int
 	order           []string
+	relationOrders  relationOrders
+	criteria        []criterion
+	// err is the error of binding the query to a context, returned when the query is run
+	err error
 }
 
 func newDefaultQueryBuilder(documentManager *defaultDocumentManager) queryBuilder {
@@ -77,6 +107,10 @@ func (qb *defaultQueryBuilder) Find(query interface{}) queryBuilder {
 	return qb
 }
 
+func (qb *defaultQueryBuilder) Where(path string) queryCondition {
+	return defaultQueryCondition{queryBuilder: qb, path: path}
+}
+
 func (qb *defaultQueryBuilder) Limit(limit int) queryBuilder {
 	qb.limit = limit
 	return qb
@@ -92,17 +126,56 @@ func (qb *defaultQueryBuilder) Select(fieldSelection interface{}) queryBuilder {
 	return qb
 }
 
+func (qb *defaultQueryBuilder) Context(ctx context.Context) queryBuilder {
+	qb.documentManager = qb.documentManager.withContext(ctx)
+	qb.err = qb.documentManager.ensureTenantIndexes()
+	return qb
+}
+
+func (qb *defaultQueryBuilder) WithDeleted() queryBuilder {
+	qb.documentManager = qb.documentManager.withSoftDeleteMode(withDeleted)
+	return qb
+}
+
+func (qb *defaultQueryBuilder) OnlyDeleted() queryBuilder {
+	qb.documentManager = qb.documentManager.withSoftDeleteMode(onlyDeleted)
+	return qb
+}
+
 func (qb *defaultQueryBuilder) Sort(fields ...string) queryBuilder {
 	qb.order = fields
 	return qb
 }
 
+func (qb *defaultQueryBuilder) SortRelation(field string, fields ...string) queryBuilder {
+	if qb.relationOrders == nil {
+		qb.relationOrders = relationOrders{}
+	}
+	order := qb.relationOrders[field]
+	order.sort = append([]string{}, fields...)
+	qb.relationOrders[field] = order
+	return qb
+}
+
+func (qb *defaultQueryBuilder) LimitRelation(field string, limit int) queryBuilder {
+	if qb.relationOrders == nil {
+		qb.relationOrders = relationOrders{}
+	}
+	order := qb.relationOrders[field]
+	order.limit = limit
+	qb.relationOrders[field] = order
+	return qb
+}
+
 func (qb *defaultQueryBuilder) One(document interface{}) error {
 	meta, err := qb.documentManager.metadatas.getMetadatas(reflect.TypeOf(document))
 	if err != nil {
 		return ErrDocumentNotRegistered
 	}
-	query := qb.buildQuery(meta.targetDocument)
+	query, err := qb.buildQuery(meta)
+	if err != nil {
+		return err
+	}
 	if err := query.One(document); err != nil {
 		return err
 	}
@@ -110,11 +183,16 @@ func (qb *defaultQueryBuilder) One(document interface{}) error {
 	if qb.selection != nil {
 		fields = qb.buildFieldListFromProjection(qb.selection)
 	}
-	return qb.documentManager.resolveRelations(document, fields...)
+	return qb.documentManager.resolveRelations(document, qb.relationOrders, fields...)
 }
 
 func (qb *defaultQueryBuilder) Count(targetDocument string) (int, error) {
-	q := qb.buildQuery(targetDocument)
+	meta, _ := qb.documentManager.metadatas.findMetadataByCollectionName(targetDocument)
+	meta.targetDocument = targetDocument
+	q, err := qb.buildQuery(meta)
+	if err != nil {
+		return 0, err
+	}
 	return q.Count()
 }
 func (qb *defaultQueryBuilder) All(documents interface{}) error {
@@ -128,7 +206,10 @@ func (qb *defaultQueryBuilder) All(documents interface{}) error {
 	if err != nil {
 		return ErrDocumentNotRegistered
 	}
-	query := qb.buildQuery(meta.targetDocument)
+	query, err := qb.buildQuery(meta)
+	if err != nil {
+		return err
+	}
 	if err := query.All(documents); err != nil {
 		return err
 	}
@@ -136,7 +217,7 @@ func (qb *defaultQueryBuilder) All(documents interface{}) error {
 	if qb.selection != nil {
 		fields = qb.buildFieldListFromProjection(qb.selection)
 	}
-	return qb.documentManager.resolveRelations(documents, fields...)
+	return qb.documentManager.resolveRelations(documents, qb.relationOrders, fields...)
 }
 
 func (qb *defaultQueryBuilder) buildFieldListFromProjection(projection interface{}) []string {
@@ -166,8 +247,15 @@ func (qb *defaultQueryBuilder) buildFieldListFromProjection(projection interface
 	return fields
 }
 
-func (qb *defaultQueryBuilder) buildQuery(collectionName string) *mgo.Query {
-	q := qb.documentManager.GetDB().C(collectionName).Find(qb.query)
+func (qb *defaultQueryBuilder) buildQuery(meta metadata) (Query, error) {
+	if qb.err != nil {
+		return nil, qb.err
+	}
+	filter, err := qb.buildFilter(meta)
+	if err != nil {
+		return nil, err
+	}
+	q := qb.documentManager.find(meta.targetDocument, filter)
 	if qb.limit > 0 {
 		q = q.Limit(qb.limit)
 	}
@@ -183,5 +271,5 @@ func (qb *defaultQueryBuilder) buildQuery(collectionName string) *mgo.Query {
 		q = q.Select(qb.selection)
 	}
 
-	return q
+	return q, nil
 }
@@ -0,0 +1,247 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"reflect"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// storeAs defines how a reference to a related document is stored
+type storeAs int
+
+const (
+	// storeAsID stores the ObjectId of the related document
+	storeAsID storeAs = iota
+	// storeAsDBRef stores a DBRef { $ref, $id }
+	storeAsDBRef
+	// storeAsDBRefWithDB stores a DBRef { $ref, $id, $db }
+	storeAsDBRefWithDB
+)
+
+func (s storeAs) String() string {
+	switch s {
+	case storeAsDBRef:
+		return "dbRef"
+	case storeAsDBRefWithDB:
+		return "dbRefWithDB"
+	}
+	return "id"
+}
+
+// queryKey returns the key to query in order to match the id of a reference stored in key
+func (r relation) queryKey(key string) string {
+	if r.storeAs == storeAsID {
+		return key
+	}
+	return key + ".$id"
+}
+
+// referenceValue returns the value stored for a reference to the document with id
+// stored in the collection named targetDocument
+func (manager *defaultDocumentManager) referenceValue(r relation, targetDocument string, id bson.ObjectId) interface{} {
+	switch r.storeAs {
+	case storeAsDBRef:
+		return mgo.DBRef{Collection: targetDocument, Id: id}
+	case storeAsDBRefWithDB:
+		return mgo.DBRef{Collection: targetDocument, Id: id, Database: manager.storage.Name()}
+	}
+	return id
+}
+
+// referenceTargetDocument returns the collection a related document is stored in,
+// a DBRef references the actual type of the related document.
+func (manager *defaultDocumentManager) referenceTargetDocument(r relation, related reflect.Value) string {
+	if meta, ok := manager.metadatas[related.Type()]; ok && r.storeAs != storeAsID {
+		return meta.targetDocument
+	}
+	return r.targetDocument
+}
+
+// relatedDocument returns the document held by a relation field, or by an element of a referenceMany field,
+// with the metadata of its type if it is registered and meta otherwise : a DBRef may reference documents of several types
+func (manager *defaultDocumentManager) relatedDocument(meta metadata, value reflect.Value) (reflect.Value, metadata, bool) {
+	if value.Kind() == reflect.Interface {
+		value = value.Elem()
+	}
+	if !value.IsValid() || value.Kind() != reflect.Ptr || value.IsNil() {
+		return value, meta, false
+	}
+	if actual, ok := manager.metadatas[value.Type()]; ok {
+		meta = actual
+	}
+	return value, meta, true
+}
+
+// reference is a stored reference, collection and database are only known for DBRefs
+type reference struct {
+	id         bson.ObjectId
+	collection string
+	database   string
+}
+
+// referenceOf extracts a stored reference, whatever its storage format
+func referenceOf(value interface{}) (reference, bool) {
+	switch value := value.(type) {
+	case bson.ObjectId:
+		return reference{id: value}, true
+	case bson.M:
+		return referenceOf(map[string]interface{}(value))
+	case map[string]interface{}:
+		id, ok := value["$id"].(bson.ObjectId)
+		collection, _ := value["$ref"].(string)
+		database, _ := value["$db"].(string)
+		return reference{id, collection, database}, ok
+	case bson.D:
+		return referenceOf(value.Map())
+	case mgo.DBRef:
+		id, ok := value.Id.(bson.ObjectId)
+		return reference{id, value.Collection, value.Database}, ok
+	case *mgo.DBRef:
+		if value != nil {
+			return referenceOf(*value)
+		}
+	}
+	return reference{}, false
+}
+
+// referencesOf extracts an array of stored references
+func referencesOf(value interface{}) (result []reference) {
+	values, _ := value.([]interface{})
+	for _, value := range values {
+		if reference, ok := referenceOf(value); ok {
+			result = append(result, reference)
+		}
+	}
+	return
+}
+
+// referenceID extracts the ObjectId of a stored reference, whatever its storage format
+func referenceID(value interface{}) (bson.ObjectId, bool) {
+	reference, ok := referenceOf(value)
+	return reference.id, ok
+}
+
+// referenceIDs extracts the ObjectIds of an array of stored references
+func referenceIDs(value interface{}) (ids []bson.ObjectId) {
+	for _, reference := range referencesOf(value) {
+		ids = append(ids, reference.id)
+	}
+	return
+}
+
+// collectionOf returns the collection a reference of the relation r points to
+func (r relation) collectionOf(reference reference) string {
+	if reference.collection != "" {
+		return reference.collection
+	}
+	return r.targetDocument
+}
+
+// isForeign returns true if the reference is a DBRef to a document of another database
+func (manager *defaultDocumentManager) isForeign(reference reference) bool {
+	return reference.database != "" && reference.database != manager.storage.Name()
+}
+
+// fetchReferences fetches the documents referenced by a relation. A DBRef may reference another collection
+// than the target document of the relation, so the documents are fetched by collection,
+// a DBRef to another database fails with ErrForeignDatabaseReference.
+// It returns the documents keyed by id and the slices of the documents fetched, one by collection.
+func (manager *defaultDocumentManager) fetchReferences(r relation, references []reference) (map[bson.ObjectId]reflect.Value, []interface{}, error) {
+	idsByCollection := map[string][]bson.ObjectId{}
+	collections := []string{}
+	for _, reference := range references {
+		if manager.isForeign(reference) {
+			return nil, nil, ErrForeignDatabaseReference
+		}
+		collection := r.collectionOf(reference)
+		if _, ok := idsByCollection[collection]; !ok {
+			collections = append(collections, collection)
+		}
+		idsByCollection[collection] = append(idsByCollection[collection], reference.id)
+	}
+	documents := map[bson.ObjectId]reflect.Value{}
+	slices := []interface{}{}
+	for _, collection := range collections {
+		meta, Type := manager.metadatas.findMetadataByCollectionName(collection)
+		if Type == nil {
+			return nil, nil, ErrDocumentNotRegistered
+		}
+		slice := reflect.New(reflect.SliceOf(Type))
+		if err := manager.find(collection, bson.M{"_id": bson.M{"$in": idsByCollection[collection]}}).All(slice.Interface()); err != nil && err != ErrNotFound {
+			return nil, nil, err
+		}
+		for i := 0; i < slice.Elem().Len(); i++ {
+			value := slice.Elem().Index(i)
+			documents[value.Elem().FieldByName(meta.idField).Interface().(bson.ObjectId)] = value
+		}
+		if slice.Elem().Len() > 0 {
+			slices = append(slices, slice.Interface())
+		}
+	}
+	return documents, slices, nil
+}
+
+// hiddenReferences are the stored references of the referenceMany fields of loaded documents which related documents
+// aren't exposed by the field : past the limit of the relation, soft deleted, filtered out or not found.
+// They are keyed by document then by field name, and written back when the document is persisted,
+// so that loading then persisting a document never loses its references.
+type hiddenReferences map[interface{}]map[string][]reference
+
+// hide records the stored references of the field of document which are not exposed, stored being all the stored references
+func (hidden hiddenReferences) hide(document interface{}, field string, stored []reference, exposed map[bson.ObjectId]bool) {
+	references := []reference{}
+	for _, reference := range stored {
+		if !exposed[reference.id] {
+			references = append(references, reference)
+		}
+	}
+	if len(references) == 0 {
+		if fields, ok := hidden[document]; ok {
+			delete(fields, field)
+		}
+		return
+	}
+	if _, ok := hidden[document]; !ok {
+		hidden[document] = map[string][]reference{}
+	}
+	hidden[document][field] = references
+}
+
+// of returns the hidden references of the field of document which are not in ids
+func (hidden hiddenReferences) of(document interface{}, field string, ids []bson.ObjectId) (references []reference) {
+	persisted := map[bson.ObjectId]bool{}
+	for _, id := range ids {
+		persisted[id] = true
+	}
+	for _, reference := range hidden[document][field] {
+		if !persisted[reference.id] {
+			references = append(references, reference)
+		}
+	}
+	return
+}
+
+// storedValue returns the value stored for an existing reference of the relation r
+func (manager *defaultDocumentManager) storedValue(r relation, reference reference) interface{} {
+	value := manager.referenceValue(r, r.collectionOf(reference), reference.id)
+	if dbRef, ok := value.(mgo.DBRef); ok && r.storeAs == storeAsDBRefWithDB && reference.database != "" {
+		dbRef.Database = reference.database
+		return dbRef
+	}
+	return value
+}
@@ -0,0 +1,395 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// SchemaManager manages the indexes of the collections of the registered documents
+type SchemaManager interface {
+	// EnsureIndexes creates the indexes defined in the metadata of every registered document,
+	// even if they were already ensured. It should be called once at startup, after the documents are registered.
+	EnsureIndexes() error
+
+	// DiffIndexes compares the indexes defined in the metadata with the indexes of the database
+	DiffIndexes() ([]IndexDiff, error)
+
+	// SyncIndexes creates missing indexes, recreates changed indexes and
+	// drops the indexes that are not defined in the metadata if dropExtra is true
+	SyncIndexes(dropExtra bool) error
+
+	// CreateCollections creates the collections of the registered documents that don't exist yet,
+	// with the options given to DocumentManager.RegisterWithOptions
+	CreateCollections() error
+
+	// JSONSchema returns the $jsonSchema generated from the metadata of a registered document type
+	JSONSchema(document interface{}) (bson.M, error)
+
+	// DiffValidators compares the validators of the collections with the $jsonSchema generated from the metadata
+	DiffValidators() ([]ValidatorDiff, error)
+
+	// ApplyValidators sets the generated $jsonSchema as the validator of the collections with collMod
+	ApplyValidators() error
+
+	// ValidateMappings returns the relations of the registered documents which target document
+	// is not registered or which mappedBy field can't be found
+	ValidateMappings() []error
+
+	// DescribeDocuments describes the mapping of the registered documents
+	DescribeDocuments() []DocumentDescription
+}
+
+// DocumentDescription describes the mapping of a registered document type
+type DocumentDescription struct {
+	Collection string             `json:"collection" yaml:"collection"`
+	Type       string             `json:"type" yaml:"type"`
+	IDField    string             `json:"idField" yaml:"idField"`
+	Fields     []FieldDescription `json:"fields" yaml:"fields"`
+	Indexes    []string           `json:"indexes,omitempty" yaml:"indexes,omitempty"`
+}
+
+// FieldDescription describes the mapping of a struct field
+type FieldDescription struct {
+	Name      string `json:"name" yaml:"name"`
+	Key       string `json:"key" yaml:"key"`
+	Type      string `json:"type" yaml:"type"`
+	Omitempty bool   `json:"omitempty,omitempty" yaml:"omitempty,omitempty"`
+	Ignore    bool   `json:"ignore,omitempty" yaml:"ignore,omitempty"`
+	Relation  string `json:"relation,omitempty" yaml:"relation,omitempty"`
+}
+
+// IndexDiff lists the differences between the indexes of a collection and its metadata
+type IndexDiff struct {
+	// Collection is the name of the collection
+	Collection string
+	// Missing are the indexes defined in the metadata that don't exist in the collection
+	Missing []Index
+	// Extra are the indexes of the collection that are not defined in the metadata
+	Extra []Index
+	// Changed are the indexes which options differ
+	Changed []IndexChange
+}
+
+// IsEmpty returns true if the collection indexes match the metadata
+func (diff IndexDiff) IsEmpty() bool {
+	return len(diff.Missing) == 0 && len(diff.Extra) == 0 && len(diff.Changed) == 0
+}
+
+func (diff IndexDiff) String() string {
+	result := fmt.Sprintf("collection '%s' :", diff.Collection)
+	for _, index := range diff.Missing {
+		result += fmt.Sprintf("\n\t+ %s", indexToString(index))
+	}
+	for _, index := range diff.Extra {
+		result += fmt.Sprintf("\n\t- %s", indexToString(index))
+	}
+	for _, change := range diff.Changed {
+		result += fmt.Sprintf("\n\t~ %s => %s", indexToString(change.Current), indexToString(change.Wanted))
+	}
+	return result
+}
+
+// IndexChange is an index which options differ from its definition
+type IndexChange struct {
+	// Current is the index in the database
+	Current Index
+	// Wanted is the index as defined in the metadata
+	Wanted Index
+}
+
+type defaultSchemaManager struct {
+	documentManager *defaultDocumentManager
+	// ensured are the types which indexes have been ensured, by tenant
+	ensured *ensuredTypes
+}
+
+func newDefaultSchemaManager(documentManager *defaultDocumentManager) *defaultSchemaManager {
+	return &defaultSchemaManager{documentManager: documentManager, ensured: newEnsuredTypes()}
+}
+
+// ensuredTypes is a set of types by tenant, shared by the document managers of a DocumentManagerFactory.
+// The types are ensured in the storage of each tenant of a NewTenantStorage.
+type ensuredTypes struct {
+	sync.Mutex
+	types map[ensuredType]bool
+}
+
+type ensuredType struct {
+	tenant string
+	Type   reflect.Type
+}
+
+func newEnsuredTypes() *ensuredTypes {
+	return &ensuredTypes{types: map[ensuredType]bool{}}
+}
+
+func (ensured *ensuredTypes) has(tenant string, Type reflect.Type) bool {
+	ensured.Lock()
+	defer ensured.Unlock()
+	return ensured.types[ensuredType{tenant, Type}]
+}
+
+func (ensured *ensuredTypes) add(tenant string, Type reflect.Type) {
+	ensured.Lock()
+	defer ensured.Unlock()
+	ensured.types[ensuredType{tenant, Type}] = true
+}
+
+// tenant returns the tenant of the storage of the document manager, an empty string if the storage
+// isn't a NewTenantStorage
+func (schemaManager *defaultSchemaManager) tenant() string {
+	if storage, ok := schemaManager.documentManager.storage.(*tenantStorage); ok {
+		return storage.tenant
+	}
+	return ""
+}
+
+func (schemaManager *defaultSchemaManager) EnsureIndexes() error {
+	return schemaManager.ensureIndexes(false)
+}
+
+// ensureIndexes creates the indexes of the registered types, if cached is true the types which indexes
+// were already ensured in the storage of the tenant are skipped
+func (schemaManager *defaultSchemaManager) ensureIndexes(cached bool) error {
+	for _, meta := range schemaManager.sortedMetadatas() {
+		if cached && schemaManager.ensured.has(schemaManager.tenant(), meta.structType) {
+			continue
+		}
+		if err := schemaManager.ensureIndexesFor(meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureIndexesFor creates the indexes of a type and of the join collections of its through relations
+func (schemaManager *defaultSchemaManager) ensureIndexesFor(meta metadata) error {
+	for _, index := range meta.getAllIndexes() {
+		if err := schemaManager.documentManager.collection(meta.targetDocument).CreateIndex(index); err != nil {
+			return err
+		}
+	}
+	for _, through := range schemaManager.joinCollections(meta) {
+		for _, index := range schemaManager.documentManager.linkIndexes(through) {
+			if err := schemaManager.documentManager.collection(through).CreateIndex(index); err != nil {
+				return err
+			}
+		}
+	}
+	schemaManager.ensured.add(schemaManager.tenant(), meta.structType)
+	return nil
+}
+
+// joinCollections returns the join collections of the through relations of the types in metas
+func (schemaManager *defaultSchemaManager) joinCollections(metas ...metadata) []string {
+	collections := []string{}
+	seen := map[string]bool{}
+	for _, meta := range metas {
+		for _, field := range meta.getFieldsWithRelation() {
+			if through := field.relation.through; through != "" && field.relation.mapped != mappedBy && !seen[through] {
+				seen[through] = true
+				collections = append(collections, through)
+			}
+		}
+	}
+	sort.Strings(collections)
+	return collections
+}
+
+// indexedCollection is a collection and the indexes it should have
+type indexedCollection struct {
+	name    string
+	indexes []Index
+	// meta is the metadata of the documents of the collection, if they are registered
+	meta *metadata
+}
+
+// indexedCollections returns the collections of the registered types, with the indexes of their links
+// if they are association documents, followed by the join collections which aren't registered
+func (schemaManager *defaultSchemaManager) indexedCollections() []indexedCollection {
+	collections := []indexedCollection{}
+	metas := schemaManager.sortedMetadatas()
+	for i, meta := range metas {
+		indexes := append(meta.getAllIndexes(), schemaManager.documentManager.linkIndexes(meta.targetDocument)...)
+		collections = append(collections, indexedCollection{meta.targetDocument, indexes, &metas[i]})
+	}
+	for _, through := range schemaManager.joinCollections(metas...) {
+		if _, Type := schemaManager.documentManager.metadatas.findMetadataByCollectionName(through); Type == nil {
+			collections = append(collections, indexedCollection{through, schemaManager.documentManager.linkIndexes(through), nil})
+		}
+	}
+	return collections
+}
+
+func (schemaManager *defaultSchemaManager) DiffIndexes() ([]IndexDiff, error) {
+	diffs := []IndexDiff{}
+	for _, collection := range schemaManager.indexedCollections() {
+		diff, err := schemaManager.diffIndexesFor(collection)
+		if err != nil {
+			return diffs, err
+		}
+		diffs = append(diffs, diff)
+	}
+	return diffs, nil
+}
+
+func (schemaManager *defaultSchemaManager) diffIndexesFor(indexed indexedCollection) (IndexDiff, error) {
+	diff := IndexDiff{Collection: indexed.name}
+	current, err := schemaManager.documentManager.collection(indexed.name).Indexes()
+	if err != nil && !isNamespaceNotFound(err) {
+		return diff, err
+	}
+	currentByKey := map[string]Index{}
+	for _, index := range current {
+		currentByKey[indexKey(index)] = index
+	}
+	wantedByKey := map[string]bool{}
+	for _, index := range indexed.indexes {
+		key := indexKey(index)
+		wantedByKey[key] = true
+		if currentIndex, ok := currentByKey[key]; !ok {
+			diff.Missing = append(diff.Missing, index)
+		} else if !indexOptionsEqual(currentIndex, index) {
+			diff.Changed = append(diff.Changed, IndexChange{Current: currentIndex, Wanted: index})
+		}
+	}
+	for _, index := range current {
+		if index.Name == "_id_" || wantedByKey[indexKey(index)] {
+			continue
+		}
+		diff.Extra = append(diff.Extra, index)
+	}
+	return diff, nil
+}
+
+func (schemaManager *defaultSchemaManager) SyncIndexes(dropExtra bool) error {
+	for _, indexed := range schemaManager.indexedCollections() {
+		diff, err := schemaManager.diffIndexesFor(indexed)
+		if err != nil {
+			return err
+		}
+		collection := schemaManager.documentManager.collection(indexed.name)
+		for _, change := range diff.Changed {
+			if err = collection.DropIndexName(change.Current.Name); err != nil {
+				return err
+			}
+			if err = collection.CreateIndex(change.Wanted); err != nil {
+				return err
+			}
+		}
+		for _, index := range diff.Missing {
+			if err = collection.CreateIndex(index); err != nil {
+				return err
+			}
+		}
+		if dropExtra {
+			for _, index := range diff.Extra {
+				if err = collection.DropIndexName(index.Name); err != nil {
+					return err
+				}
+			}
+		}
+		schemaManager.documentManager.log(fmt.Sprintf("Synchronized indexes of %s", diff))
+		if indexed.meta != nil {
+			schemaManager.ensured.add(schemaManager.tenant(), indexed.meta.structType)
+		}
+	}
+	return nil
+}
+
+func (schemaManager *defaultSchemaManager) ValidateMappings() []error {
+	errors := []error{}
+	for _, meta := range schemaManager.sortedMetadatas() {
+		for _, field := range meta.getFieldsWithRelation() {
+			if err := schemaManager.documentManager.checkRelationMapping(meta, field); err != nil {
+				errors = append(errors, err)
+			}
+		}
+	}
+	return errors
+}
+
+func (schemaManager *defaultSchemaManager) DescribeDocuments() []DocumentDescription {
+	descriptions := []DocumentDescription{}
+	for _, meta := range schemaManager.sortedMetadatas() {
+		description := DocumentDescription{Collection: meta.targetDocument, Type: meta.structType.String(),
+			IDField: meta.idField}
+		for _, field := range meta.fields {
+			fieldDescription := FieldDescription{Name: field.name, Key: field.key, Omitempty: field.omitempty, Ignore: field.ignore}
+			if structField, ok := meta.structType.Elem().FieldByName(field.name); ok {
+				fieldDescription.Type = structField.Type.String()
+			}
+			if field.hasRelation() {
+				fieldDescription.Relation = field.relation.String()
+			}
+			description.Fields = append(description.Fields, fieldDescription)
+		}
+		for _, index := range meta.getAllIndexes() {
+			description.Indexes = append(description.Indexes, indexToString(index))
+		}
+		descriptions = append(descriptions, description)
+	}
+	return descriptions
+}
+
+// sortedMetadatas returns the registered metadatas sorted by collection name
+func (schemaManager *defaultSchemaManager) sortedMetadatas() []metadata {
+	metas := []metadata{}
+	for _, meta := range schemaManager.documentManager.metadatas {
+		metas = append(metas, meta)
+	}
+	sort.Slice(metas, func(i, j int) bool { return metas[i].targetDocument < metas[j].targetDocument })
+	return metas
+}
+
+// indexKey identifies an index by its keys
+func indexKey(index Index) string {
+	return strings.Join(index.Key, ",")
+}
+
+func indexToString(index Index) string {
+	options := []string{}
+	if index.Name != "" {
+		options = append(options, "name:"+index.Name)
+	}
+	if index.Unique {
+		options = append(options, "unique")
+	}
+	if index.Sparse {
+		options = append(options, "sparse")
+	}
+	if index.ExpireAfter > 0 {
+		options = append(options, "expireAfter:"+index.ExpireAfter.String())
+	}
+	if index.PartialFilter != nil {
+		options = append(options, fmt.Sprintf("partialFilter:%v", index.PartialFilter))
+	}
+	return fmt.Sprintf("[%s] %s", indexKey(index), strings.Join(options, ","))
+}
+
+// isNamespaceNotFound returns true if the error is yielded because a collection doesn't exist
+func isNamespaceNotFound(err error) bool {
+	if hasErrorCode(err, 26) {
+		return true
+	}
+	return strings.Contains(err.Error(), "ns not found") || strings.Contains(err.Error(), "ns does not exist")
+}
@@ -0,0 +1,121 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// softDeleteMode selects the soft deleted documents a document manager finds
+type softDeleteMode int
+
+const (
+	withoutDeleted softDeleteMode = iota
+	withDeleted
+	onlyDeleted
+)
+
+// notDeleted are the values of the softDelete field of a document which isn't soft deleted
+var notDeleted = []interface{}{nil, time.Time{}}
+
+// softDeleteFilter returns the condition on the softDelete field of meta, nil if meta has no softDelete field
+// or if the document manager finds every document
+func (manager *defaultDocumentManager) softDeleteFilter(meta metadata) bson.M {
+	if meta.softDelete == "" {
+		return nil
+	}
+	field, _ := meta.findField(meta.softDelete)
+	switch manager.softDeleteMode {
+	case withoutDeleted:
+		return bson.M{field.key: bson.M{"$in": notDeleted}}
+	case onlyDeleted:
+		return bson.M{field.key: bson.M{"$nin": notDeleted}}
+	}
+	return nil
+}
+
+func (manager *defaultDocumentManager) WithDeleted() DocumentManager {
+	return manager.withSoftDeleteMode(withDeleted)
+}
+
+func (manager *defaultDocumentManager) OnlyDeleted() DocumentManager {
+	return manager.withSoftDeleteMode(onlyDeleted)
+}
+
+// withSoftDeleteMode returns a copy of the document manager finding the soft deleted documents selected by mode,
+// the copy shares the registered documents and the pending tasks of manager
+func (manager *defaultDocumentManager) withSoftDeleteMode(mode softDeleteMode) *defaultDocumentManager {
+	view := *manager
+	view.softDeleteMode = mode
+	view.release = nil
+	return &view
+}
+
+func (manager *defaultDocumentManager) Restore(document interface{}) {
+	manager.tasks[document] = restore
+}
+
+// softRemove sets the softDelete field of a document to the current time instead of removing the document
+func (manager *defaultDocumentManager) softRemove(document interface{}, meta metadata, id interface{}) error {
+	// mongodb stores times with a millisecond precision
+	now := time.Now().Truncate(time.Millisecond)
+	field, _ := meta.findField(meta.softDelete)
+	if err := manager.collection(meta.targetDocument).Update(bson.M{"_id": id}, bson.M{"$set": bson.M{field.key: now}}); err != nil {
+		return err
+	}
+	setSoftDelete(document, meta, &now)
+	manager.log(fmt.Sprintf("Soft deleted document with id '%s' from collection '%s' ", id, meta.targetDocument))
+	return nil
+}
+
+// doRestore resets the softDelete field of a soft deleted document
+func (manager *defaultDocumentManager) doRestore(document interface{}, meta metadata) error {
+	if meta.softDelete == "" {
+		return ErrSoftDeleteNotMapped
+	}
+	id, err := manager.metadatas.getDocumentID(document)
+	if err != nil {
+		return err
+	}
+	if err = manager.checkVisible(meta, id); err != nil {
+		return err
+	}
+	field, _ := meta.findField(meta.softDelete)
+	Field, _ := meta.structType.Elem().FieldByName(meta.softDelete)
+	if err = manager.collection(meta.targetDocument).Update(bson.M{"_id": id},
+		bson.M{"$set": bson.M{field.key: reflect.Zero(Field.Type).Interface()}}); err != nil {
+		return err
+	}
+	setSoftDelete(document, meta, nil)
+	manager.log(fmt.Sprintf("Restored document with id '%s' from collection '%s' ", id, meta.targetDocument))
+	return nil
+}
+
+// setSoftDelete sets the softDelete field of document to deletedAt, or to its zero value if deletedAt is nil
+func setSoftDelete(document interface{}, meta metadata, deletedAt *time.Time) {
+	Field := reflect.ValueOf(document).Elem().FieldByName(meta.softDelete)
+	switch {
+	case deletedAt == nil:
+		Field.Set(reflect.Zero(Field.Type()))
+	case Field.Type() == timeType:
+		Field.Set(reflect.ValueOf(*deletedAt))
+	default:
+		Field.Set(reflect.ValueOf(deletedAt))
+	}
+}
@@ -0,0 +1,156 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+
+	"gopkg.in/mgo.v2"
+)
+
+// Storage is the database the documents are stored in, it adapts a mongodb driver.
+// Documents, queries and results are encoded with gopkg.in/mgo.v2/bson whatever the driver,
+// so the bson struct tags of the documents are read the same way.
+//
+// NewMgoStorage adapts gopkg.in/mgo.v2, the mongodriver package adapts go.mongodb.org/mongo-driver.
+type Storage interface {
+	// Name returns the name of the database
+	Name() string
+	// C returns the collection named name, with the read preference and
+	// the write concern of options if options is not nil
+	C(name string, options *CollectionOptions) Collection
+	// Run runs a database command and decodes its result in result if result is not nil
+	Run(command interface{}, result interface{}) error
+	// CollectionNames returns the names of the collections of the database
+	CollectionNames() ([]string, error)
+	// WithContext returns a copy of the storage which operations are bound to ctx,
+	// they fail with the error of ctx once it is done and the deadline of ctx is propagated to the server
+	WithContext(ctx context.Context) Storage
+}
+
+// TransactionalStorage is a Storage supporting multi-document transactions, like the storage of the mongodriver package
+type TransactionalStorage interface {
+	Storage
+	// Transaction runs fn with a storage bound to a transaction, which is committed if fn returns nil
+	// and aborted otherwise. fn is run again when the transaction fails with a transient error,
+	// ErrTransactionsNotSupported is returned if the deployment doesn't support transactions.
+	Transaction(fn func(storage Storage) error) error
+}
+
+// Collection is a collection of a Storage.
+// Methods expecting a single document return ErrNotFound when no document matches.
+type Collection interface {
+	// Name returns the name of the collection
+	Name() string
+	// Find returns a query on the documents matching query
+	Find(query interface{}) Query
+	// FindId returns a query on the document with the id id
+	FindId(id interface{}) Query
+	// Insert inserts documents in bulk
+	Insert(documents ...interface{}) error
+	// Update updates the first document matching selector
+	Update(selector interface{}, update interface{}) error
+	// UpdateAll updates the documents matching selector
+	UpdateAll(selector interface{}, update interface{}) (*ChangeInfo, error)
+	// Upsert updates the first document matching selector or inserts it
+	Upsert(selector interface{}, update interface{}) (*ChangeInfo, error)
+	// UpsertId updates the document with the id id or inserts it
+	UpsertId(id interface{}, update interface{}) (*ChangeInfo, error)
+	// Remove removes the first document matching selector
+	Remove(selector interface{}) error
+	// RemoveId removes the document with the id id
+	RemoveId(id interface{}) error
+	// RemoveAll removes the documents matching selector
+	RemoveAll(selector interface{}) (*ChangeInfo, error)
+	// Aggregate runs an aggregation pipeline and decodes the results in result, a pointer to slice
+	Aggregate(pipeline interface{}, result interface{}) error
+	// CreateIndex creates an index if it doesn't exist
+	CreateIndex(index Index) error
+	// Indexes returns the indexes of the collection
+	Indexes() ([]Index, error)
+	// DropIndexName drops the index named name
+	DropIndexName(name string) error
+}
+
+// Query is a query on the documents of a Collection
+type Query interface {
+	// Select sets the projection of the query
+	Select(selector interface{}) Query
+	// Sort sorts the results by fields, prefixed with a dash (-) for a descending order
+	Sort(fields ...string) Query
+	Skip(n int) Query
+	Limit(n int) Query
+	// Batch sets the number of documents fetched at once by Iter
+	Batch(n int) Query
+	// One decodes the first result in result
+	One(result interface{}) error
+	// All decodes the results in result, a pointer to slice
+	All(result interface{}) error
+	// Count returns the number of results
+	Count() (int, error)
+	// Iter returns an iterator on the results
+	Iter() Iter
+}
+
+// Iter iterates on the results of a Query
+type Iter interface {
+	// Next decodes the next result in result, returns false when the results are exhausted or on error
+	Next(result interface{}) bool
+	// Close closes the iterator and returns the error of the iteration if any
+	Close() error
+}
+
+// ChangeInfo reports the documents changed by an update, an upsert or a remove
+type ChangeInfo struct {
+	// Updated is the number of documents updated
+	Updated int
+	// Removed is the number of documents removed
+	Removed int
+	// Matched is the number of documents matching the selector
+	Matched int
+	// UpsertedId is the id of the document inserted by an upsert
+	UpsertedId interface{}
+}
+
+// errorCoder is implemented by the errors of go.mongodb.org/mongo-driver
+type errorCoder interface {
+	HasErrorCode(code int) bool
+}
+
+// hasErrorCode returns true if err is a server error with one of the codes
+func hasErrorCode(err error, codes ...int) bool {
+	for _, code := range codes {
+		switch err := err.(type) {
+		case *mgo.QueryError:
+			if err.Code == code {
+				return true
+			}
+		case *mgo.LastError:
+			if err.Code == code {
+				return true
+			}
+		case errorCoder:
+			if err.HasErrorCode(code) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isDuplicateKey returns true if err is yielded by a unique index violation
+func isDuplicateKey(err error) bool {
+	return mgo.IsDup(err) || hasErrorCode(err, 11000, 11001, 12582)
+}
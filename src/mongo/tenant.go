@@ -0,0 +1,166 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"context"
+	"sync"
+
+	"gopkg.in/mgo.v2"
+)
+
+// TenantResolver returns the storage of the documents of a tenant, nil for the default storage
+type TenantResolver func(tenant string) Storage
+
+// DatabaseResolver returns a TenantResolver storing the documents of a tenant in the mgo database returned by resolve,
+// nil for the default database
+func DatabaseResolver(resolve func(tenant string) *mgo.Database) TenantResolver {
+	return func(tenant string) Storage {
+		if database := resolve(tenant); database != nil {
+			return NewMgoStorage(database)
+		}
+		return nil
+	}
+}
+
+type tenantKey struct{}
+
+// WithTenant returns a copy of ctx carrying tenant, the operations bound to it use the storage of tenant
+// when the storage of the document manager is a NewTenantStorage
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant carried by ctx
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenant, ok := ctx.Value(tenantKey{}).(string)
+	return tenant, ok
+}
+
+// tenantStorage routes the operations of a tenant to the storage returned by a TenantResolver
+type tenantStorage struct {
+	// Storage is the storage of the tenant
+	Storage
+	defaultStorage Storage
+	tenants        *tenantStorages
+	tenant         string
+	// copied is true when defaultStorage is a copy closed by Close
+	copied bool
+}
+
+// tenantStorages are the storages of the tenants resolved once by tenant, shared by the storages bound to a context
+type tenantStorages struct {
+	sync.Mutex
+	resolver TenantResolver
+	storages map[string]Storage
+	// parent are the storages copied by Copy, the storages of a copy are copies of the storages of parent
+	parent *tenantStorages
+}
+
+// NewTenantStorage returns a Storage routing the operations to the storage of a tenant. The tenant of an operation
+// is the tenant of its context, given with WithTenant, or the tenant of the document manager created
+// by DocumentManagerFactory.CreateForTenant. Operations without tenant use storage.
+// The resolver is called once per tenant. The document types and their indexes are shared by the tenants,
+// the indexes are ensured in the storage of a tenant the first time a document manager is bound to the tenant.
+func NewTenantStorage(storage Storage, resolver TenantResolver) Storage {
+	return &tenantStorage{Storage: storage, defaultStorage: storage, tenants: &tenantStorages{resolver: resolver, storages: map[string]Storage{}}}
+}
+
+// storage returns the storage of tenant, nil for the default storage
+func (tenants *tenantStorages) storage(tenant string) Storage {
+	tenants.Lock()
+	defer tenants.Unlock()
+	if storage, ok := tenants.storages[tenant]; ok {
+		return storage
+	}
+	var storage Storage
+	if tenants.parent == nil {
+		storage = tenants.resolver(tenant)
+	} else if storage = tenants.parent.storage(tenant); storage != nil {
+		if copyable, ok := storage.(copyableStorage); ok {
+			storage = copyable.Copy()
+		}
+	}
+	tenants.storages[tenant] = storage
+	return storage
+}
+
+// close closes the copies of the storages of the tenants
+func (tenants *tenantStorages) close() {
+	tenants.Lock()
+	defer tenants.Unlock()
+	for tenant, storage := range tenants.storages {
+		if copyable, ok := storage.(copyableStorage); ok && tenants.parent != nil {
+			copyable.Close()
+		}
+		delete(tenants.storages, tenant)
+	}
+}
+
+// route returns the storage of tenant, or the default storage
+func (storage *tenantStorage) route(tenant string) Storage {
+	if tenant != "" {
+		if tenantStorage := storage.tenants.storage(tenant); tenantStorage != nil {
+			return tenantStorage
+		}
+	}
+	return storage.defaultStorage
+}
+
+func (storage *tenantStorage) WithContext(ctx context.Context) Storage {
+	tenant := storage.tenant
+	if contextTenant, ok := TenantFromContext(ctx); ok {
+		tenant = contextTenant
+	}
+	return &tenantStorage{Storage: storage.route(tenant).WithContext(ctx), defaultStorage: storage.defaultStorage,
+		tenants: storage.tenants, tenant: tenant, copied: storage.copied}
+}
+
+// Copy returns a storage using copies of the default storage and of the storages of the tenants,
+// the storages of the tenants are copied when they are first used
+func (storage *tenantStorage) Copy() Storage {
+	copied := &tenantStorage{defaultStorage: storage.defaultStorage, tenant: storage.tenant,
+		tenants: &tenantStorages{resolver: storage.tenants.resolver, storages: map[string]Storage{}, parent: storage.tenants}}
+	if copyable, ok := storage.defaultStorage.(copyableStorage); ok {
+		copied.defaultStorage, copied.copied = copyable.Copy(), true
+	}
+	copied.Storage = copied.route(copied.tenant)
+	return copied
+}
+
+// Close closes the copies of a storage returned by Copy
+func (storage *tenantStorage) Close() {
+	storage.tenants.close()
+	if copyable, ok := storage.defaultStorage.(copyableStorage); ok && storage.copied {
+		copyable.Close()
+	}
+}
+
+// ensureTenantIndexes ensures the indexes of the registered types in the storage of the tenant
+// the document manager is bound to, once per tenant
+func (manager *defaultDocumentManager) ensureTenantIndexes() error {
+	if manager.schemaManager.tenant() == "" {
+		return nil
+	}
+	return manager.schemaManager.ensureIndexes(true)
+}
+
+// Transaction runs fn in a transaction of the storage of the tenant if it supports transactions
+func (storage *tenantStorage) Transaction(fn func(storage Storage) error) error {
+	if transactional, ok := storage.Storage.(TransactionalStorage); ok {
+		return transactional.Transaction(fn)
+	}
+	return ErrTransactionsNotSupported
+}
@@ -0,0 +1,243 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// A referenceMany relation with a through parameter doesn't store the related ids
+// on the owning document, each link is a document in a join collection :
+//
+//	{ _id: ObjectId(..), "odm:userid": ObjectId(..), "odm:groupid": ObjectId(..) }
+//
+// If through is the name of a registered document, that document is the association
+// document and may carry extra attributes, its referenceOne fields targeting the owning
+// and the related documents define the keys of the link. The links are then managed only
+// through the association documents : persisting or removing an association document adds
+// or removes a link, while persisting the owning document doesn't change its links.
+// Otherwise the links are synchronized with the related documents of the owning document
+// when it is persisted.
+
+// getJoinKeys returns the key holding the owning document id and the key holding
+// the related document id in the join collection of a through relation
+func (manager *defaultDocumentManager) getJoinKeys(meta metadata, field field) (joinKey string, inverseJoinKey string) {
+	joinKey, inverseJoinKey = field.relation.joinKey, field.relation.inverseJoinKey
+	if associationMeta, Type := manager.metadatas.findMetadataByCollectionName(field.relation.through); Type != nil {
+		for _, associationField := range associationMeta.getFieldsWithRelation() {
+			if associationField.relation.relation != referenceOne || associationField.relation.mapped == mappedBy {
+				continue
+			}
+			if joinKey == "" && associationField.relation.targetDocument == meta.targetDocument && associationField.key != inverseJoinKey {
+				joinKey = associationField.key
+			} else if inverseJoinKey == "" && associationField.relation.targetDocument == field.relation.targetDocument && associationField.key != joinKey {
+				inverseJoinKey = associationField.key
+			}
+		}
+	}
+	if joinKey == "" {
+		joinKey = "odm:" + strings.ToLower(meta.targetDocument) + "id"
+	}
+	if inverseJoinKey == "" {
+		inverseJoinKey = "odm:" + strings.ToLower(field.relation.targetDocument) + "id"
+	}
+	return
+}
+
+// persistLinks synchronizes the links of the join collection of a relation without association document
+// with the related ids of the owning document : stale links are removed and missing links are inserted.
+func (manager *defaultDocumentManager) persistLinks(meta metadata, field field, documentID bson.ObjectId, relatedIDs []bson.ObjectId) error {
+	joinKey, inverseJoinKey := manager.getJoinKeys(meta, field)
+	collection := manager.collection(field.relation.through)
+	if _, err := collection.RemoveAll(bson.M{joinKey: documentID, inverseJoinKey: bson.M{"$nin": relatedIDs}}); err != nil {
+		return err
+	}
+	links := docs{}
+	if err := collection.Find(bson.M{joinKey: documentID}).Select(bson.M{"_id": 1, inverseJoinKey: 1}).All(&links); err != nil && err != ErrNotFound {
+		return err
+	}
+	linked := map[bson.ObjectId]bool{}
+	for _, link := range links {
+		if id, ok := link[inverseJoinKey].(bson.ObjectId); ok {
+			linked[id] = true
+		}
+	}
+	missing := []interface{}{}
+	for _, relatedID := range relatedIDs {
+		if linked[relatedID] {
+			continue
+		}
+		missing = append(missing, bson.M{"_id": bson.NewObjectId(), joinKey: documentID, inverseJoinKey: relatedID})
+		linked[relatedID] = true
+	}
+	// the missing links are inserted at once
+	if len(missing) > 0 {
+		if err := collection.Insert(missing...); err != nil {
+			return err
+		}
+	}
+	manager.log(fmt.Sprintf("Persisted links of document with id '%s' in collection '%s'", documentID, field.relation.through))
+	return nil
+}
+
+// linkIndexes returns the indexes of the join collection named through : a compound index on the keys of the links
+// of each through relation, for the lookups of the owning side, and an index on the key of the related documents
+// for the lookups of the inverse side
+func (manager *defaultDocumentManager) linkIndexes(through string) []Index {
+	indexes := []Index{}
+	seen := map[string]bool{}
+	for _, meta := range manager.metadatas {
+		for _, field := range meta.getFieldsWithRelation() {
+			if field.relation.through != through || field.relation.relation != referenceMany || field.relation.mapped == mappedBy {
+				continue
+			}
+			joinKey, inverseJoinKey := manager.getJoinKeys(meta, field)
+			for _, index := range []Index{
+				{Index: mgo.Index{Key: []string{joinKey, inverseJoinKey}}},
+				{Index: mgo.Index{Key: []string{inverseJoinKey}}},
+			} {
+				if !seen[indexKey(index)] {
+					seen[indexKey(index)] = true
+					indexes = append(indexes, index)
+				}
+			}
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexKey(indexes[i]) < indexKey(indexes[j]) })
+	return indexes
+}
+
+// removeLinks removes all the links of a removed document, whether it is the owning side
+// or the inverse side of a through relation
+func (manager *defaultDocumentManager) removeLinks(meta metadata, documentID bson.ObjectId) error {
+	for _, field := range meta.getFieldsWithRelation() {
+		if field.relation.relation != referenceMany {
+			continue
+		}
+		switch {
+		case field.relation.through != "" && field.relation.mapped != mappedBy:
+			joinKey, _ := manager.getJoinKeys(meta, field)
+			if _, err := manager.collection(field.relation.through).RemoveAll(bson.M{joinKey: documentID}); err != nil {
+				return err
+			}
+		case field.relation.mapped == mappedBy:
+			relatedMeta, relatedType := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
+			if relatedType == nil {
+				continue
+			}
+			relatedField, ok := relatedMeta.findField(field.relation.mappedField)
+			if !ok || relatedField.relation.through == "" {
+				continue
+			}
+			_, inverseJoinKey := manager.getJoinKeys(relatedMeta, relatedField)
+			if _, err := manager.collection(relatedField.relation.through).RemoveAll(bson.M{inverseJoinKey: documentID}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveLinks resolves a relation stored in a join collection for a batch of documents.
+// joinKey is the key of the link holding the source document id, inverseJoinKey
+// the key holding the related document id. Unless the relation is sorted, related documents
+// are appended in the order the links were created.
+func (manager *defaultDocumentManager) resolveLinks(field field, order relationOrder, through string, joinKey string, inverseJoinKey string,
+	sourceValuesKeyedBySourceID map[bson.ObjectId]reflect.Value, fetchedDocuments map[bson.ObjectId]interface{}) error {
+
+	relatedMeta, relatedType := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
+	if relatedType == nil {
+		return ErrDocumentNotRegistered
+	}
+	links := docs{}
+	if err := manager.collection(through).Find(bson.M{joinKey: bson.M{"$in": getKeys(sourceValuesKeyedBySourceID)}}).
+		Select(bson.M{joinKey: 1, inverseJoinKey: 1}).Sort("_id").All(&links); err != nil && err != ErrNotFound {
+		return err
+	}
+	relatedIDsBySourceID := map[bson.ObjectId][]bson.ObjectId{}
+	// the links of the owning side are all kept, in order to hide the ones that aren't exposed
+	storedReferencesBySourceID := map[bson.ObjectId][]reference{}
+	relatedIDsToFetch := []bson.ObjectId{}
+	seen := map[bson.ObjectId]bool{}
+	for _, link := range links {
+		sourceID, ok := link[joinKey].(bson.ObjectId)
+		if !ok {
+			continue
+		}
+		relatedID, ok := link[inverseJoinKey].(bson.ObjectId)
+		if !ok {
+			continue
+		}
+		storedReferencesBySourceID[sourceID] = append(storedReferencesBySourceID[sourceID], reference{id: relatedID})
+		if len(order.sort) == 0 && order.limit > 0 && len(relatedIDsBySourceID[sourceID]) >= order.limit {
+			continue
+		}
+		relatedIDsBySourceID[sourceID] = append(relatedIDsBySourceID[sourceID], relatedID)
+	}
+	for sourceID, relatedIDs := range relatedIDsBySourceID {
+		if order.limit > 0 && len(relatedIDs) > order.limit {
+			var err error
+			if relatedIDs, err = manager.firstIDs(relatedMeta, order, relatedIDs); err != nil {
+				return err
+			}
+			relatedIDsBySourceID[sourceID] = relatedIDs
+		}
+		for _, relatedID := range relatedIDs {
+			if _, ok := fetchedDocuments[relatedID]; !ok && !seen[relatedID] {
+				relatedIDsToFetch = append(relatedIDsToFetch, relatedID)
+				seen[relatedID] = true
+			}
+		}
+	}
+	relatedDocuments := reflect.New(reflect.SliceOf(relatedType))
+	if len(relatedIDsToFetch) > 0 {
+		if err := manager.find(relatedMeta.targetDocument, bson.M{"_id": bson.M{"$in": relatedIDsToFetch}}).All(relatedDocuments.Interface()); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	relatedDocumentsByID := map[bson.ObjectId]reflect.Value{}
+	for i := 0; i < relatedDocuments.Elem().Len(); i++ {
+		value := relatedDocuments.Elem().Index(i)
+		relatedDocumentsByID[value.Elem().FieldByName(relatedMeta.idField).Interface().(bson.ObjectId)] = value
+	}
+	for sourceID, value := range sourceValuesKeyedBySourceID {
+		exposed := map[bson.ObjectId]bool{}
+		for _, relatedID := range relatedIDsBySourceID[sourceID] {
+			if document, ok := fetchedDocuments[relatedID]; ok {
+				value.Elem().FieldByName(field.name).Set(reflect.Append(value.Elem().FieldByName(field.name), reflect.ValueOf(document)))
+				exposed[relatedID] = true
+			} else if document, ok := relatedDocumentsByID[relatedID]; ok {
+				value.Elem().FieldByName(field.name).Set(reflect.Append(value.Elem().FieldByName(field.name), document))
+				exposed[relatedID] = true
+			}
+		}
+		if field.relation.mapped != mappedBy {
+			manager.hidden.hide(value.Interface(), field.name, storedReferencesBySourceID[sourceID], exposed)
+		}
+		if len(order.sort) > 0 {
+			order.apply(value.Elem().FieldByName(field.name))
+		}
+	}
+	if relatedDocuments.Elem().Len() == 0 {
+		return nil
+	}
+	return manager.doResolveRelations(relatedDocuments.Interface(), fetchedDocuments, nil)
+}
@@ -0,0 +1,154 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"errors"
+	"fmt"
+)
+
+// PartialFlushError is yielded by a transactional flush when the storage or the deployment doesn't support
+// transactions and the flush, run without transaction, fails. Committed are the operations written before the error,
+// the documents which weren't written stay pending.
+type PartialFlushError struct {
+	Committed []Operation
+	Err       error
+}
+
+func (err *PartialFlushError) Error() string {
+	return fmt.Sprintf("%s (flushed without transaction, %d operation(s) committed)", err.Err, len(err.Committed))
+}
+
+func (err *PartialFlushError) Unwrap() error {
+	return err.Err
+}
+
+func (manager *defaultDocumentManager) SetTransactionalFlush(enabled bool) {
+	manager.transactionalFlush = enabled
+}
+
+func (manager *defaultDocumentManager) Transactional(fn func(documentManager DocumentManager) error) error {
+	_, err := manager.transactional(func(documentManager *defaultDocumentManager) error {
+		return fn(documentManager)
+	})
+	return err
+}
+
+// flushInTransaction flushes the pending tasks in a transaction, they stay pending if the transaction is aborted
+func (manager *defaultDocumentManager) flushInTransaction() (*FlushResult, error) {
+	pending := tasks{}
+	for document, task := range manager.tasks {
+		pending[document] = task
+	}
+	result, err := manager.transactional(func(documentManager *defaultDocumentManager) error {
+		for document, task := range pending {
+			documentManager.tasks[document] = task
+		}
+		return nil
+	})
+	var partialFlushError *PartialFlushError
+	if err == nil {
+		for document := range pending {
+			delete(manager.tasks, document)
+		}
+	} else if errors.As(err, &partialFlushError) {
+		for _, operation := range partialFlushError.Committed {
+			delete(manager.tasks, operation.Document)
+		}
+	}
+	return result, err
+}
+
+// transactional runs fn with a copy of the document manager bound to a transaction and flushes the tasks of the copy
+// in the transaction, the result is empty if the transaction is aborted. Without transactions, the tasks are flushed
+// after fn and a *PartialFlushError reports the operations executed before a failure.
+func (manager *defaultDocumentManager) transactional(fn func(documentManager *defaultDocumentManager) error) (*FlushResult, error) {
+	if storage, ok := manager.storage.(TransactionalStorage); ok {
+		var committed, attempt *defaultDocumentManager
+		var result *FlushResult
+		err := storage.Transaction(func(storage Storage) (err error) {
+			// a transaction retried after a transient error runs fn again with the documents of the aborted attempt
+			if attempt != nil {
+				attempt.resetAssignedIDs()
+			}
+			documentManager := manager.inTransaction(storage)
+			attempt = documentManager
+			if err = fn(documentManager); err != nil {
+				return err
+			}
+			if result, err = documentManager.flush(false); err != nil {
+				return err
+			}
+			committed = documentManager
+			return nil
+		})
+		if err != ErrTransactionsNotSupported {
+			if err != nil {
+				if attempt != nil {
+					attempt.resetAssignedIDs()
+				}
+				result = &FlushResult{Operations: []Operation{}, Failures: []*FlushError{}}
+				var flushError *FlushError
+				if errors.As(err, &flushError) {
+					result.Failures = append(result.Failures, flushError)
+				}
+				return result, err
+			}
+			for _, document := range committed.removed {
+				manager.metadatas.setIDForValue(document, zeroObjectID)
+			}
+			return result, nil
+		}
+	}
+	manager.log("Transactions are not supported, flushing without transaction")
+	documentManager := manager.inTransaction(manager.storage)
+	documentManager.removed, documentManager.assigned = nil, nil
+	if err := fn(documentManager); err != nil {
+		return nil, err
+	}
+	result, err := documentManager.flush(false)
+	if err != nil {
+		return result, &PartialFlushError{Committed: result.Operations, Err: err}
+	}
+	return result, nil
+}
+
+// inTransaction returns a copy of the document manager with its own pending tasks using storage.
+func (manager *defaultDocumentManager) inTransaction(storage Storage) *defaultDocumentManager {
+	documentManager := *manager
+	documentManager.storage = storage
+	documentManager.tasks = tasks{}
+	documentManager.transactionalFlush = false
+	documentManager.removed = []interface{}{}
+	documentManager.assigned = []interface{}{}
+	documentManager.release = nil
+	return &documentManager
+}
+
+// assign records a document which id was assigned by a document manager bound to a transaction
+func (manager *defaultDocumentManager) assign(document interface{}) {
+	if manager.assigned != nil {
+		manager.assigned = append(manager.assigned, document)
+	}
+}
+
+// resetAssignedIDs resets the ids assigned by a document manager bound to an aborted transaction,
+// so that the documents are inserted again rather than upserted
+func (manager *defaultDocumentManager) resetAssignedIDs() {
+	for _, document := range manager.assigned {
+		manager.metadatas.setIDForValue(document, zeroObjectID)
+	}
+	manager.assigned = []interface{}{}
+}
@@ -0,0 +1,93 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrUniqueViolation is yielded when a unique index rejects the write of a document,
+// errors.As gets the *UniqueViolationError which describes the violation
+var ErrUniqueViolation = fmt.Errorf("Error a unique index rejected the document")
+
+// UniqueViolationError is a write of a document rejected by a unique index,
+// Err is the duplicate key error of the database
+type UniqueViolationError struct {
+	// Collection is the collection of the document
+	Collection string
+	// Index is the name of the unique index
+	Index string
+	// Fields are the names of the struct fields of the index, empty if the index isn't mapped
+	Fields []string
+	// Values are the values of the fields in the document
+	Values []interface{}
+	Err    error
+}
+
+func (err *UniqueViolationError) Error() string {
+	if len(err.Fields) == 0 {
+		return fmt.Sprintf("Error the unique index '%s' of collection '%s' rejected the document", err.Index, err.Collection)
+	}
+	return fmt.Sprintf("Error %s %v already exists in collection '%s' (unique index '%s')",
+		strings.Join(err.Fields, ", "), err.Values, err.Collection, err.Index)
+}
+
+// Is makes errors.Is(err, ErrUniqueViolation) true
+func (err *UniqueViolationError) Is(target error) bool {
+	return target == ErrUniqueViolation
+}
+
+func (err *UniqueViolationError) Unwrap() error {
+	return err.Err
+}
+
+// duplicateKeyIndex matches the name of the index in a duplicate key error message, like
+// "E11000 duplicate key error collection: db.User index: Email_1 dup key: { Email: "x" }",
+// older servers prefix the name with the namespace : "index: db.User.$Email_1"
+var duplicateKeyIndex = regexp.MustCompile(`index: (?:\S+\.\$)?(\S+)`)
+
+// uniqueViolation converts the duplicate key error of the write of document to a *UniqueViolationError.
+// The fields of the error are the fields of the index of meta named in the error message, the values are read in document.
+func uniqueViolation(meta metadata, document map[string]interface{}, err error) error {
+	violation := &UniqueViolationError{Collection: meta.targetDocument, Fields: []string{}, Values: []interface{}{}, Err: err}
+	match := duplicateKeyIndex.FindStringSubmatch(err.Error())
+	if match == nil {
+		return violation
+	}
+	violation.Index = match[1]
+	values, conversionError := toDocument(document)
+	for _, index := range meta.getAllIndexes() {
+		spec := index.Spec()
+		if spec.Name != violation.Index {
+			continue
+		}
+		for _, key := range spec.Key {
+			name := key.Name
+			for _, field := range meta.fields {
+				if field.key == key.Name {
+					name = field.name
+				}
+			}
+			violation.Fields = append(violation.Fields, name)
+			if conversionError == nil {
+				value, _ := getPath(values, strings.Split(key.Name, "."))
+				violation.Values = append(violation.Values, value)
+			}
+		}
+	}
+	return violation
+}
@@ -0,0 +1,118 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MappingError is a problem in the mapping of a field of a document type
+type MappingError struct {
+	// Type is the document type
+	Type string
+	// Field is the struct field
+	Field string
+	// Tag is the odm tag of the field
+	Tag string
+	// Column is the position of the annotation in the tag, 0 if unknown
+	Column int
+	// Parameter is the invalid parameter of the annotation, if any
+	Parameter string
+	// Message describes the problem
+	Message string
+	// Err is either ErrInvalidAnnotation, ErrDocumentNotRegistered or ErrMappedFieldNotFound
+	Err error
+}
+
+func (mappingError *MappingError) Error() string {
+	message := fmt.Sprintf("%s.%s : %s", mappingError.Type, mappingError.Field, mappingError.Message)
+	if mappingError.Tag != "" {
+		message += fmt.Sprintf(" (tag `%s`", mappingError.Tag)
+		if mappingError.Column > 0 {
+			message += fmt.Sprintf(" at column %d", mappingError.Column)
+		}
+		message += ")"
+	}
+	return message
+}
+
+// Unwrap returns the error the MappingError is a case of
+func (mappingError *MappingError) Unwrap() error {
+	return mappingError.Err
+}
+
+// MappingErrors lists every problem found in the mappings of document types
+type MappingErrors []error
+
+func (errors MappingErrors) Error() string {
+	messages := []string{}
+	for _, err := range errors {
+		messages = append(messages, err.Error())
+	}
+	return strings.Join(messages, "\n")
+}
+
+// Unwrap returns the problems found
+func (errors MappingErrors) Unwrap() []error {
+	return errors
+}
+
+// Validate checks the relations between the registered document types : target documents must be registered,
+// mappedBy and inversedBy fields must reference the document and sort fields must exist in the target document.
+// Call it once all the types are registered, so misconfigured mappings fail at startup.
+func (manager *defaultDocumentManager) Validate() error {
+	if errors := manager.GetSchemaManager().ValidateMappings(); len(errors) > 0 {
+		return MappingErrors(errors)
+	}
+	return nil
+}
+
+// checkRelationMapping returns an error if the target document of a relation isn't registered,
+// if the mappedBy or inversedBy field of the relation can't be found or doesn't reference the document,
+// or if the sort field of the relation can't be found
+func (manager *defaultDocumentManager) checkRelationMapping(meta metadata, field field) error {
+	newError := func(err error, parameter string, format string, arguments ...interface{}) error {
+		mappingError := &MappingError{Type: meta.structType.Elem().String(), Field: field.name, Parameter: parameter,
+			Message: fmt.Sprintf(format, arguments...), Err: err}
+		if structField, ok := meta.structType.Elem().FieldByName(field.name); ok {
+			mappingError.Tag = structField.Tag.Get("odm")
+		}
+		return mappingError
+	}
+	relatedMeta, relatedType := manager.metadatas.findMetadataByCollectionName(field.relation.targetDocument)
+	if relatedType == nil {
+		return newError(ErrDocumentNotRegistered, "targetDocument", "target document '%s' is not registered",
+			field.relation.targetDocument)
+	}
+	if field.relation.mapped != 0 {
+		parameter := "mappedBy"
+		if field.relation.mapped == inversedBy {
+			parameter = "inversedBy"
+		}
+		relatedField, ok := relatedMeta.findField(field.relation.mappedField)
+		if !ok || !relatedField.hasRelation() || relatedField.relation.targetDocument != meta.targetDocument {
+			return newError(ErrMappedFieldNotFound, parameter, "%s field '%s' of document '%s' not found or doesn't reference '%s'",
+				parameter, field.relation.mappedField, relatedMeta.targetDocument, meta.targetDocument)
+		}
+	}
+	if sort := strings.TrimPrefix(field.relation.sort, "-"); sort != "" {
+		if _, ok := relatedType.Elem().FieldByName(sort); !ok {
+			return newError(ErrInvalidAnnotation, "sort", "sort field '%s' of document '%s' not found",
+				sort, relatedMeta.targetDocument)
+		}
+	}
+	return nil
+}
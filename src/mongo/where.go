@@ -0,0 +1,208 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongo
+
+import (
+	"strings"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+// queryCondition adds a condition on a field path to a query builder.
+// A path is made of struct field names separated by dots, when a field of the path
+// holds a relation, the rest of the path applies to the related document :
+//
+//	documentManager.CreateQuery().Where("Author.Name").Eq("Bob").All(&articles)
+type queryCondition interface {
+	// Eq matches values equal to value
+	Eq(value interface{}) queryBuilder
+	// Ne matches values not equal to value
+	Ne(value interface{}) queryBuilder
+	// Gt matches values greater than value
+	Gt(value interface{}) queryBuilder
+	// Gte matches values greater than or equal to value
+	Gte(value interface{}) queryBuilder
+	// Lt matches values less than value
+	Lt(value interface{}) queryBuilder
+	// Lte matches values less than or equal to value
+	Lte(value interface{}) queryBuilder
+	// In matches any of the values
+	In(values ...interface{}) queryBuilder
+	// Nin matches none of the values
+	Nin(values ...interface{}) queryBuilder
+	// Exists matches documents that have the field if exists is true
+	Exists(exists bool) queryBuilder
+	// Regex matches values with a regular expression
+	Regex(pattern string, options string) queryBuilder
+}
+
+// criterion is a condition on a field path
+type criterion struct {
+	path     string
+	operator string
+	value    interface{}
+}
+
+type defaultQueryCondition struct {
+	queryBuilder *defaultQueryBuilder
+	path         string
+}
+
+func (condition defaultQueryCondition) add(operator string, value interface{}) queryBuilder {
+	condition.queryBuilder.criteria = append(condition.queryBuilder.criteria, criterion{condition.path, operator, value})
+	return condition.queryBuilder
+}
+
+func (condition defaultQueryCondition) Eq(value interface{}) queryBuilder {
+	return condition.add("$eq", value)
+}
+func (condition defaultQueryCondition) Ne(value interface{}) queryBuilder {
+	return condition.add("$ne", value)
+}
+func (condition defaultQueryCondition) Gt(value interface{}) queryBuilder {
+	return condition.add("$gt", value)
+}
+func (condition defaultQueryCondition) Gte(value interface{}) queryBuilder {
+	return condition.add("$gte", value)
+}
+func (condition defaultQueryCondition) Lt(value interface{}) queryBuilder {
+	return condition.add("$lt", value)
+}
+func (condition defaultQueryCondition) Lte(value interface{}) queryBuilder {
+	return condition.add("$lte", value)
+}
+func (condition defaultQueryCondition) In(values ...interface{}) queryBuilder {
+	return condition.add("$in", values)
+}
+func (condition defaultQueryCondition) Nin(values ...interface{}) queryBuilder {
+	return condition.add("$nin", values)
+}
+func (condition defaultQueryCondition) Exists(exists bool) queryBuilder {
+	return condition.add("$exists", exists)
+}
+func (condition defaultQueryCondition) Regex(pattern string, options string) queryBuilder {
+	return condition.add("$regex", bson.RegEx{Pattern: pattern, Options: options})
+}
+
+// buildFilter returns the query of the query builder and-ed with its criteria
+func (qb *defaultQueryBuilder) buildFilter(meta metadata) (interface{}, error) {
+	if len(qb.criteria) == 0 {
+		return qb.query, nil
+	}
+	conditions := []interface{}{}
+	if qb.query != nil {
+		conditions = append(conditions, qb.query)
+	}
+	for _, criterion := range qb.criteria {
+		condition, err := qb.translateCriterion(meta, strings.Split(criterion.path, "."), criterion)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+	return bson.M{"$and": conditions}, nil
+}
+
+// translateCriterion translates a criterion on a field path of a document into a mongodb query.
+// Conditions on related documents are resolved with a sub query on the related collection
+// and become a $in condition on the document ids or on the key holding the references.
+func (qb *defaultQueryBuilder) translateCriterion(meta metadata, path []string, criterion criterion) (bson.M, error) {
+	f, ok := meta.findField(path[0])
+	if !ok {
+		// not a mapped field, use the path as a key
+		return bson.M{strings.Join(path, "."): bson.M{criterion.operator: criterion.value}}, nil
+	}
+	if !f.hasRelation() || len(path) == 1 {
+		key := f.key
+		if f.name == meta.idField {
+			key = "_id"
+		}
+		if f.hasRelation() {
+			key = f.relation.queryKey(key)
+		}
+		return bson.M{strings.Join(append([]string{key}, path[1:]...), "."): bson.M{criterion.operator: criterion.value}}, nil
+	}
+	manager := qb.documentManager
+	relatedMeta, relatedType := manager.metadatas.findMetadataByCollectionName(f.relation.targetDocument)
+	if relatedType == nil {
+		return nil, ErrDocumentNotRegistered
+	}
+	relatedCondition, err := qb.translateCriterion(relatedMeta, path[1:], criterion)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case f.relation.mapped == mappedBy:
+		relatedField, ok := relatedMeta.findField(f.relation.mappedField)
+		if !ok {
+			return nil, ErrMappedFieldNotFound
+		}
+		if relatedField.relation.through != "" {
+			relatedIDs, err := qb.findIDs(relatedMeta.targetDocument, relatedCondition, "_id")
+			if err != nil {
+				return nil, err
+			}
+			joinKey, inverseJoinKey := manager.getJoinKeys(relatedMeta, relatedField)
+			ids, err := qb.findIDs(relatedField.relation.through, bson.M{joinKey: bson.M{"$in": relatedIDs}}, inverseJoinKey)
+			if err != nil {
+				return nil, err
+			}
+			return bson.M{"_id": bson.M{"$in": ids}}, nil
+		}
+		// the related documents hold the references to the documents
+		ids, err := qb.findIDs(relatedMeta.targetDocument, relatedCondition, relatedField.key)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"_id": bson.M{"$in": ids}}, nil
+	case f.relation.through != "":
+		relatedIDs, err := qb.findIDs(relatedMeta.targetDocument, relatedCondition, "_id")
+		if err != nil {
+			return nil, err
+		}
+		joinKey, inverseJoinKey := manager.getJoinKeys(meta, f)
+		ids, err := qb.findIDs(f.relation.through, bson.M{inverseJoinKey: bson.M{"$in": relatedIDs}}, joinKey)
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{"_id": bson.M{"$in": ids}}, nil
+	default:
+		relatedIDs, err := qb.findIDs(relatedMeta.targetDocument, relatedCondition, "_id")
+		if err != nil {
+			return nil, err
+		}
+		return bson.M{f.relation.queryKey(f.key): bson.M{"$in": relatedIDs}}, nil
+	}
+}
+
+// findIDs returns the ids or the references held in key by the documents of a collection matching query
+func (qb *defaultQueryBuilder) findIDs(collectionName string, query interface{}, key string) ([]bson.ObjectId, error) {
+	results := docs{}
+	if err := qb.documentManager.find(collectionName, query).Select(bson.M{key: 1}).All(&results); err != nil && err != ErrNotFound {
+		return nil, err
+	}
+	ids := []bson.ObjectId{}
+	for _, result := range results {
+		if id, ok := referenceID(result[key]); ok {
+			ids = append(ids, id)
+			continue
+		}
+		ids = append(ids, referenceIDs(result[key])...)
+	}
+	return ids, nil
+}
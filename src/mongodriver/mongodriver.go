@@ -0,0 +1,487 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+// Package mongodriver adapts go.mongodb.org/mongo-driver to the storage of the document manager :
+//
+//	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(url))
+//	documentManager := odm.NewDocumentManagerWithStorage(mongodriver.NewStorage(client.Database("app")))
+//
+// Documents, queries and results are still encoded with gopkg.in/mgo.v2/bson,
+// so the documents keep their bson struct tags and their bson.ObjectId ids.
+package mongodriver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+
+	odm "../mongo"
+
+	driverbson "go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// emptyDocument is the encoding of {}
+var emptyDocument = driverbson.Raw{5, 0, 0, 0, 0}
+
+type storage struct {
+	database *mongo.Database
+	// context is the context of the operations
+	context context.Context
+}
+
+// NewStorage returns a Storage of a database of go.mongodb.org/mongo-driver
+func NewStorage(database *mongo.Database) odm.Storage {
+	return &storage{database, context.Background()}
+}
+
+// WithContext returns a storage which operations are bound to ctx,
+// the driver applies its deadline to the operations
+func (storage *storage) WithContext(ctx context.Context) odm.Storage {
+	bound := *storage
+	bound.context = ctx
+	return &bound
+}
+
+// Transaction runs fn in a transaction of a new session, with automatic retries on transient errors.
+// A standalone server doesn't support transactions, ErrTransactionsNotSupported is returned then.
+func (storage *storage) Transaction(fn func(storage odm.Storage) error) error {
+	session, err := storage.database.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(storage.context)
+	_, err = session.WithTransaction(storage.context, func(ctx mongo.SessionContext) (interface{}, error) {
+		return nil, fn(storage.WithContext(ctx))
+	})
+	var serverError mongo.ServerError
+	if errors.As(err, &serverError) && serverError.HasErrorCodeWithMessage(20, "Transaction numbers") {
+		return odm.ErrTransactionsNotSupported
+	}
+	return err
+}
+
+func (storage *storage) Name() string {
+	return storage.database.Name()
+}
+
+// C returns a collection with the read preference and the write concern of options
+func (storage *storage) C(name string, collectionOptions *odm.CollectionOptions) odm.Collection {
+	opts := options.Collection()
+	if collectionOptions != nil && collectionOptions.ReadMode != nil {
+		opts.SetReadPreference(readPreference(*collectionOptions.ReadMode))
+	}
+	if collectionOptions != nil && collectionOptions.WriteConcern != nil {
+		opts.SetWriteConcern(writeConcern(collectionOptions.WriteConcern))
+	}
+	return collection{storage, storage.database.Collection(name, opts)}
+}
+
+func (storage *storage) Run(command interface{}, result interface{}) error {
+	document, err := encode(command)
+	if err != nil {
+		return err
+	}
+	raw, err := storage.database.RunCommand(storage.context, document).Raw()
+	if err != nil || result == nil {
+		return err
+	}
+	return bson.Unmarshal(raw, result)
+}
+
+func (storage *storage) CollectionNames() ([]string, error) {
+	return storage.database.ListCollectionNames(storage.context, emptyDocument)
+}
+
+type collection struct {
+	storage    *storage
+	collection *mongo.Collection
+}
+
+func (collection collection) Name() string {
+	return collection.collection.Name()
+}
+
+func (collection collection) Find(selector interface{}) odm.Query {
+	return &query{context: collection.storage.context, collection: collection.collection, filter: selector}
+}
+
+func (collection collection) FindId(id interface{}) odm.Query {
+	return collection.Find(bson.M{"_id": id})
+}
+
+func (collection collection) Insert(documents ...interface{}) error {
+	encoded := []interface{}{}
+	for _, document := range documents {
+		document, err := encode(document)
+		if err != nil {
+			return err
+		}
+		encoded = append(encoded, document)
+	}
+	_, err := collection.collection.InsertMany(collection.storage.context, encoded)
+	return err
+}
+
+func (collection collection) Update(selector interface{}, update interface{}) error {
+	changeInfo, err := collection.update(selector, update, false)
+	if err == nil && changeInfo.Matched == 0 {
+		return odm.ErrNotFound
+	}
+	return err
+}
+
+func (collection collection) UpdateAll(selector interface{}, update interface{}) (*odm.ChangeInfo, error) {
+	filter, document, err := encodeTwo(selector, update)
+	if err != nil {
+		return nil, err
+	}
+	result, err := collection.collection.UpdateMany(collection.storage.context, filter, document)
+	if err != nil {
+		return nil, err
+	}
+	return &odm.ChangeInfo{Matched: int(result.MatchedCount), Updated: int(result.ModifiedCount)}, nil
+}
+
+func (collection collection) Upsert(selector interface{}, update interface{}) (*odm.ChangeInfo, error) {
+	return collection.update(selector, update, true)
+}
+
+func (collection collection) UpsertId(id interface{}, update interface{}) (*odm.ChangeInfo, error) {
+	return collection.update(bson.M{"_id": id}, update, true)
+}
+
+func (collection collection) update(selector interface{}, update interface{}, upsert bool) (*odm.ChangeInfo, error) {
+	filter, document, err := encodeTwo(selector, update)
+	if err != nil {
+		return nil, err
+	}
+	result, err := collection.collection.UpdateOne(collection.storage.context, filter, document, options.Update().SetUpsert(upsert))
+	if err != nil {
+		return nil, err
+	}
+	changeInfo := &odm.ChangeInfo{Matched: int(result.MatchedCount), Updated: int(result.ModifiedCount)}
+	if result.UpsertedID != nil {
+		if changeInfo.UpsertedId, err = decodeValue(result.UpsertedID); err != nil {
+			return nil, err
+		}
+	}
+	return changeInfo, nil
+}
+
+func (collection collection) Remove(selector interface{}) error {
+	filter, err := encode(selector)
+	if err != nil {
+		return err
+	}
+	result, err := collection.collection.DeleteOne(collection.storage.context, filter)
+	if err == nil && result.DeletedCount == 0 {
+		return odm.ErrNotFound
+	}
+	return err
+}
+
+func (collection collection) RemoveId(id interface{}) error {
+	return collection.Remove(bson.M{"_id": id})
+}
+
+func (collection collection) RemoveAll(selector interface{}) (*odm.ChangeInfo, error) {
+	filter, err := encode(selector)
+	if err != nil {
+		return nil, err
+	}
+	result, err := collection.collection.DeleteMany(collection.storage.context, filter)
+	if err != nil {
+		return nil, err
+	}
+	return &odm.ChangeInfo{Removed: int(result.DeletedCount), Matched: int(result.DeletedCount)}, nil
+}
+
+func (collection collection) Aggregate(pipeline interface{}, result interface{}) error {
+	// the stages are encoded as an array of a document
+	document, err := encode(bson.M{"pipeline": pipeline})
+	if err != nil {
+		return err
+	}
+	stages := struct {
+		Pipeline []driverbson.Raw `bson:"pipeline"`
+	}{}
+	if err = driverbson.Unmarshal(document, &stages); err != nil {
+		return err
+	}
+	cursor, err := collection.collection.Aggregate(collection.storage.context, stages.Pipeline)
+	if err != nil {
+		return err
+	}
+	return decodeAll(collection.storage.context, cursor, result)
+}
+
+func (collection collection) CreateIndex(index odm.Index) error {
+	return collection.storage.Run(bson.D{{Name: "createIndexes", Value: collection.collection.Name()},
+		{Name: "indexes", Value: []interface{}{index.Spec()}}}, nil)
+}
+
+func (collection collection) Indexes() ([]odm.Index, error) {
+	cursor, err := collection.collection.Indexes().List(collection.storage.context)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(collection.storage.context)
+	indexes := []odm.Index{}
+	for cursor.Next(collection.storage.context) {
+		spec := odm.IndexSpec{}
+		if err = bson.Unmarshal(cursor.Current, &spec); err != nil {
+			return nil, err
+		}
+		indexes = append(indexes, spec.Index())
+	}
+	return indexes, cursor.Err()
+}
+
+func (collection collection) DropIndexName(name string) error {
+	_, err := collection.collection.Indexes().DropOne(collection.storage.context, name)
+	return err
+}
+
+type query struct {
+	context    context.Context
+	collection *mongo.Collection
+	filter     interface{}
+	projection interface{}
+	sort       []string
+	skip       int
+	limit      int
+	batch      int
+}
+
+func (query *query) Select(selector interface{}) odm.Query {
+	query.projection = selector
+	return query
+}
+
+func (query *query) Sort(fields ...string) odm.Query {
+	query.sort = fields
+	return query
+}
+
+func (query *query) Skip(n int) odm.Query {
+	query.skip = n
+	return query
+}
+
+func (query *query) Limit(n int) odm.Query {
+	query.limit = n
+	return query
+}
+
+func (query *query) Batch(n int) odm.Query {
+	query.batch = n
+	return query
+}
+
+func (query *query) One(result interface{}) error {
+	filter, err := encode(query.filter)
+	if err != nil {
+		return err
+	}
+	opts := options.FindOne().SetSort(sortDocument(query.sort)).SetSkip(int64(query.skip))
+	if query.projection != nil {
+		projection, err := encode(query.projection)
+		if err != nil {
+			return err
+		}
+		opts.SetProjection(projection)
+	}
+	raw, err := query.collection.FindOne(query.context, filter, opts).Raw()
+	if err == mongo.ErrNoDocuments {
+		return odm.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, result)
+}
+
+func (query *query) All(result interface{}) error {
+	cursor, err := query.cursor()
+	if err != nil {
+		return err
+	}
+	return decodeAll(query.context, cursor, result)
+}
+
+func (query *query) Count() (int, error) {
+	filter, err := encode(query.filter)
+	if err != nil {
+		return 0, err
+	}
+	opts := options.Count().SetSkip(int64(query.skip))
+	if query.limit > 0 {
+		opts.SetLimit(int64(query.limit))
+	}
+	count, err := query.collection.CountDocuments(query.context, filter, opts)
+	return int(count), err
+}
+
+func (query *query) Iter() odm.Iter {
+	cursor, err := query.cursor()
+	return &iter{context: query.context, cursor: cursor, err: err}
+}
+
+func (query *query) cursor() (*mongo.Cursor, error) {
+	filter, err := encode(query.filter)
+	if err != nil {
+		return nil, err
+	}
+	opts := options.Find().SetSort(sortDocument(query.sort)).SetSkip(int64(query.skip)).SetLimit(int64(query.limit))
+	if query.batch > 0 {
+		opts.SetBatchSize(int32(query.batch))
+	}
+	if query.projection != nil {
+		projection, err := encode(query.projection)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetProjection(projection)
+	}
+	return query.collection.Find(query.context, filter, opts)
+}
+
+type iter struct {
+	context context.Context
+	cursor  *mongo.Cursor
+	err     error
+}
+
+func (iter *iter) Next(result interface{}) bool {
+	if iter.err != nil || !iter.cursor.Next(iter.context) {
+		return false
+	}
+	if iter.err = bson.Unmarshal(iter.cursor.Current, result); iter.err != nil {
+		return false
+	}
+	return true
+}
+
+func (iter *iter) Close() error {
+	if iter.cursor == nil {
+		return iter.err
+	}
+	if err := iter.cursor.Err(); err != nil && iter.err == nil {
+		iter.err = err
+	}
+	if err := iter.cursor.Close(iter.context); err != nil && iter.err == nil {
+		iter.err = err
+	}
+	return iter.err
+}
+
+// encode encodes a document with gopkg.in/mgo.v2/bson, nil is encoded as {}
+func encode(document interface{}) (driverbson.Raw, error) {
+	if document == nil {
+		return emptyDocument, nil
+	}
+	data, err := bson.Marshal(document)
+	return driverbson.Raw(data), err
+}
+
+func encodeTwo(first, second interface{}) (driverbson.Raw, driverbson.Raw, error) {
+	firstDocument, err := encode(first)
+	if err != nil {
+		return nil, nil, err
+	}
+	secondDocument, err := encode(second)
+	return firstDocument, secondDocument, err
+}
+
+// decodeValue converts a value of go.mongodb.org/mongo-driver, like a primitive.ObjectID,
+// to a value of gopkg.in/mgo.v2/bson
+func decodeValue(value interface{}) (interface{}, error) {
+	data, err := driverbson.Marshal(driverbson.D{{Key: "value", Value: value}})
+	if err != nil {
+		return nil, err
+	}
+	result := struct {
+		Value interface{} `bson:"value"`
+	}{}
+	err = bson.Unmarshal(data, &result)
+	return result.Value, err
+}
+
+// decodeAll decodes the documents of cursor in result, a pointer to slice
+func decodeAll(ctx context.Context, cursor *mongo.Cursor, result interface{}) error {
+	defer cursor.Close(ctx)
+	slice := reflect.ValueOf(result).Elem()
+	slice = slice.Slice(0, 0)
+	for cursor.Next(ctx) {
+		element := reflect.New(slice.Type().Elem())
+		if err := bson.Unmarshal(cursor.Current, element.Interface()); err != nil {
+			return err
+		}
+		slice = reflect.Append(slice, element.Elem())
+	}
+	reflect.ValueOf(result).Elem().Set(slice)
+	return cursor.Err()
+}
+
+// sortDocument converts mgo sort fields, prefixed with a dash (-) for a descending order, to a sort document
+func sortDocument(fields []string) driverbson.D {
+	document := driverbson.D{}
+	for _, field := range fields {
+		if strings.HasPrefix(field, "-") {
+			document = append(document, driverbson.E{Key: field[1:], Value: -1})
+			continue
+		}
+		document = append(document, driverbson.E{Key: strings.TrimPrefix(field, "+"), Value: 1})
+	}
+	return document
+}
+
+// readPreference converts a mgo consistency mode to a read preference
+func readPreference(mode mgo.Mode) *readpref.ReadPref {
+	switch mode {
+	case mgo.PrimaryPreferred, mgo.Monotonic:
+		return readpref.PrimaryPreferred()
+	case mgo.Secondary:
+		return readpref.Secondary()
+	case mgo.SecondaryPreferred:
+		return readpref.SecondaryPreferred()
+	case mgo.Nearest, mgo.Eventual:
+		return readpref.Nearest()
+	}
+	return readpref.Primary()
+}
+
+// writeConcern converts a mgo safety mode to a write concern
+func writeConcern(safe *mgo.Safe) *writeconcern.WriteConcern {
+	concern := &writeconcern.WriteConcern{WTimeout: time.Duration(safe.WTimeout) * time.Millisecond}
+	switch {
+	case safe.WMode != "":
+		concern.W = safe.WMode
+	case safe.W > 0:
+		concern.W = safe.W
+	}
+	if safe.J || safe.FSync {
+		journal := true
+		concern.Journal = &journal
+	}
+	return concern
+}
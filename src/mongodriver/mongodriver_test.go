@@ -0,0 +1,85 @@
+//    Copyright (C) 2016  mparaiso <mparaiso@online.fr>
+//
+//    Licensed under the Apache License, Version 2.0 (the "License");
+//    you may not use this file except in compliance with the License.
+//    You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS,
+//    WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//    See the License for the specific language governing permissions and
+//    limitations under the License.
+
+package mongodriver_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	odm "../mongo"
+	"../mongodriver"
+	"../test"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"gopkg.in/mgo.v2/bson"
+)
+
+type Author struct {
+	ID   bson.ObjectId `bson:"_id"`
+	Name string        `bson:"Name" odm:"index(unique:true)"`
+}
+
+type Article struct {
+	ID     bson.ObjectId `bson:"_id"`
+	Title  string        `bson:"Title"`
+	Author *Author       `odm:"referenceOne(targetDocument:Author,cascade:persist)"`
+}
+
+func getStorage(t *testing.T) (storage odm.Storage, done func()) {
+	url := os.Getenv("MONGODB_TEST_SERVER")
+	if url == "" {
+		t.Skip("MONGODB_TEST_SERVER is not set")
+	}
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI("mongodb://"+url))
+	test.Fatal(t, err, nil)
+	database := client.Database(os.Getenv("MONGODB_TEST_DB") + "_mongodriver")
+	return mongodriver.NewStorage(database), func() {
+		database.Drop(context.Background())
+		client.Disconnect(context.Background())
+	}
+}
+
+func TestNewStorage(t *testing.T) {
+	storage, done := getStorage(t)
+	defer done()
+	test.Fatal(t, storage.Name(), os.Getenv("MONGODB_TEST_DB")+"_mongodriver")
+	test.Fatal(t, storage.C("Article", nil).Name(), "Article")
+	_, ok := storage.(odm.TransactionalStorage)
+	test.Fatal(t, ok, true)
+}
+
+func TestNewStorage_DocumentManager(t *testing.T) {
+	storage, done := getStorage(t)
+	defer done()
+	documentManager := odm.NewDocumentManagerWithStorage(storage)
+	err := documentManager.RegisterMany(map[string]interface{}{"Author": new(Author), "Article": new(Article)})
+	test.Fatal(t, err, nil)
+	test.Fatal(t, documentManager.GetSchemaManager().EnsureIndexes(), nil)
+	article := &Article{Title: "Go", Author: &Author{Name: "Rob"}}
+	documentManager.Persist(article)
+	test.Fatal(t, documentManager.Flush(), nil)
+	found := new(Article)
+	test.Fatal(t, documentManager.FindID(article.ID, found), nil)
+	test.Fatal(t, found.Title, "Go")
+	test.Fatal(t, found.Author.Name, "Rob")
+	test.Fatal(t, documentManager.FindID(bson.NewObjectId(), new(Article)), odm.ErrNotFound)
+	diffs, err := documentManager.GetSchemaManager().DiffIndexes()
+	test.Fatal(t, err, nil)
+	for _, diff := range diffs {
+		test.Fatal(t, diff.IsEmpty(), true, diff.String())
+	}
+}
@@ -57,6 +57,8 @@ type Definition struct {
 	Name       string
 	Value      string
 	Parameters []Parameter
+	// Column is the column of the definition in the tag, starting at 1
+	Column int
 }
 
 // IsSimple returns true if the definition doesn't have parameters
@@ -87,7 +89,7 @@ func (parser *defaultParser) Parse() (definitions []*Definition, err error) {
 		} else if token == scanner.Ident {
 			// if identifier , add a definition with identifier as name
 			parser.log(logger.Debug, "found identifer ", parser.scanner.TokenText())
-			definition := &Definition{Name: parser.scanner.TokenText()}
+			definition := &Definition{Name: parser.scanner.TokenText(), Column: parser.scanner.Position.Column}
 			definitions = append(definitions, definition)
 			if token = parser.scanner.Scan(); token != ':' && token != '(' && token != ';' && token != scanner.EOF {
 				parser.log(logger.Error, "found", string(token))
@@ -145,5 +147,17 @@ func (parser *defaultParser) Parse() (definitions []*Definition, err error) {
 }
 func (parser *defaultParser) errorUnexpectedToken() error {
 	parser.log(logger.Error, "found", parser.scanner.TokenText())
-	return fmt.Errorf("Error unexpected token '%s' at position %d in ", parser.scanner.TokenText(), parser.scanner.Pos().Column)
+	return &SyntaxError{Token: parser.scanner.TokenText(), Column: parser.scanner.Pos().Column}
+}
+
+// SyntaxError is returned by Parse when a tag doesn't follow the grammar
+type SyntaxError struct {
+	// Token is the unexpected token
+	Token string
+	// Column is the column following the unexpected token
+	Column int
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("Error unexpected token '%s' at position %d", err.Token, err.Column)
 }
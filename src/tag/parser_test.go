@@ -43,10 +43,10 @@ func TestParser(t *testing.T) {
 		{`field:foo;complex_field(name:param,name2:param2,name_3:3);field:1;last_field`,
 			4,
 			[]*tag.Definition{
-				{Name: "field", Value: "foo"},
-				{Name: "complex_field", Parameters: []tag.Parameter{{Key: "name", Value: "param"}, {Key: "name2", Value: "param2"}, {Key: "name_3", Value: "3"}}},
-				{Name: "field", Value: "1"},
-				{Name: "last_field"},
+				{Name: "field", Value: "foo", Column: 1},
+				{Name: "complex_field", Parameters: []tag.Parameter{{Key: "name", Value: "param"}, {Key: "name2", Value: "param2"}, {Key: "name_3", Value: "3"}}, Column: 11},
+				{Name: "field", Value: "1", Column: 59},
+				{Name: "last_field", Column: 67},
 			},
 		},
 	} {
@@ -59,3 +59,11 @@ func TestParser(t *testing.T) {
 	}
 
 }
+
+func TestParser_SyntaxError(t *testing.T) {
+	_, err := tag.NewParser(strings.NewReader(`index(unique:true);referenceOne(targetDocument:)`)).Parse()
+	syntaxError, ok := err.(*tag.SyntaxError)
+	test.Fatal(t, ok, true)
+	test.Fatal(t, syntaxError.Token, ")")
+	test.Fatal(t, syntaxError.Column, 49)
+}